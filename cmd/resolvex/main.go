@@ -18,15 +18,18 @@ import (
 	"github.com/im-kulikov/resolvex/internal/domain"
 	"github.com/im-kulikov/resolvex/internal/resolver"
 	"github.com/im-kulikov/resolvex/internal/storage"
+	"github.com/im-kulikov/resolvex/internal/subscription"
 )
 
 type settings struct {
 	config.Base
 
-	API api.Config      `env:"API"`
-	BGP bgp.Config      `env:"BGP"`
-	DNS resolver.Config `env:"DNS"`
-	CLI domain.Config   `env:"CLI"`
+	API   api.Config          `env:"API"`
+	BGP   bgp.Config          `env:"BGP"`
+	DNS   resolver.Config     `env:"DNS"`
+	CLI   domain.Config       `env:"CLI"`
+	Lists subscription.Config `env:"LISTS"`
+	Store storage.Config      `env:"STORE"`
 
 	Shutdown time.Duration `env:"SHUTDOWN" default:"5s"`
 }
@@ -64,19 +67,25 @@ func main() {
 	manager := broadcast.New(cfg.BGP.Attributes, log)
 
 	var domains []string
-	if domains, err = domain.Fetch(cfg.CLI); err != nil {
+	if domains, err = domain.Fetch(cfg.CLI, log); err != nil {
 		logger.Error("could not fetch domain list", logger.Err(err))
 
 		return
 	}
 
 	var store storage.Repository
-	if store, err = storage.New(log, manager, domains); err != nil {
+	if store, err = storage.New(cfg.Store, log, manager, domains); err != nil {
 		logger.Error("could not create domain storage", logger.Err(err))
 
 		return
 	}
 
+	defer func() {
+		if err = store.Close(); err != nil {
+			logger.Error("could not close domain storage", logger.Err(err))
+		}
+	}()
+
 	var dnsService service.Service
 	if dnsService, err = resolver.New(cfg.DNS, log, store); err != nil {
 		logger.Error("could not create resolver service", logger.Err(err))
@@ -84,6 +93,27 @@ func main() {
 		return
 	}
 
+	var fwdService service.Service
+	if fwdService, err = resolver.NewForwarder(cfg.DNS, log, store, manager); err != nil {
+		logger.Error("could not create forwarder service", logger.Err(err))
+
+		return
+	}
+
+	var tapService service.Service
+	if tapService, err = resolver.NewDnstap(cfg.DNS, log, store); err != nil {
+		logger.Error("could not create dnstap service", logger.Err(err))
+
+		return
+	}
+
+	var subService service.Service
+	if subService, err = subscription.New(cfg.Lists, log, store); err != nil {
+		logger.Error("could not create subscription service", logger.Err(err))
+
+		return
+	}
+
 	var bgpService service.Service
 	if bgpService, err = bgp.New(cfg.BGP, log, manager); err != nil {
 		logger.Error("could not create bgp service", logger.Err(err))
@@ -106,7 +136,7 @@ func main() {
 	}
 
 	log.Info("start service", logger.String("version", version))
-	if err = service.Run(log, service.WithService(manager, dnsService, bgpService, apiService, opsService)); err != nil {
+	if err = service.Run(log, service.WithService(manager, dnsService, fwdService, tapService, subService, bgpService, apiService, opsService)); err != nil {
 		logger.Error("could not create service runner", logger.Err(err))
 	}
 }
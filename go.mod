@@ -6,20 +6,26 @@ go 1.24
 
 require (
 	github.com/davecgh/go-spew v1.1.1
+	github.com/dnstap/golang-dnstap v0.4.0
 	github.com/im-kulikov/go-bones v0.1.0-rc.1
 	github.com/jwhited/corebgp v0.8.5
+	github.com/klauspost/compress v1.18.0
 	github.com/maypok86/otter/v2 v2.2.1
 	github.com/miekg/dns v1.1.67
 	github.com/stretchr/testify v1.10.0
+	go.etcd.io/bbolt v1.4.3
 	go.uber.org/zap v1.27.0
 	go.uber.org/zap/exp v0.3.0
 	golang.org/x/net v0.42.0
 	golang.org/x/sync v0.16.0
+	golang.org/x/time v0.12.0
+	google.golang.org/protobuf v1.36.6
 )
 
 require (
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/farsightsec/golang-framestream v0.3.0 // indirect
 	github.com/go-viper/mapstructure/v2 v2.4.0 // indirect
 	github.com/im-kulikov/gonfig v0.5.2 // indirect
 	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
@@ -38,6 +44,5 @@ require (
 	golang.org/x/sys v0.34.0 // indirect
 	golang.org/x/text v0.27.0 // indirect
 	golang.org/x/tools v0.34.0 // indirect
-	google.golang.org/protobuf v1.36.6 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -3,8 +3,29 @@ const { useState, useEffect } = React;
 
 interface Item {
     domain: string;
+    parent?: string;
     record: null | string[];
     expire: null | Date;
+    chain?: string[];
+    status?: {
+        rcode?: string;
+        error?: string;
+        failures: number;
+        success?: Date;
+        disagreement?: {
+            answers: Record<string, null | string[]>;
+            rejected?: string[];
+        };
+        dnssec?: 'secure' | 'insecure' | 'bogus';
+    };
+    hold?: Record<string, number>;
+    sources?: string[];
+}
+
+interface Guard {
+    alert: boolean;
+    since?: Date;
+    withheld: null | string[];
 }
 
 type AlertType = 'success' | 'danger';
@@ -57,6 +78,7 @@ function Page() {
     const [total, setTotal] = useState(0)
     const [loading, setLoading] = useState(0)
     const [alerts, setAlerts] = useState([] as Alert[])
+    const [guard, setGuard] = useState(null as null | Guard)
     // @ts-ignore
     const [listUniqIPS, setListUniqIPS] = useState<Map<string, number>>(new Map());
 
@@ -111,6 +133,7 @@ function Page() {
                 })
 
                 setItems(data.list)
+                setGuard(data.guard)
 
                 return data.list
             })
@@ -184,6 +207,23 @@ function Page() {
         }
     }
 
+    const acknowledge = () => {
+        if (!confirm("Отозвать замороженные маршруты?")) return;
+
+        fetch('/api/guard/ack', { method: 'POST' })
+            .then(res => {
+                if (res.ok) {
+                    pushAlert("success", "Маршруты отозваны")
+
+                    return fetchData()
+                }
+
+                return res.text().then(text => {
+                    throw new Error(text || "Server error")
+                })
+            }).catch(err => pushAlert("danger", err))
+    }
+
     function onSubmit(event: FormDataEvent) {
         event.preventDefault()
 
@@ -263,6 +303,15 @@ function Page() {
     return (<div class="container-sm mx-auto table-responsive-sm">
         <h1 className="text-center h3 my-3">Управление DNS / BGP</h1>
 
+        {guard?.alert && <div className="alert alert-danger d-flex align-items-center" role="alert">
+            <div className="me-auto" title={guard.withheld?.join(",")}>
+                Массовый отзыв маршрутов заморожен
+                {guard.since && <span> с {(new Date(guard.since)).toLocaleString('ru-RU', {})}</span>}:
+                удерживается {guard.withheld?.length || 0} адресов
+            </div>
+            <button type="button" className="btn btn-danger btn-sm" onClick={acknowledge}>Подтвердить</button>
+        </div>}
+
         <form className="needs-validation position-relative" noValidate onSubmit={onSubmit}>
             <div className="input-group has-validation">
                 <button className="btn btn-success" type="button" onClick={fetchData}>&#8635;</button>
@@ -355,12 +404,40 @@ function Page() {
             {items && items.map(item => {
                 return (!filter || item.domain.includes(filter)) && (<tr key={item.domain}>
                     <td className="w-40 text-nowrap"
-                        style={{overflow: "hidden", textOverflow: "ellipsis"}}>{item.domain}</td>
+                        style={{overflow: "hidden", textOverflow: "ellipsis"}}>
+                        {item.domain}
+                        {item.parent && <small className="text-muted ms-1" title="Найден по wildcard или CNAME">({item.parent})</small>}
+                        {item.sources?.map((name) =>
+                            <span key={name} className="badge text-bg-light border ms-1" title="Список-источник">{name}</span>)}
+                        {item.status && item.status.failures > 0 &&
+                            <span className="badge text-bg-danger ms-1"
+                                  title={`Ошибок подряд: ${item.status.failures}` + (item.status.success ? `, последний успех: ${(new Date(item.status.success)).toLocaleString('ru-RU', {})}` : "")}>
+                                {item.status.error || item.status.rcode}
+                            </span>}
+                        {item.status?.dnssec && item.status.dnssec !== 'insecure' &&
+                            <span className={`badge ms-1 ${item.status.dnssec === 'secure' ? "text-bg-success" : "text-bg-danger"}`}
+                                  title="Проверка DNSSEC">
+                                {item.status.dnssec === 'secure' ? "DNSSEC" : "DNSSEC: подделка"}
+                            </span>}
+                        {item.status?.disagreement &&
+                            <span className={`badge ms-1 ${item.status.disagreement.rejected ? "text-bg-warning" : "text-bg-secondary"}`}
+                                  title={Object.entries(item.status.disagreement.answers).map(([server, list]) => `${server}: ${list?.join(", ") || "—"}`).join("\n") +
+                                      (item.status.disagreement.rejected ? `\nОтклонены: ${item.status.disagreement.rejected.join(", ")}` : "")}>
+                                {item.status.disagreement.rejected ? `отклонено ${item.status.disagreement.rejected.length}` : "ответы различаются"}
+                            </span>}
+                        {item.chain && <div className="small text-muted text-truncate" title={item.chain.join(" → ")}>
+                            CNAME: {item.chain.slice(1).join(" → ")}
+                        </div>}
+                    </td>
                     <td className="w-15 text-center">{item.expire ? (new Date(item.expire)).toLocaleString('ru-RU', {}) : "—"}</td>
                     <td className="w-10 text-center text-nowrap" title={item.record && item.record.join(",")}>
                         {item.record?.filter((key) => listUniqIPS?.get(key) <= 1).length || 0}
                         <span> / </span>
                         {item.record?.length || 0}
+                        {item.hold && <small className="text-muted ms-1"
+                                             title={Object.entries(item.hold).map(([ip, left]) => `${ip}: ${left ? Math.ceil(left / 60) + ' мин' : 'до замены'}`).join("\n")}>
+                            (удерживается {Object.keys(item.hold).length})
+                        </small>}
                     </td>
                     <td className="w-15 text-center text-nowrap">
                         <div className="input-group" style={{minWidth: '70px'}}>
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/im-kulikov/go-bones/logger"
@@ -12,12 +13,21 @@ import (
 	"golang.org/x/net/idna"
 
 	"github.com/im-kulikov/resolvex/internal/domain"
+	"github.com/im-kulikov/resolvex/internal/storage"
 )
 
 type ResponseItem struct {
 	Domain string    `json:"domain"`
+	Parent string    `json:"parent,omitempty"`
 	Record []string  `json:"record"`
 	Expire time.Time `json:"expire"`
+	Chain  []string  `json:"chain,omitempty"`
+	// Status describes the last resolution of the domain.
+	Status *ResponseStatus `json:"status,omitempty"`
+	// Hold contains seconds left before withdrawal of addresses kept by retention policy.
+	Hold map[string]int64 `json:"hold,omitempty"`
+	// Sources contains names of list subscriptions the domain came from.
+	Sources []string `json:"sources,omitempty"`
 }
 
 type ResponseList struct {
@@ -30,10 +40,73 @@ type ErrorResponse struct {
 	Description string `json:"description,omitempty"`
 }
 
+// ResponseStatus describes the last resolution of the domain.
+type ResponseStatus struct {
+	Rcode    string    `json:"rcode,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Failures int       `json:"failures"`
+	Success  time.Time `json:"success,omitzero"`
+	// Disagreement describes different answers of servers, it is omitted when servers agree.
+	Disagreement *ResponseDisagreement `json:"disagreement,omitempty"`
+	// DNSSEC contains the validation status of the last answer, it is omitted when validation is disabled.
+	DNSSEC string `json:"dnssec,omitempty"`
+}
+
+// ResponseDisagreement describes different answers of servers for the domain.
+type ResponseDisagreement struct {
+	Answers  map[string][]string `json:"answers"`
+	Rejected []string            `json:"rejected,omitempty"`
+}
+
+// ResponseGuard describes the state of the mass-withdrawal guard.
+type ResponseGuard struct {
+	Alert    bool      `json:"alert"`
+	Since    time.Time `json:"since,omitzero"`
+	Withheld []string  `json:"withheld"`
+}
+
 type Response struct {
 	*ErrorResponse
 	*ResponseItem
 	*ResponseList
+
+	Guard *ResponseGuard `json:"guard,omitempty"`
+}
+
+func newResponseStatus(status storage.Status) *ResponseStatus {
+	if status == (storage.Status{}) {
+		return nil
+	}
+
+	out := &ResponseStatus{
+		Rcode:    status.Rcode,
+		Error:    status.Error,
+		Failures: status.Failures,
+		Success:  status.Success,
+		DNSSEC:   status.DNSSEC,
+	}
+
+	if status.Disagreement != nil {
+		out.Disagreement = &ResponseDisagreement{
+			Answers:  status.Disagreement.Answers,
+			Rejected: status.Disagreement.Rejected,
+		}
+	}
+
+	return out
+}
+
+func holdSeconds(hold map[string]time.Duration) map[string]int64 {
+	if len(hold) == 0 {
+		return nil
+	}
+
+	out := make(map[string]int64, len(hold))
+	for address, left := range hold {
+		out[address] = int64(left / time.Second)
+	}
+
+	return out
 }
 
 type ErrorHandler func(http.ResponseWriter, *http.Request) error
@@ -43,6 +116,9 @@ func validateDomain(domain string) error {
 		return errors.New("domain is required")
 	}
 
+	// для wildcard проверяем домен, который он покрывает
+	domain = strings.TrimPrefix(domain, "*.")
+
 	if _, err := idna.Lookup.ToASCII(domain); err != nil {
 		return err
 	}
@@ -64,12 +140,45 @@ func (s *server) listCacheItems(w http.ResponseWriter, _ *http.Request) error {
 	for rec := range s.List() {
 		result.List = append(result.List, ResponseItem{
 			Domain: rec.Domain,
+			Parent: rec.Parent,
 			Record: rec.Record,
 			Expire: rec.Expire,
+			Chain:  rec.Chain,
+			Status: newResponseStatus(rec.Status),
+			Hold:   holdSeconds(rec.Hold),
+
+			Sources: rec.Sources,
 		})
 	}
 
-	return json.NewEncoder(w).Encode(Response{ResponseList: &result})
+	return json.NewEncoder(w).Encode(Response{ResponseList: &result, Guard: s.guardStatus()})
+}
+
+func (s *server) guardStatus() *ResponseGuard {
+	status := s.Guard()
+
+	return &ResponseGuard{Alert: status.Alert, Since: status.Since, Withheld: status.Withheld}
+}
+
+func (s *server) getGuard(w http.ResponseWriter, _ *http.Request) error {
+	return json.NewEncoder(w).Encode(Response{Guard: s.guardStatus()})
+}
+
+func (s *server) acknowledgeGuard(w http.ResponseWriter, r *http.Request) error {
+	if !s.Acknowledge() {
+		w.WriteHeader(http.StatusConflict)
+
+		return json.NewEncoder(w).Encode(Response{
+			ErrorResponse: &ErrorResponse{
+				Code:    "409",
+				Message: "No mass-withdrawal alert",
+			},
+		})
+	}
+
+	s.WarnContext(r.Context(), "mass-withdrawal alert acknowledged by operator")
+
+	return json.NewEncoder(w).Encode(Response{Guard: s.guardStatus()})
 }
 
 func (s *server) createCacheItem(w http.ResponseWriter, r *http.Request) error {
@@ -209,6 +318,8 @@ func (s *server) attach(srv *http.Server) {
 	mux.HandleFunc("POST /api", wrapErrorHandler(s.createCacheItem))
 	mux.HandleFunc("PUT /api/{domain}/", wrapErrorHandler(s.updateCacheItem))
 	mux.HandleFunc("DELETE /api/{domain}/", wrapErrorHandler(s.deleteCacheItem))
+	mux.HandleFunc("GET /api/guard", wrapErrorHandler(s.getGuard))
+	mux.HandleFunc("POST /api/guard/ack", wrapErrorHandler(s.acknowledgeGuard))
 
 	srv.Handler = mux
 }
@@ -0,0 +1,243 @@
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// CommunitiesAttrType and LargeCommunitiesAttrType represent attribute types for communities.
+const (
+	CommunitiesAttrType      = 8
+	LargeCommunitiesAttrType = 32
+)
+
+// Well-known communities (RFC 1997, RFC 7999).
+const (
+	CommunityBlackhole         uint32 = 0xFFFF029A
+	CommunityNoExport          uint32 = 0xFFFFFF01
+	CommunityNoAdvertise       uint32 = 0xFFFFFF02
+	CommunityNoExportSubconfed uint32 = 0xFFFFFF03
+)
+
+// AttributeCommunities represents a COMMUNITIES attribute (RFC 1997).
+type AttributeCommunities struct {
+	Values []uint32
+}
+
+// Encode serializes the AttributeCommunities into a byte slice.
+func (a *AttributeCommunities) Encode() ([]byte, error) {
+	if len(a.Values) == 0 {
+		return nil, fmt.Errorf("communities attribute should not be empty")
+	}
+
+	buf := make([]byte, 0, len(a.Values)*4)
+	for _, value := range a.Values {
+		buf = binary.BigEndian.AppendUint32(buf, value)
+	}
+
+	return encodeAttribute(flagOptional|flagTransitive, CommunitiesAttrType, buf), nil
+}
+
+// Type returns the type of the BGP attribute represented by AttributeCommunities.
+func (a *AttributeCommunities) Type() uint8 { return CommunitiesAttrType }
+
+// LargeCommunity represents a single large community value (RFC 8092).
+type LargeCommunity struct {
+	GlobalAdmin uint32
+	LocalData1  uint32
+	LocalData2  uint32
+}
+
+// AttributeLargeCommunities represents a LARGE_COMMUNITIES attribute (RFC 8092).
+type AttributeLargeCommunities struct {
+	Values []LargeCommunity
+}
+
+// Encode serializes the AttributeLargeCommunities into a byte slice.
+func (a *AttributeLargeCommunities) Encode() ([]byte, error) {
+	if len(a.Values) == 0 {
+		return nil, fmt.Errorf("large communities attribute should not be empty")
+	}
+
+	var buf bytes.Buffer
+	for _, value := range a.Values {
+		buf.Write(binary.BigEndian.AppendUint32(nil, value.GlobalAdmin))
+		buf.Write(binary.BigEndian.AppendUint32(nil, value.LocalData1))
+		buf.Write(binary.BigEndian.AppendUint32(nil, value.LocalData2))
+	}
+
+	return encodeAttribute(flagOptional|flagTransitive, LargeCommunitiesAttrType, buf.Bytes()), nil
+}
+
+// Type returns the type of the BGP attribute represented by AttributeLargeCommunities.
+func (a *AttributeLargeCommunities) Type() uint8 { return LargeCommunitiesAttrType }
+
+// ParseCommunity parses a community in `asn:value` format or one of well-known names.
+func ParseCommunity(value string) (uint32, error) {
+	switch strings.ToLower(value) {
+	case "blackhole":
+		return CommunityBlackhole, nil
+	case "no-export":
+		return CommunityNoExport, nil
+	case "no-advertise":
+		return CommunityNoAdvertise, nil
+	case "no-export-subconfed":
+		return CommunityNoExportSubconfed, nil
+	}
+
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid community %q: expected asn:value", value)
+	}
+
+	var out uint32
+	for _, part := range parts {
+		num, err := strconv.ParseUint(part, 10, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid community %q: %w", value, err)
+		}
+
+		out = out<<16 | uint32(num)
+	}
+
+	return out, nil
+}
+
+// ParseLargeCommunity parses a large community in `global:local1:local2` format.
+func ParseLargeCommunity(value string) (LargeCommunity, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return LargeCommunity{}, fmt.Errorf("invalid large community %q: expected global:local1:local2", value)
+	}
+
+	var nums [3]uint32
+	for i, part := range parts {
+		num, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return LargeCommunity{}, fmt.Errorf("invalid large community %q: %w", value, err)
+		}
+
+		nums[i] = uint32(num)
+	}
+
+	return LargeCommunity{GlobalAdmin: nums[0], LocalData1: nums[1], LocalData2: nums[2]}, nil
+}
+
+// communitySet contains communities attached to announced routes.
+type communitySet struct {
+	communities []uint32
+	large       []LargeCommunity
+}
+
+// communityConfig contains communities parsed from Config: global ones and per domain group.
+type communityConfig struct {
+	global communitySet
+	groups map[string]communitySet
+}
+
+func (c *communitySet) add(community string, large bool) error {
+	if !large {
+		value, err := ParseCommunity(community)
+		if err != nil {
+			return err
+		}
+
+		if !slices.Contains(c.communities, value) {
+			c.communities = append(c.communities, value)
+		}
+
+		return nil
+	}
+
+	value, err := ParseLargeCommunity(community)
+	if err != nil {
+		return err
+	}
+
+	if !slices.Contains(c.large, value) {
+		c.large = append(c.large, value)
+	}
+
+	return nil
+}
+
+// addGroups parses entries in `group=community` format, a group could be set several times.
+func (c *communityConfig) addGroups(entries []string, large bool) error {
+	for _, entry := range entries {
+		group, community, ok := strings.Cut(entry, "=")
+		if group = strings.TrimSpace(group); !ok || group == "" {
+			return fmt.Errorf("could not parse %q: expected group=community", entry)
+		}
+
+		set := c.groups[group]
+		if err := set.add(strings.TrimSpace(community), large); err != nil {
+			return err
+		}
+
+		c.groups[group] = set
+	}
+
+	return nil
+}
+
+func newCommunityConfig(cfg Config) (*communityConfig, error) {
+	out := &communityConfig{groups: make(map[string]communitySet)}
+	for _, community := range cfg.Communities {
+		if err := out.global.add(strings.TrimSpace(community), false); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, community := range cfg.LargeCommunities {
+		if err := out.global.add(strings.TrimSpace(community), true); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := out.addGroups(cfg.GroupCommunities, false); err != nil {
+		return nil, fmt.Errorf("group communities: %w", err)
+	}
+
+	if err := out.addGroups(cfg.GroupLargeCommunities, true); err != nil {
+		return nil, fmt.Errorf("group large communities: %w", err)
+	}
+
+	return out, nil
+}
+
+// attributes returns community attributes for routes of the group, global communities are always included.
+func (c *communityConfig) attributes(group string) []Attribute {
+	set := communitySet{
+		communities: slices.Clone(c.global.communities),
+		large:       slices.Clone(c.global.large),
+	}
+
+	if extra, ok := c.groups[group]; ok {
+		for _, value := range extra.communities {
+			if !slices.Contains(set.communities, value) {
+				set.communities = append(set.communities, value)
+			}
+		}
+
+		for _, value := range extra.large {
+			if !slices.Contains(set.large, value) {
+				set.large = append(set.large, value)
+			}
+		}
+	}
+
+	var out []Attribute
+	if len(set.communities) > 0 {
+		out = append(out, &AttributeCommunities{Values: set.communities})
+	}
+
+	if len(set.large) > 0 {
+		out = append(out, &AttributeLargeCommunities{Values: set.large})
+	}
+
+	return out
+}
@@ -0,0 +1,82 @@
+package bgp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommunities(t *testing.T) {
+	t.Run("parse", func(t *testing.T) {
+		value, err := ParseCommunity("65000:100")
+		require.NoError(t, err)
+		require.Equal(t, uint32(65000<<16|100), value)
+
+		value, err = ParseCommunity("NO-EXPORT")
+		require.NoError(t, err)
+		require.Equal(t, CommunityNoExport, value)
+
+		for _, wrong := range []string{"", "65000", "65536:1", "1:2:3", "a:b"} {
+			_, err = ParseCommunity(wrong)
+			require.Error(t, err, wrong)
+		}
+
+		large, err := ParseLargeCommunity("4200000000:1:2")
+		require.NoError(t, err)
+		require.Equal(t, LargeCommunity{GlobalAdmin: 4200000000, LocalData1: 1, LocalData2: 2}, large)
+
+		_, err = ParseLargeCommunity("1:2")
+		require.Error(t, err)
+	})
+
+	t.Run("encode", func(t *testing.T) {
+		buf, err := (&AttributeCommunities{Values: []uint32{65000<<16 | 100}}).Encode()
+		require.NoError(t, err)
+		require.Equal(t, []byte{0xC0, CommunitiesAttrType, 4, 0xFD, 0xE8, 0, 100}, buf)
+
+		buf, err = (&AttributeLargeCommunities{Values: []LargeCommunity{{1, 2, 3}}}).Encode()
+		require.NoError(t, err)
+		require.Equal(t, []byte{0xC0, LargeCommunitiesAttrType, 12, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3}, buf)
+
+		_, err = (&AttributeCommunities{}).Encode()
+		require.Error(t, err)
+	})
+
+	t.Run("config", func(t *testing.T) {
+		_, err := newCommunityConfig(Config{GroupCommunities: []string{"65000:1"}})
+		require.Error(t, err)
+
+		cfg, err := newCommunityConfig(Config{
+			Communities:           []string{"65000:1"},
+			GroupCommunities:      []string{"cdn=65000:2", "cdn=65000:1", "cdn=no-export"},
+			GroupLargeCommunities: []string{"cdn=65000:1:1"},
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, []Attribute{&AttributeCommunities{Values: []uint32{65000<<16 | 1}}}, cfg.attributes(""))
+		require.Equal(t, []Attribute{
+			&AttributeCommunities{Values: []uint32{65000<<16 | 1, 65000<<16 | 2, CommunityNoExport}},
+			&AttributeLargeCommunities{Values: []LargeCommunity{{65000, 1, 1}}},
+		}, cfg.attributes("cdn"))
+	})
+
+	t.Run("announce", func(t *testing.T) {
+		com, err := newCommunityConfig(Config{Communities: []string{"65000:1"}})
+		require.NoError(t, err)
+
+		p := &plugin{Config: Config{LocalPref: 100}, com: com}
+		buf, err := p.buildAnnounce([]string{"10.0.0.1"}, "", session{hops: nextHops{ipv4: net.IPv4(10, 0, 0, 254)}})
+		require.NoError(t, err)
+		require.Equal(t, [][]byte{{
+			0, 0, // withdrawn length
+			0, 28, // attributes length
+			0x40, OriginAttrType, 1, byte(OriginEGP),
+			0x40, ASPathAttrType, 0,
+			0x40, NextHopAttrType, 4, 10, 0, 0, 254,
+			0x40, LocalPrefAttrType, 4, 0, 0, 0, 100,
+			0xC0, CommunitiesAttrType, 4, 0xFD, 0xE8, 0, 1,
+			32, 10, 0, 0, 1, // NLRI
+		}}, buf)
+	})
+}
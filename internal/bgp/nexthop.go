@@ -0,0 +1,168 @@
+package bgp
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// NextHopSelf is a special next hop value that is replaced by the local address of the BGP session.
+const NextHopSelf = "self"
+
+// nextHop represents a configured next hop: a fixed address or the local address of the session.
+type nextHop struct {
+	self bool
+	addr net.IP
+}
+
+// nextHopConfig contains next hops parsed from Config: global ones, per peer and per domain group.
+type nextHopConfig struct {
+	ipv4   nextHop
+	ipv6   nextHop
+	peers  map[string]nextHop
+	groups map[string]nextHop
+}
+
+// nextHops contains next hops resolved for the specific session.
+type nextHops struct {
+	ipv4 net.IP
+	ipv6 net.IP
+}
+
+func parseNextHop(value string) (nextHop, error) {
+	if strings.EqualFold(value, NextHopSelf) {
+		return nextHop{self: true}, nil
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nextHop{}, fmt.Errorf("invalid next hop %q", value)
+	}
+
+	return nextHop{addr: ip}, nil
+}
+
+// parseNextHops parses entries in `key=next-hop` format.
+func parseNextHops(entries []string) (map[string]nextHop, error) {
+	out := make(map[string]nextHop, len(entries))
+	for _, entry := range entries {
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("could not parse %q: expected key=next-hop", entry)
+		}
+
+		hop, err := parseNextHop(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+
+		out[strings.TrimSpace(key)] = hop
+	}
+
+	return out, nil
+}
+
+func newNextHopConfig(cfg Config) (*nextHopConfig, error) {
+	var (
+		err error
+		out nextHopConfig
+	)
+
+	if out.ipv4, err = parseNextHop(cfg.NextHop); err != nil {
+		return nil, err
+	} else if !out.ipv4.self && out.ipv4.addr.To4() == nil {
+		return nil, fmt.Errorf("invalid IPv4 next hop %q", cfg.NextHop)
+	}
+
+	if out.ipv6, err = parseNextHop(cfg.NextHop6); err != nil {
+		return nil, err
+	} else if !out.ipv6.self && out.ipv6.addr.To4() != nil {
+		return nil, fmt.Errorf("invalid IPv6 next hop %q", cfg.NextHop6)
+	}
+
+	if out.peers, err = parseNextHops(cfg.PeerNextHops); err != nil {
+		return nil, fmt.Errorf("peer next hops: %w", err)
+	}
+
+	if out.groups, err = parseNextHops(cfg.GroupNextHops); err != nil {
+		return nil, fmt.Errorf("group next hops: %w", err)
+	}
+
+	return &out, nil
+}
+
+// apply overrides the next hop of the address family of the given hop.
+// The self hop is applied to the family of the session local address.
+func (h nextHops) apply(hop nextHop, local net.IP) nextHops {
+	addr := hop.addr
+	if hop.self {
+		addr = local
+	}
+
+	switch {
+	case addr == nil:
+	case addr.To4() != nil:
+		h.ipv4 = addr.To4()
+	default:
+		h.ipv6 = addr
+	}
+
+	return h
+}
+
+// resolve returns next hops of the peer session and next hops of every configured domain group.
+// Priority: group next hop, then peer next hop, then global next hops.
+func (c *nextHopConfig) resolve(peer string, local net.IP) (nextHops, map[string]nextHops) {
+	var out nextHops
+	if !c.ipv4.self || local.To4() != nil {
+		out = out.apply(c.ipv4, local)
+	}
+
+	if !c.ipv6.self || local.To4() == nil {
+		out = out.apply(c.ipv6, local)
+	}
+
+	if hop, ok := c.peers[peer]; ok {
+		out = out.apply(hop, local)
+	}
+
+	groups := make(map[string]nextHops, len(c.groups))
+	for group, hop := range c.groups {
+		groups[group] = out.apply(hop, local)
+	}
+
+	return out, groups
+}
+
+// self reports whether next hops of the peer session depend on the session local address.
+func (c *nextHopConfig) self(peer string) bool {
+	if hop, ok := c.peers[peer]; ok && hop.self {
+		return true
+	}
+
+	for _, hop := range c.groups {
+		if hop.self {
+			return true
+		}
+	}
+
+	return c.ipv4.self || c.ipv6.self
+}
+
+// sessionLocalAddress returns the source address that is used to reach the peer.
+// No packets are sent, UDP socket is used only to ask the kernel for the route.
+func sessionLocalAddress(remote netip.Addr) (net.IP, error) {
+	conn, err := net.Dial("udp", netip.AddrPortFrom(remote, 179).String())
+	if err != nil {
+		return nil, fmt.Errorf("could not detect local address for %q: %w", remote, err)
+	}
+
+	defer func() { _ = conn.Close() }()
+
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		return addr.IP, nil
+	}
+
+	return nil, fmt.Errorf("could not detect local address for %q", remote)
+}
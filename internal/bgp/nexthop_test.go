@@ -0,0 +1,64 @@
+package bgp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNextHopConfig(t *testing.T) {
+	_, err := newNextHopConfig(Config{NextHop: "::1", NextHop6: "::1"})
+	require.Error(t, err)
+
+	_, err = newNextHopConfig(Config{NextHop: "127.0.0.1", NextHop6: "::1", PeerNextHops: []string{"wrong"}})
+	require.Error(t, err)
+
+	cfg, err := newNextHopConfig(Config{
+		NextHop:       "self",
+		NextHop6:      "2001:db8::1",
+		PeerNextHops:  []string{"10.0.0.2=10.0.0.254", "10.0.0.3 = 2001:db8::3"},
+		GroupNextHops: []string{"cdn=self", "office=10.0.0.100"},
+	})
+	require.NoError(t, err)
+
+	local := net.ParseIP("10.0.0.1")
+
+	t.Run("global", func(t *testing.T) {
+		hops, groups := cfg.resolve("10.0.0.1", local)
+		require.Equal(t, nextHops{ipv4: local.To4(), ipv6: net.ParseIP("2001:db8::1")}, hops)
+		require.Equal(t, hops, groups["cdn"])
+		require.Equal(t, net.ParseIP("10.0.0.100").To4(), groups["office"].ipv4)
+	})
+
+	t.Run("peer", func(t *testing.T) {
+		hops, groups := cfg.resolve("10.0.0.2", local)
+		require.Equal(t, net.ParseIP("10.0.0.254").To4(), hops.ipv4)
+		require.Equal(t, local.To4(), groups["cdn"].ipv4)
+
+		hops, _ = cfg.resolve("10.0.0.3", local)
+		require.Equal(t, local.To4(), hops.ipv4)
+		require.Equal(t, net.ParseIP("2001:db8::3"), hops.ipv6)
+	})
+
+	t.Run("self", func(t *testing.T) {
+		require.True(t, cfg.self("10.0.0.2"))
+
+		fixed, err := newNextHopConfig(Config{
+			NextHop:       "127.0.0.1",
+			NextHop6:      "::1",
+			PeerNextHops:  []string{"10.0.0.2=self"},
+			GroupNextHops: []string{"office=10.0.0.100"},
+		})
+		require.NoError(t, err)
+		require.False(t, fixed.self("10.0.0.1"))
+		require.True(t, fixed.self("10.0.0.2"))
+	})
+
+	t.Run("session", func(t *testing.T) {
+		sess := session{hops: nextHops{ipv4: local}, groups: map[string]nextHops{"cdn": {ipv4: net.IPv4zero}}}
+		require.Equal(t, local, sess.nextHops("").ipv4)
+		require.Equal(t, local, sess.nextHops("unknown").ipv4)
+		require.Equal(t, net.IPv4zero, sess.nextHops("cdn").ipv4)
+	})
+}
@@ -18,10 +18,26 @@ type Attribute interface {
 
 // OriginAttrType represents an attribute type for origin.
 const (
-	OriginAttrType    = 1
-	ASPathAttrType    = 2
-	NextHopAttrType   = 3
-	LocalPrefAttrType = 5
+	OriginAttrType        = 1
+	ASPathAttrType        = 2
+	NextHopAttrType       = 3
+	LocalPrefAttrType     = 5
+	MPReachNLRIAttrType   = 14
+	MPUnreachNLRIAttrType = 15
+)
+
+// BGP message length limits (RFC 4271, RFC 8654), the BGP header is included.
+const (
+	headerLength             = 19
+	maxMessageLength         = 4096
+	maxExtendedMessageLength = 65535
+)
+
+// Attribute flags used to encode path attributes.
+const (
+	flagOptional       = 0x80
+	flagTransitive     = 0x40
+	flagExtendedLength = 0x10
 )
 
 // ==== Реализация атрибутов ====
@@ -50,20 +66,42 @@ type AttributeASPath struct {
 }
 
 // writeEndOfRIB Represents the end of a Route Information Base (RIB) with a value of 0x00000000.
-func writeEndOfRIB(log *logger.Logger, peer string, rw bgp.UpdateMessageWriter) error {
-	if err := rw.WriteUpdate([]byte{0, 0, 0, 0}); err != nil {
-		log.Error(
-			"could not write end-of-rib",
-			logger.String("peer", peer),
-			logger.Err(err),
-		)
+// For IPv6 the End-of-RIB is an UPDATE with an empty MP_UNREACH_NLRI attribute.
+func writeEndOfRIB(log *logger.Logger, peer string, rw bgp.UpdateMessageWriter, ipv6 bool) error {
+	messages := [][]byte{{0, 0, 0, 0}}
+	if ipv6 {
+		messages = append(messages, []byte{
+			0, 0, 0, 6,
+			flagOptional, MPUnreachNLRIAttrType, 3, 0, byte(bgp.AFI_IPV6), bgp.SAFI_UNICAST,
+		})
+	}
+
+	for _, msg := range messages {
+		if err := rw.WriteUpdate(msg); err != nil {
+			log.Error(
+				"could not write end-of-rib",
+				logger.String("peer", peer),
+				logger.Err(err),
+			)
 
-		return err
+			return err
+		}
 	}
 
 	return nil
 }
 
+// encodeAttribute serializes a path attribute and sets the extended length flag when required.
+func encodeAttribute(flags, kind uint8, data []byte) []byte {
+	if len(data) > 255 {
+		out := []byte{flags | flagExtendedLength, kind}
+
+		return append(binary.BigEndian.AppendUint16(out, uint16(len(data))), data...) // nolint:gosec
+	}
+
+	return append([]byte{flags, kind, byte(len(data))}, data...)
+}
+
 // Encode serializes the AttributeASPath into a byte slice according to BGP protocol specifications.
 func (a *AttributeASPath) Encode() ([]byte, error) {
 	if len(a.ASNs) == 0 {
@@ -130,6 +168,63 @@ func (a *AttributeLocalPref) Encode() ([]byte, error) {
 // Type returns the type of the BGP attribute represented by AttributeLocalPref.
 func (a *AttributeLocalPref) Type() uint8 { return LocalPrefAttrType }
 
+// AttributeMPReachNLRI represents a MP_REACH_NLRI attribute (RFC 4760) used to announce non-IPv4 prefixes.
+type AttributeMPReachNLRI struct {
+	AFI      uint16
+	SAFI     uint8
+	NextHop  net.IP
+	Prefixes []net.IPNet
+}
+
+// Encode serializes the AttributeMPReachNLRI, only IPv6 next hop is supported.
+func (a *AttributeMPReachNLRI) Encode() ([]byte, error) {
+	nextHop := a.NextHop.To16()
+	if nextHop == nil || a.NextHop.To4() != nil {
+		return nil, fmt.Errorf("only IPv6 supported in MP_REACH_NLRI next hop")
+	}
+
+	buf := bytes.NewBuffer(binary.BigEndian.AppendUint16(nil, a.AFI))
+	buf.WriteByte(a.SAFI)
+	buf.WriteByte(byte(len(nextHop)))
+	buf.Write(nextHop)
+	buf.WriteByte(0) // Reserved
+
+	for _, prefix := range a.Prefixes {
+		if err := encodePrefix(buf, prefix); err != nil {
+			return nil, err
+		}
+	}
+
+	return encodeAttribute(flagOptional, MPReachNLRIAttrType, buf.Bytes()), nil
+}
+
+// Type returns the type of the BGP attribute represented by AttributeMPReachNLRI.
+func (a *AttributeMPReachNLRI) Type() uint8 { return MPReachNLRIAttrType }
+
+// AttributeMPUnreachNLRI represents a MP_UNREACH_NLRI attribute (RFC 4760) used to withdraw non-IPv4 prefixes.
+type AttributeMPUnreachNLRI struct {
+	AFI      uint16
+	SAFI     uint8
+	Prefixes []net.IPNet
+}
+
+// Encode serializes the AttributeMPUnreachNLRI.
+func (a *AttributeMPUnreachNLRI) Encode() ([]byte, error) {
+	buf := bytes.NewBuffer(binary.BigEndian.AppendUint16(nil, a.AFI))
+	buf.WriteByte(a.SAFI)
+
+	for _, prefix := range a.Prefixes {
+		if err := encodePrefix(buf, prefix); err != nil {
+			return nil, err
+		}
+	}
+
+	return encodeAttribute(flagOptional, MPUnreachNLRIAttrType, buf.Bytes()), nil
+}
+
+// Type returns the type of the BGP attribute represented by AttributeMPUnreachNLRI.
+func (a *AttributeMPUnreachNLRI) Type() uint8 { return MPUnreachNLRIAttrType }
+
 // buildUpdateMessage creates a BGP update message with withdrawn routes,
 // path attributes, and NLRI from given inputs. It serializes the data into
 // a byte slice suitable for transmission over a BGP session.
@@ -143,7 +238,7 @@ func buildUpdateMessage(
 	// Withdrawn Routes
 	withdrawnBuf := new(bytes.Buffer)
 	for _, prefix := range removes {
-		if err := encodePrefix(withdrawnBuf, prefix); err != nil {
+		if err := encodeIPv4Prefix(withdrawnBuf, prefix); err != nil {
 			return nil, err
 		}
 	}
@@ -170,7 +265,7 @@ func buildUpdateMessage(
 
 	buf.Write(attrBuf.Bytes())
 	for _, prefix := range updates {
-		if err := encodePrefix(&buf, prefix); err != nil {
+		if err := encodeIPv4Prefix(&buf, prefix); err != nil {
 			return nil, err
 		}
 	}
@@ -178,19 +273,100 @@ func buildUpdateMessage(
 	return buf.Bytes(), nil
 }
 
+// encodeIPv4Prefix writes the encoded prefix into a buffer, classic NLRI fields support only IPv4 prefixes.
+func encodeIPv4Prefix(buf *bytes.Buffer, prefix net.IPNet) error {
+	if _, bits := prefix.Mask.Size(); bits != net.IPv4len*8 || prefix.IP.To4() == nil {
+		return fmt.Errorf("only IPv4 supported")
+	}
+
+	return encodePrefix(buf, prefix)
+}
+
 // encodePrefix writes the encoded prefix of a given IP network into a buffer.
-// It supports only IPv4 addresses. The function returns an error if the
-// input is not an IPv4 address or if encoding fails.
+// The address family is chosen by the mask length, IPv4 and IPv6 are supported.
 func encodePrefix(buf *bytes.Buffer, prefix net.IPNet) error {
-	ones, _ := prefix.Mask.Size()
-	buf.WriteByte(uint8(ones)) // nolint:gosec
+	ones, bits := prefix.Mask.Size()
 
 	ip := prefix.IP.To4()
-	if ip == nil {
-		return fmt.Errorf("only IPv4 supported")
+	if bits == net.IPv6len*8 {
+		ip = prefix.IP.To16()
+	}
+
+	if ip == nil || len(ip)*8 != bits {
+		return fmt.Errorf("unsupported prefix %q", prefix.String())
 	}
 
+	buf.WriteByte(uint8(ones)) // nolint:gosec
+
 	numBytes := (ones + 7) / 8
 	buf.Write(ip[:numBytes])
 	return nil
 }
+
+// prefixLength returns the number of bytes used to encode the prefix.
+func prefixLength(prefix net.IPNet) int {
+	ones, _ := prefix.Mask.Size()
+
+	return 1 + (ones+7)/8
+}
+
+// splitUpdate builds UPDATE messages that carry all prefixes, each message fits into limit bytes.
+// When prefixes do not fit into one message, address families are sent separately and packed greedily.
+func splitUpdate(limit int, v4, v6 []net.IPNet, build func(v4, v6 []net.IPNet) ([]byte, error)) ([][]byte, error) {
+	if len(v4) == 0 && len(v6) == 0 {
+		return nil, nil
+	}
+
+	buf, err := build(v4, v6)
+	if err != nil {
+		return nil, err
+	} else if len(buf)+headerLength <= limit {
+		return [][]byte{buf}, nil
+	}
+
+	out, err := packPrefixes(limit, v4, func(chunk []net.IPNet) ([]byte, error) { return build(chunk, nil) })
+	if err != nil {
+		return nil, err
+	}
+
+	out6, err := packPrefixes(limit, v6, func(chunk []net.IPNet) ([]byte, error) { return build(nil, chunk) })
+	if err != nil {
+		return nil, err
+	}
+
+	return append(out, out6...), nil
+}
+
+// packPrefixes splits prefixes into as many messages as required to keep each of them within limit bytes.
+func packPrefixes(limit int, prefixes []net.IPNet, build func([]net.IPNet) ([]byte, error)) ([][]byte, error) {
+	var out [][]byte
+	for len(prefixes) > 0 {
+		one, err := build(prefixes[:1])
+		if err != nil {
+			return nil, err
+		}
+
+		// размер сообщения без префиксов, с запасом в байт на расширенную длину атрибута
+		size, count := len(one)+headerLength-prefixLength(prefixes[0])+1, 0
+		for count < len(prefixes) && size+prefixLength(prefixes[count]) <= limit {
+			size += prefixLength(prefixes[count])
+			count++
+		}
+
+		if count == 0 {
+			return nil, fmt.Errorf("prefix %q does not fit into message of %d bytes", prefixes[0].String(), limit)
+		}
+
+		buf, err := build(prefixes[:count])
+		if err != nil {
+			return nil, err
+		} else if len(buf)+headerLength > limit {
+			return nil, fmt.Errorf("message length %d exceeds limit %d", len(buf)+headerLength, limit)
+		}
+
+		out = append(out, buf)
+		prefixes = prefixes[count:]
+	}
+
+	return out, nil
+}
@@ -0,0 +1,173 @@
+package bgp
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"testing"
+
+	bgp "github.com/jwhited/corebgp"
+	"github.com/stretchr/testify/require"
+
+	"github.com/im-kulikov/resolvex/internal/broadcast"
+)
+
+func TestBuildUpdateMessage(t *testing.T) {
+	updates, updates6 := hostPrefixes([]string{"10.0.0.1", "2001:db8::1", "wrong"})
+	require.Len(t, updates, 1)
+	require.Len(t, updates6, 1)
+
+	t.Run("ipv4", func(t *testing.T) {
+		buf, err := buildUpdateMessage(updates, nil, OriginIGP)
+		require.NoError(t, err)
+		require.Equal(t, []byte{
+			0, 0, // withdrawn length
+			0, 4, 0x40, OriginAttrType, 1, 0, // attributes
+			32, 10, 0, 0, 1, // NLRI
+		}, buf)
+	})
+
+	t.Run("ipv6 in classic nlri", func(t *testing.T) {
+		_, err := buildUpdateMessage(updates6, nil)
+		require.Error(t, err)
+	})
+
+	t.Run("mp reach", func(t *testing.T) {
+		buf, err := (&AttributeMPReachNLRI{
+			AFI:      bgp.AFI_IPV6,
+			SAFI:     bgp.SAFI_UNICAST,
+			NextHop:  net.ParseIP("2001:db8::fe"),
+			Prefixes: updates6,
+		}).Encode()
+		require.NoError(t, err)
+
+		expect := []byte{flagOptional, MPReachNLRIAttrType, 38, 0, 2, 1, 16}
+		expect = append(expect, net.ParseIP("2001:db8::fe")...)
+		expect = append(expect, 0, 128)
+		expect = append(expect, net.ParseIP("2001:db8::1")...)
+		require.Equal(t, expect, buf)
+
+		_, err = (&AttributeMPReachNLRI{NextHop: net.ParseIP("127.0.0.1")}).Encode()
+		require.Error(t, err)
+	})
+
+	t.Run("mp unreach", func(t *testing.T) {
+		buf, err := (&AttributeMPUnreachNLRI{
+			AFI:      bgp.AFI_IPV6,
+			SAFI:     bgp.SAFI_UNICAST,
+			Prefixes: updates6,
+		}).Encode()
+		require.NoError(t, err)
+
+		expect := []byte{flagOptional, MPUnreachNLRIAttrType, 20, 0, 2, 1, 128}
+		expect = append(expect, net.ParseIP("2001:db8::1")...)
+		require.Equal(t, expect, buf)
+	})
+
+	t.Run("extended length", func(t *testing.T) {
+		data := make([]byte, 300)
+		buf := encodeAttribute(flagOptional, MPUnreachNLRIAttrType, data)
+		require.Equal(t, []byte{flagOptional | flagExtendedLength, MPUnreachNLRIAttrType, 1, 44}, buf[:4])
+		require.Len(t, buf, 304)
+	})
+}
+
+func TestSplitUpdates(t *testing.T) {
+	addresses := make([]string, 0, 2000)
+	for i := range 1000 {
+		addresses = append(addresses,
+			net.IPv4(10, 0, byte(i>>8), byte(i)).String(),
+			net.ParseIP("2001:db8::").To16().String()[:len("2001:db8::")]+strconv.Itoa(i))
+	}
+
+	p := &plugin{Config: Config{LocalPref: 100}, com: &communityConfig{}}
+	sess := session{
+		caps: peerCapabilities{ipv6: true},
+		hops: nextHops{ipv4: net.IPv4(10, 0, 0, 254), ipv6: net.ParseIP("2001:db8::fe")},
+	}
+
+	for _, extended := range []bool{false, true} {
+		sess.caps.extended = extended
+
+		messages, err := p.buildUpdates(broadcast.UpdateMessage{ToUpdate: addresses, ToRemove: addresses}, sess)
+		require.NoError(t, err)
+
+		if extended {
+			require.Len(t, messages, 2)
+		} else {
+			require.Greater(t, len(messages), 2)
+		}
+
+		var announced, withdrawn int
+		for _, msg := range messages {
+			require.LessOrEqual(t, len(msg)+headerLength, sess.caps.maxLength())
+
+			update, remove := countPrefixes(t, msg)
+			announced += update
+			withdrawn += remove
+		}
+
+		require.Equal(t, len(addresses), announced)
+		require.Equal(t, len(addresses), withdrawn)
+	}
+
+	_, err := packPrefixes(10, []net.IPNet{{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(32, 32)}},
+		func(chunk []net.IPNet) ([]byte, error) { return buildUpdateMessage(chunk, nil) })
+	require.Error(t, err)
+}
+
+func TestBuildUpdates_UnresolvedFamily(t *testing.T) {
+	p := &plugin{Config: Config{LocalPref: 100}, com: &communityConfig{}}
+
+	// IPv6 next hop `self` не разрешается на IPv4 сессии
+	sess := session{
+		caps:   peerCapabilities{ipv6: true},
+		hops:   nextHops{ipv4: net.IPv4(10, 0, 0, 254)},
+		groups: map[string]nextHops{"cdn": {ipv6: net.ParseIP("2001:db8::fe")}},
+	}
+	require.Equal(t, []string{"ipv6", "ipv4"}, sess.unresolved())
+
+	messages, err := p.buildUpdates(broadcast.UpdateMessage{
+		ToUpdate: []string{"10.0.0.1", "2001:db8::1", "10.0.0.2", "2001:db8::2"},
+		Groups:   map[string]string{"10.0.0.2": "cdn", "2001:db8::2": "cdn"},
+	}, sess)
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+
+	// IPv4 адрес группы без IPv4 next hop тоже пропускается
+	update, remove := countPrefixes(t, messages[0])
+	require.Equal(t, 1, update)
+	require.Zero(t, remove)
+
+	update, _ = countPrefixes(t, messages[1])
+	require.Equal(t, 1, update)
+}
+
+// countPrefixes returns the number of announced and withdrawn host prefixes in the UPDATE message body.
+func countPrefixes(t *testing.T, msg []byte) (int, int) {
+	withdrawnLen := int(binary.BigEndian.Uint16(msg))
+	withdrawn := withdrawnLen / 5
+	msg = msg[2+withdrawnLen:]
+
+	attrsLen := int(binary.BigEndian.Uint16(msg))
+	announced := (len(msg) - 2 - attrsLen) / 5
+
+	for attrs := msg[2 : 2+attrsLen]; len(attrs) > 0; {
+		flags, kind, size, offset := attrs[0], attrs[1], int(attrs[2]), 3
+		if flags&flagExtendedLength != 0 {
+			size, offset = int(binary.BigEndian.Uint16(attrs[2:])), 4
+		}
+
+		switch kind {
+		case MPReachNLRIAttrType:
+			announced += (size - 21) / 17
+		case MPUnreachNLRIAttrType:
+			withdrawn += (size - 3) / 17
+		}
+
+		require.GreaterOrEqual(t, len(attrs), offset+size)
+		attrs = attrs[offset+size:]
+	}
+
+	return announced, withdrawn
+}
@@ -3,8 +3,12 @@ package bgp
 import (
 	"context"
 	"encoding/binary"
+	"fmt"
+	"maps"
 	"net"
 	"net/netip"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/im-kulikov/go-bones/logger"
@@ -18,14 +22,114 @@ type plugin struct {
 	*logger.Logger
 
 	rid netip.Addr
+	hop *nextHopConfig
+	com *communityConfig
 	srv *bgp.Server
 	rec broadcast.PeerManager
+
+	caps *sync.Map // remote address => peerCapabilities
+}
+
+// session contains everything required to prepare UPDATE messages for the established peer.
+type session struct {
+	caps   peerCapabilities
+	hops   nextHops
+	groups map[string]nextHops
+}
+
+// nextHops returns next hops for the route group, unknown group uses session next hops.
+func (s session) nextHops(group string) nextHops {
+	if hops, ok := s.groups[group]; ok {
+		return hops
+	}
+
+	return s.hops
+}
+
+// unresolved returns address families without a next hop in the session or one of its groups,
+// prefixes of such families are not announced.
+func (s session) unresolved() []string {
+	var out []string
+	for _, hops := range append([]nextHops{s.hops}, slices.Collect(maps.Values(s.groups))...) {
+		if hops.ipv4 == nil && !slices.Contains(out, "ipv4") {
+			out = append(out, "ipv4")
+		}
+
+		if s.caps.ipv6 && hops.ipv6 == nil && !slices.Contains(out, "ipv6") {
+			out = append(out, "ipv6")
+		}
+	}
+
+	return out
+}
+
+// peerCapabilities contains capabilities negotiated with the remote peer.
+type peerCapabilities struct {
+	ipv6     bool
+	extended bool
+}
+
+// maxLength returns the maximum BGP message length allowed for the peer.
+func (c peerCapabilities) maxLength() int {
+	if c.extended {
+		return maxExtendedMessageLength
+	}
+
+	return maxMessageLength
+}
+
+// newPeerCapabilities parses capabilities received from the peer,
+// extended messages are used only when we advertise them too.
+func newPeerCapabilities(caps []bgp.Capability, extended bool) peerCapabilities {
+	var out peerCapabilities
+	for _, c := range caps {
+		if c.Code == bgp.CAP_EXTENDED_MESSSAGE {
+			out.extended = extended
+		}
+
+		if c.Code != bgp.CAP_MP_EXTENSIONS || len(c.Value) != 4 {
+			continue
+		}
+
+		if binary.BigEndian.Uint16(c.Value) == bgp.AFI_IPV6 && c.Value[3] == bgp.SAFI_UNICAST {
+			out.ipv6 = true
+		}
+	}
+
+	return out
+}
+
+func (p *plugin) peerCapabilities(peer string) peerCapabilities {
+	if val, ok := p.caps.Load(peer); ok {
+		return val.(peerCapabilities) // nolint:forcetypeassert
+	}
+
+	return peerCapabilities{}
+}
+
+// hostPrefixes converts addresses into host prefixes (/32 and /128) split by address family.
+func hostPrefixes(addresses []string) ([]net.IPNet, []net.IPNet) {
+	v4 := make([]net.IPNet, 0, len(addresses))
+	var v6 []net.IPNet
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+		switch {
+		case ip == nil:
+			continue
+		case ip.To4() != nil:
+			v4 = append(v4, net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(net.IPv4len*8, net.IPv4len*8)})
+		default:
+			v6 = append(v6, net.IPNet{IP: ip, Mask: net.CIDRMask(net.IPv6len*8, net.IPv6len*8)})
+		}
+	}
+
+	return v4, v6
 }
 
 func (p *plugin) GetCapabilities(peer bgp.PeerConfig) []bgp.Capability {
 	p.Info("peer get capabilities", logger.Any("peer", peer))
 
-	return []bgp.Capability{
+	caps := []bgp.Capability{
 		// Четырёхбайтная AS-нумерация (CAP_FOUR_OCTET_AS = 65)
 		{
 			Code:  bgp.CAP_FOUR_OCTET_AS,
@@ -40,12 +144,22 @@ func (p *plugin) GetCapabilities(peer bgp.PeerConfig) []bgp.Capability {
 		// Subsequent Address Family Identifier: Unicast
 		bgp.NewMPExtensionsCapability(bgp.AFI_IPV4, bgp.SAFI_UNICAST),
 
+		// Multiprotocol Extensions (CAP_MP_EXTENSIONS = 1), для IPv6 Unicast
+		bgp.NewMPExtensionsCapability(bgp.AFI_IPV6, bgp.SAFI_UNICAST),
+
 		// Graceful Restart (CAP_GRACEFUL_RESTART = 64)
 		// {
 		// 	Code:  bgp.CAP_GRACEFUL_RESTART,
 		// 	Value: []byte{0x00, 0x78, 0x00, 0x00}, // примерное значение (нужна конкретизация под задачу)
 		// },
 	}
+
+	// Extended Message (CAP_EXTENDED_MESSAGE = 6), RFC 8654
+	if p.ExtendedMessages {
+		caps = append(caps, bgp.Capability{Code: bgp.CAP_EXTENDED_MESSSAGE})
+	}
+
+	return caps
 }
 
 func (p *plugin) OnOpenMessage(
@@ -56,43 +170,123 @@ func (p *plugin) OnOpenMessage(
 	p.Info("peer open message",
 		logger.String("peer", peer.RemoteAddress.String()), logger.Any("caps", caps))
 
+	// без локального адреса `self` превратится в пустой next hop, такую сессию не поднимаем
+	if _, err := p.localAddress(peer.RemoteAddress); err != nil {
+		p.Error("could not resolve next hop self",
+			logger.String("peer", peer.RemoteAddress.String()), logger.Err(err))
+
+		return &bgp.Notification{Code: bgp.NOTIF_CODE_CEASE}
+	}
+
+	p.caps.Store(peer.RemoteAddress.String(), newPeerCapabilities(caps, p.ExtendedMessages))
+
 	return nil
 }
 
-func (p *plugin) newWriter(
-	peer string,
-	writer bgp.UpdateMessageWriter,
-) broadcast.PeerWriter {
-	return func(ctx context.Context, msg broadcast.UpdateMessage) error {
-		updates := make([]net.IPNet, 0, len(msg.ToUpdate))
-		for _, address := range msg.ToUpdate {
-			updates = append(updates, net.IPNet{
-				IP:   net.ParseIP(address),
-				Mask: net.IPv4Mask(255, 255, 255, 255),
-			})
+// localAddress returns the session local address, an error is returned only when the address is required
+// by the `self` next hop of the peer.
+func (p *plugin) localAddress(remote netip.Addr) (net.IP, error) {
+	local, err := sessionLocalAddress(remote)
+	if err != nil && p.hop.self(remote.String()) {
+		return nil, err
+	}
+
+	return local, nil
+}
+
+// buildUpdates prepares UPDATE messages: IPv4 prefixes are sent in classic NLRI fields,
+// IPv6 prefixes are sent via MP_REACH_NLRI / MP_UNREACH_NLRI when the peer supports them.
+// Withdrawals are sent first, announcements are grouped by route groups.
+// Every message fits into the maximum message length negotiated with the peer.
+func (p *plugin) buildUpdates(msg broadcast.UpdateMessage, sess session) ([][]byte, error) {
+	removes, removes6 := hostPrefixes(msg.ToRemove)
+	if !sess.caps.ipv6 {
+		removes6 = nil
+	}
+
+	out, err := splitUpdate(sess.caps.maxLength(), removes, removes6, func(v4, v6 []net.IPNet) ([]byte, error) {
+		var attributes []Attribute
+		if len(v6) > 0 {
+			attributes = append(attributes,
+				&AttributeMPUnreachNLRI{AFI: bgp.AFI_IPV6, SAFI: bgp.SAFI_UNICAST, Prefixes: v6})
 		}
 
-		removes := make([]net.IPNet, 0, len(msg.ToRemove))
-		for _, address := range msg.ToRemove {
-			removes = append(removes, net.IPNet{
-				IP:   net.ParseIP(address),
-				Mask: net.IPv4Mask(255, 255, 255, 255),
-			})
+		return buildUpdateMessage(nil, v4, attributes...)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := make(map[string][]string)
+	for _, address := range msg.ToUpdate {
+		group := msg.Groups[address]
+		buckets[group] = append(buckets[group], address)
+	}
+
+	for _, group := range slices.Sorted(maps.Keys(buckets)) {
+		messages, err := p.buildAnnounce(buckets[group], group, sess)
+		if err != nil {
+			return nil, fmt.Errorf("group %q: %w", group, err)
 		}
 
-		// We should provide one of:
-		_ = OriginIGP
-		_ = OriginEGP
-		_ = OriginINCOMPLETE
+		out = append(out, messages...)
+	}
+
+	return out, nil
+}
+
+// buildAnnounce prepares UPDATE messages that announce addresses of the route group,
+// next hops and communities are chosen by the group.
+func (p *plugin) buildAnnounce(addresses []string, group string, sess session) ([][]byte, error) {
+	hops := sess.nextHops(group)
+	updates, updates6 := hostPrefixes(addresses)
+	if !sess.caps.ipv6 {
+		updates6 = nil
+	}
+
+	// без next hop семейства (например, `self` для IPv6 на IPv4 сессии) его префиксы не анонсируем:
+	// ошибка остановила бы и анонсы другого семейства, а предупреждение пишется при установке сессии
+	if hops.ipv4 == nil {
+		updates = nil
+	}
+
+	if hops.ipv6 == nil {
+		updates6 = nil
+	}
 
-		attributes := []Attribute{
-			OriginEGP,
-			&AttributeASPath{},
-			&AttributeNextHop{IP: net.ParseIP("127.0.0.1")},
-			&AttributeLocalPref{Pref: p.LocalPref},
+	// We should provide one of:
+	_ = OriginIGP
+	_ = OriginEGP
+	_ = OriginINCOMPLETE
+
+	return splitUpdate(sess.caps.maxLength(), updates, updates6, func(v4, v6 []net.IPNet) ([]byte, error) {
+		attributes := []Attribute{OriginEGP, &AttributeASPath{}, &AttributeLocalPref{Pref: p.LocalPref}}
+		attributes = append(attributes, p.com.attributes(group)...)
+
+		if len(v4) > 0 {
+			attributes = append(attributes, &AttributeNextHop{IP: hops.ipv4})
+		}
+
+		if len(v6) > 0 {
+			attributes = append(attributes,
+				&AttributeMPReachNLRI{AFI: bgp.AFI_IPV6, SAFI: bgp.SAFI_UNICAST, NextHop: hops.ipv6, Prefixes: v6})
 		}
 
-		if buf, err := buildUpdateMessage(updates, removes, attributes...); err != nil {
+		// атрибуты отправляем в порядке возрастания типа
+		slices.SortStableFunc(attributes, func(a, b Attribute) int { return int(a.Type()) - int(b.Type()) })
+
+		return buildUpdateMessage(v4, nil, attributes...)
+	})
+}
+
+func (p *plugin) newWriter(
+	peer string,
+	writer bgp.UpdateMessageWriter,
+	sess session,
+) broadcast.PeerWriter {
+	return func(ctx context.Context, msg broadcast.UpdateMessage) error {
+		messages, err := p.buildUpdates(msg, sess)
+		if err != nil {
 			p.ErrorContext(
 				ctx,
 				"could not serialize update",
@@ -101,19 +295,49 @@ func (p *plugin) newWriter(
 			)
 
 			return err
-		} else if err = writer.WriteUpdate(buf); err != nil {
-			p.ErrorContext(ctx, "could not write update", logger.String("peer", peer), logger.Err(err))
+		}
 
-			return err
+		for _, buf := range messages {
+			if err = writer.WriteUpdate(buf); err != nil {
+				p.ErrorContext(ctx, "could not write update", logger.String("peer", peer), logger.Err(err))
+
+				return err
+			}
 		}
 
 		p.InfoContext(ctx, "update sent", logger.String("peer", peer))
 
 		// send End-of-Rib
-		return writeEndOfRIB(p.Logger, peer, writer)
+		return writeEndOfRIB(p.Logger, peer, writer, sess.caps.ipv6)
 	}
 }
 
+// newSession resolves capabilities and next hops for the established peer.
+func (p *plugin) newSession(peer bgp.PeerConfig) (session, error) {
+	remote := peer.RemoteAddress.String()
+
+	local, err := p.localAddress(peer.RemoteAddress)
+	if err != nil {
+		return session{}, err
+	}
+
+	sess := session{caps: p.peerCapabilities(remote)}
+	sess.hops, sess.groups = p.hop.resolve(remote, local)
+
+	p.Info("peer next hops",
+		logger.String("peer", remote),
+		logger.Any("ipv4", sess.hops.ipv4),
+		logger.Any("ipv6", sess.hops.ipv6))
+
+	if families := sess.unresolved(); len(families) > 0 {
+		p.Warn("next hops are not resolved, prefixes of the families are not announced",
+			logger.String("peer", remote),
+			logger.Any("families", families))
+	}
+
+	return sess, nil
+}
+
 func (p *plugin) OnEstablished(
 	peer bgp.PeerConfig,
 	writer bgp.UpdateMessageWriter,
@@ -124,12 +348,22 @@ func (p *plugin) OnEstablished(
 		logger.Any("peer", peer),
 		logger.String("remote", remote))
 
-	p.rec.AddPeer(remote, p.newWriter(remote, writer))
+	// маршрут до пира мог смениться после OPEN, без адреса для `self` анонсы не отправляем
+	sess, err := p.newSession(peer)
+	if err != nil {
+		p.Error("could not resolve next hop self", logger.String("peer", remote), logger.Err(err))
+
+		return func(bgp.PeerConfig, []byte) *bgp.Notification {
+			return &bgp.Notification{Code: bgp.NOTIF_CODE_CEASE}
+		}
+	}
+
+	p.rec.AddPeer(remote, p.newWriter(remote, writer, sess))
 
 	time.Sleep(time.Second) // wait before send initial update
 
 	// send End-of-Rib
-	if err := writeEndOfRIB(p.Logger, remote, writer); err != nil {
+	if err = writeEndOfRIB(p.Logger, remote, writer, sess.caps.ipv6); err != nil {
 		return func(bgp.PeerConfig, []byte) *bgp.Notification {
 			return bgp.UpdateNotificationFromErr(err)
 		}
@@ -142,6 +376,7 @@ func (p *plugin) OnClose(peer bgp.PeerConfig) {
 	p.Info("peer closed", logger.Any("peer", peer))
 
 	p.rec.DelPeer(peer.RemoteAddress.String())
+	p.caps.Delete(peer.RemoteAddress.String())
 
 	for _, client := range p.Clients {
 		if client != peer.RemoteAddress.String() {
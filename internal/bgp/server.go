@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
+	"sync"
 
 	"github.com/im-kulikov/go-bones/logger"
 	"github.com/im-kulikov/go-bones/service"
@@ -14,15 +15,36 @@ import (
 	"github.com/im-kulikov/resolvex/internal/broadcast"
 )
 
+// Config describes BGP server settings.
+// NextHop and NextHop6 accept an address or `self`, that means the local address of the session.
+// PeerNextHops and GroupNextHops override next hop per peer and per domain group,
+// entries have `peer=next-hop` and `group=next-hop` format.
+// Communities (`asn:value` or well-known name) and LargeCommunities (`global:local1:local2`)
+// are attached to every route, GroupCommunities and GroupLargeCommunities use `group=community` format.
+// ExtendedMessages advertises RFC 8654 capability, UPDATE messages up to 65535 bytes are sent to peers
+// that advertise it too, otherwise messages are split to fit into 4096 bytes. It is disabled by default:
+// corebgp reads messages of at most 4096 bytes, so a peer sending a larger message would reset the session.
 type Config struct {
-	Clients    []string         `env:"CLIENTS"`
-	Enabled    bool             `env:"ENABLED"    default:"true"`
-	Network    string           `env:"NETWORK"    default:"tcp"`
-	Address    string           `env:"ADDRESS"    default:":51179"`
-	RouteID    string           `env:"ROUTER_ID"  default:"127.0.0.1"`
-	LocalAs    uint32           `env:"LOCAL_AS"   default:"65001"`
-	RemoteAs   uint32           `env:"REMOTE_AS"  default:"65000"`
-	LocalPref  uint32           `env:"LOCAL_PREF" default:"100"`
+	Clients       []string `env:"CLIENTS"`
+	Enabled       bool     `env:"ENABLED"         default:"true"`
+	Network       string   `env:"NETWORK"         default:"tcp"`
+	Address       string   `env:"ADDRESS"         default:":51179"`
+	RouteID       string   `env:"ROUTER_ID"       default:"127.0.0.1"`
+	LocalAs       uint32   `env:"LOCAL_AS"        default:"65001"`
+	RemoteAs      uint32   `env:"REMOTE_AS"       default:"65000"`
+	LocalPref     uint32   `env:"LOCAL_PREF"      default:"100"`
+	NextHop       string   `env:"NEXT_HOP"        default:"127.0.0.1"`
+	NextHop6      string   `env:"NEXT_HOP_IPV6"   default:"::1"`
+	PeerNextHops  []string `env:"PEER_NEXT_HOPS"`
+	GroupNextHops []string `env:"GROUP_NEXT_HOPS"`
+
+	ExtendedMessages bool `env:"EXTENDED_MESSAGES" default:"false"`
+
+	Communities           []string `env:"COMMUNITIES"`
+	LargeCommunities      []string `env:"LARGE_COMMUNITIES"`
+	GroupCommunities      []string `env:"GROUP_COMMUNITIES"`
+	GroupLargeCommunities []string `env:"GROUP_LARGE_COMMUNITIES"`
+
 	Attributes broadcast.Config `env:"ATTRIBUTES"`
 }
 
@@ -56,6 +78,16 @@ func New(cfg Config, log *logger.Logger, rec broadcast.PeerManager) (service.Ser
 		return nil, err
 	}
 
+	var hop *nextHopConfig
+	if hop, err = newNextHopConfig(cfg); err != nil {
+		return nil, fmt.Errorf("bgp-server: %w", err)
+	}
+
+	var com *communityConfig
+	if com, err = newCommunityConfig(cfg); err != nil {
+		return nil, fmt.Errorf("bgp-server: %w", err)
+	}
+
 	corebgp.SetLogger(coreBGPLogger(log))
 
 	var srv *corebgp.Server
@@ -68,8 +100,12 @@ func New(cfg Config, log *logger.Logger, rec broadcast.PeerManager) (service.Ser
 		Logger: logger.Named(log, pluginName),
 
 		rid: rid,
+		hop: hop,
+		com: com,
 		srv: srv,
 		rec: rec,
+
+		caps: new(sync.Map),
 	}
 
 	for _, client := range cfg.Clients {
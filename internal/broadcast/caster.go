@@ -1,17 +1,44 @@
 package broadcast
 
+import "context"
+
 // Broadcaster defines an interface for broadcasting update messages to peers or systems.
 type Broadcaster interface {
 	Broadcast(msg UpdateMessage)
 }
 
+// Waiter defines an interface for waiting until items are delivered to peers.
+type Waiter interface {
+	// Wait blocks until every peer was sent the items or the context is done.
+	// Items that are not in the table are not waited for.
+	Wait(ctx context.Context, items ...string) error
+}
+
 // UpdateMessage represents a message containing updates and removals.
 // ToUpdate contains a list of items to be added or updated.
 // ToRemove contains a list of items to be removed.
+// Groups optionally maps items from ToUpdate to the route group of the domain they belong to.
 type UpdateMessage struct {
 	Cause    UpdateCause
 	ToUpdate []string
 	ToRemove []string
+	Groups   map[string]string
+
+	// wait is sent in the same queue as updates, so it follows updates broadcast before
+	wait *waiter
+}
+
+// SetGroup assigns the route group to the item, empty group is the default one and is not stored.
+func (msg *UpdateMessage) SetGroup(item, group string) {
+	if group == "" {
+		return
+	}
+
+	if msg.Groups == nil {
+		msg.Groups = make(map[string]string)
+	}
+
+	msg.Groups[item] = group
 }
 
 type UpdateCause int
@@ -21,6 +48,11 @@ const (
 	CauseAPIDelete
 	CauseAPIUpdate
 	CauseDNSPublish
+	CauseRestore
+	CauseResync
+	CauseBatch
+	CauseGuardRelease
+	CauseSubscription
 )
 
 func (cause UpdateCause) String() string {
@@ -33,6 +65,16 @@ func (cause UpdateCause) String() string {
 		return "api-update"
 	case CauseDNSPublish:
 		return "resolver-publish"
+	case CauseRestore:
+		return "storage-restore"
+	case CauseResync:
+		return "peer-resync"
+	case CauseBatch:
+		return "broadcast-batch"
+	case CauseGuardRelease:
+		return "guard-release"
+	case CauseSubscription:
+		return "list-subscription"
 	default:
 		return "unknown"
 	}
@@ -45,3 +87,23 @@ func (s *server) Broadcast(msg UpdateMessage) {
 
 	s.output <- msg
 }
+
+func (s *server) Wait(ctx context.Context, items ...string) error {
+	if s.closed.Load() || len(items) == 0 {
+		return nil
+	}
+
+	item := newWaiter(ctx, items)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case s.output <- UpdateMessage{wait: item}:
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-item.done:
+		return nil
+	}
+}
@@ -0,0 +1,294 @@
+package broadcast
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/im-kulikov/go-bones/logger"
+)
+
+// maxRetryInterval limits the delay between retries of a failed peer.
+const maxRetryInterval = time.Minute
+
+// peerEvent is a queued item for the peer: an incremental message or a full table snapshot.
+type peerEvent struct {
+	msg   UpdateMessage
+	table map[string]string
+}
+
+// peerQueue delivers messages to a single peer in its own goroutine,
+// so a slow or failing peer does not block the broadcaster and other peers.
+type peerQueue struct {
+	*logger.Logger
+
+	name   string
+	writer PeerWriter
+	events chan peerEvent
+	cancel context.CancelFunc
+	retry  time.Duration
+
+	// desired is the table the peer should have, advertised is the table the peer has.
+	desired    map[string]string
+	advertised map[string]string
+
+	// lock guards advertised table from watchers and waiters of items the peer does not have yet,
+	// every waiter keeps the stop function of its context callback
+	lock    sync.Mutex
+	waiting map[*waiter]func() bool
+}
+
+// waiter is acknowledged by every peer once the peer was sent all its items or the peer is gone,
+// peers forget the waiter when its context is done.
+type waiter struct {
+	ctx   context.Context
+	items []string
+	left  atomic.Int64
+	done  chan struct{}
+}
+
+func newWaiter(ctx context.Context, items []string) *waiter {
+	return &waiter{ctx: ctx, items: slices.Clone(items), done: make(chan struct{})}
+}
+
+// expect sets the number of peers that should acknowledge the waiter.
+func (w *waiter) expect(peers int) {
+	if w.left.Store(int64(peers)); peers == 0 {
+		close(w.done)
+	}
+}
+
+func (w *waiter) ack() {
+	if w.left.Add(-1) == 0 {
+		close(w.done)
+	}
+}
+
+func newPeerQueue(top context.Context, log *logger.Logger, cfg Config, name string, writer PeerWriter) *peerQueue {
+	ctx, cancel := context.WithCancel(top)
+
+	queue := &peerQueue{
+		Logger: log,
+
+		name:   name,
+		writer: writer,
+		events: make(chan peerEvent, max(cfg.QueueSize, 1)),
+		cancel: cancel,
+		retry:  max(cfg.RetryInterval, time.Millisecond),
+
+		desired:    make(map[string]string),
+		advertised: make(map[string]string),
+		waiting:    make(map[*waiter]func() bool),
+	}
+
+	go queue.run(ctx)
+
+	return queue
+}
+
+// push enqueues the message without blocking. When the queue overflows, pending messages
+// are dropped and replaced by the snapshot of the table, so the peer is resynchronized.
+func (q *peerQueue) push(ctx context.Context, msg UpdateMessage, table map[string]string) {
+	select {
+	case q.events <- peerEvent{msg: msg}:
+		return
+	default:
+	}
+
+	q.WarnContext(ctx, "peer queue overflow, schedule resync",
+		logger.String("peer", q.name),
+		logger.Int("queue", cap(q.events)))
+
+	q.resync(table)
+}
+
+// resync drops pending messages and enqueues the full table snapshot.
+func (q *peerQueue) resync(table map[string]string) {
+	for drained := false; !drained; {
+		select {
+		case <-q.events:
+		default:
+			drained = true
+		}
+	}
+
+	// broadcaster is the only sender, so the queue has a free slot after draining
+	q.events <- peerEvent{table: maps.Clone(table)}
+}
+
+// stop cancels delivery, waiters do not wait for the removed peer.
+func (q *peerQueue) stop() {
+	q.cancel()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for item, stop := range q.waiting {
+		stop()
+		item.ack()
+	}
+
+	clear(q.waiting)
+}
+
+// watch acknowledges the waiter when the peer was sent all its items.
+func (q *peerQueue) watch(item *waiter) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.covers(item) {
+		item.ack()
+
+		return
+	}
+
+	// упавший пир может не получить адреса никогда, ожидающий без него уходит по своему контексту
+	q.waiting[item] = context.AfterFunc(item.ctx, func() {
+		q.lock.Lock()
+		delete(q.waiting, item)
+		q.lock.Unlock()
+	})
+}
+
+// covers reports whether the peer was sent all items of the waiter, must be called under lock.
+func (q *peerQueue) covers(item *waiter) bool {
+	for _, name := range item.items {
+		if _, ok := q.advertised[name]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (q *peerQueue) run(ctx context.Context) {
+	var (
+		dirty bool
+		delay = q.retry
+		timer = time.NewTimer(delay)
+	)
+
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			if dirty = !q.send(ctx, q.diff(CauseResync), true); !dirty {
+				delay = q.retry
+
+				continue
+			}
+
+			delay = min(delay*2, maxRetryInterval)
+			timer.Reset(delay)
+		case event := <-q.events:
+			msg, full := event.msg, event.table != nil
+			if full {
+				q.desired = event.table
+			} else {
+				applyTable(q.desired, msg)
+			}
+
+			// после ошибки или при полной синхронизации отправляем разницу с тем, что есть у пира
+			if dirty || full {
+				msg, full = q.diff(CauseResync), true
+			}
+
+			if q.send(ctx, msg, full) {
+				dirty, delay = false, q.retry
+				timer.Stop()
+
+				continue
+			}
+
+			if !dirty {
+				dirty = true
+				timer.Reset(delay)
+			}
+		}
+	}
+}
+
+// send writes the message to the peer and updates the advertised table on success.
+func (q *peerQueue) send(ctx context.Context, msg UpdateMessage, full bool) bool {
+	if len(msg.ToUpdate) == 0 && len(msg.ToRemove) == 0 && !full {
+		return true
+	}
+
+	if err := q.writer(ctx, msg); err != nil {
+		q.ErrorContext(ctx, "could not send update to peer",
+			logger.String("peer", q.name),
+			logger.String("cause", msg.Cause.String()),
+			logger.Err(err))
+
+		return false
+	}
+
+	q.lock.Lock()
+	if full {
+		q.advertised = maps.Clone(q.desired)
+	} else {
+		applyTable(q.advertised, msg)
+	}
+
+	for item, stop := range q.waiting {
+		if q.covers(item) {
+			stop()
+			item.ack()
+			delete(q.waiting, item)
+		}
+	}
+	q.lock.Unlock()
+
+	q.InfoContext(ctx, "message send successfully",
+		logger.String("peer", q.name),
+		logger.String("cause", msg.Cause.String()),
+		logger.Int("update-count", len(msg.ToUpdate)),
+		logger.Int("remove-count", len(msg.ToRemove)))
+
+	return true
+}
+
+// diff returns the message that turns the advertised table into the desired one.
+func (q *peerQueue) diff(cause UpdateCause) UpdateMessage {
+	return diffTable(cause, q.desired, q.advertised)
+}
+
+// diffTable returns the message that turns the current table into the desired one.
+func diffTable(cause UpdateCause, desired, current map[string]string) UpdateMessage {
+	msg := UpdateMessage{Cause: cause}
+	for item, group := range desired {
+		if old, ok := current[item]; !ok || old != group {
+			msg.ToUpdate = append(msg.ToUpdate, item)
+			msg.SetGroup(item, group)
+		}
+	}
+
+	for item := range current {
+		if _, ok := desired[item]; !ok {
+			msg.ToRemove = append(msg.ToRemove, item)
+		}
+	}
+
+	slices.Sort(msg.ToUpdate)
+	slices.Sort(msg.ToRemove)
+
+	return msg
+}
+
+// applyTable applies the message to the table, the table maps items to their route groups.
+func applyTable(list map[string]string, msg UpdateMessage) {
+	for _, item := range msg.ToRemove {
+		delete(list, item)
+	}
+
+	for _, item := range msg.ToUpdate {
+		list[item] = msg.Groups[item]
+	}
+}
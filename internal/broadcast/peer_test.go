@@ -0,0 +1,263 @@
+package broadcast
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/im-kulikov/go-bones/logger"
+	"github.com/stretchr/testify/require"
+)
+
+type testPeer struct {
+	sync.Mutex
+
+	table    map[string]string
+	messages []UpdateMessage
+	fail     atomic.Bool
+}
+
+func (p *testPeer) write(_ context.Context, msg UpdateMessage) error {
+	if p.fail.Load() {
+		return errors.New("peer is down")
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	applyTable(p.table, msg)
+	p.messages = append(p.messages, msg)
+
+	return nil
+}
+
+func (p *testPeer) snapshot() map[string]string {
+	p.Lock()
+	defer p.Unlock()
+
+	out := make(map[string]string, len(p.table))
+	for item, group := range p.table {
+		out[item] = group
+	}
+
+	return out
+}
+
+func TestRunner_PeerIsolation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	rp := runnerParams{
+		closed: new(atomic.Bool),
+		action: make(chan updatePeer),
+		output: make(chan UpdateMessage),
+	}
+
+	// require нельзя вызывать вне горутины теста, ошибку проверяем после остановки
+	done := make(chan error, 1)
+	go func() { done <- runner(log, Config{QueueSize: 1, RetryInterval: time.Millisecond}, rp)(ctx) }()
+
+	release := make(chan struct{})
+	blocked := func(ctx context.Context, _ UpdateMessage) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-release:
+			return nil
+		}
+	}
+
+	good := &testPeer{table: make(map[string]string)}
+	flaky := &testPeer{table: make(map[string]string)}
+	flaky.fail.Store(true)
+
+	rp.action <- updatePeer{Peer: "slow", Action: addPeer, writer: blocked}
+	rp.action <- updatePeer{Peer: "good", Action: addPeer, writer: good.write}
+	rp.action <- updatePeer{Peer: "flaky", Action: addPeer, writer: flaky.write}
+
+	// медленный пир не должен блокировать остальных, даже если его очередь переполнена
+	for _, item := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		msg := UpdateMessage{Cause: CauseDNSPublish, ToUpdate: []string{item}}
+		msg.SetGroup(item, "cdn")
+
+		rp.output <- msg
+	}
+
+	rp.output <- UpdateMessage{Cause: CauseAPIDelete, ToRemove: []string{"10.0.0.2"}}
+
+	expect := map[string]string{"10.0.0.1": "cdn", "10.0.0.3": "cdn"}
+	require.Eventually(t, func() bool { return len(good.snapshot()) == 2 }, time.Second, time.Millisecond)
+	require.Equal(t, expect, good.snapshot())
+
+	// после восстановления пир получает полную таблицу
+	require.Empty(t, flaky.snapshot())
+	flaky.fail.Store(false)
+	require.Eventually(t, func() bool { return len(flaky.snapshot()) == 2 }, time.Second, time.Millisecond)
+	require.Equal(t, expect, flaky.snapshot())
+
+	close(release)
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestRunner_Interval(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	rp := runnerParams{
+		closed: new(atomic.Bool),
+		action: make(chan updatePeer),
+		output: make(chan UpdateMessage),
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- runner(log, Config{Interval: 50 * time.Millisecond, QueueSize: 10}, rp)(ctx) }()
+
+	peer := &testPeer{table: make(map[string]string)}
+	rp.action <- updatePeer{Peer: "peer", Action: addPeer, writer: peer.write}
+
+	received := func() []UpdateMessage {
+		peer.Lock()
+		defer peer.Unlock()
+
+		return append([]UpdateMessage(nil), peer.messages...)
+	}
+
+	// первое сообщение - пустая таблица для нового пира
+	require.Eventually(t, func() bool { return len(received()) == 1 }, time.Second, time.Millisecond)
+
+	// добавленный и удалённый в одном окне адрес не анонсируется
+	rp.output <- UpdateMessage{Cause: CauseDNSPublish, ToUpdate: []string{"10.0.0.1", "10.0.0.2"}}
+	rp.output <- UpdateMessage{Cause: CauseAPIDelete, ToRemove: []string{"10.0.0.2"}}
+
+	require.Eventually(t, func() bool { return len(received()) == 2 }, time.Second, time.Millisecond)
+	require.Equal(t, UpdateMessage{Cause: CauseBatch, ToUpdate: []string{"10.0.0.1"}}, received()[1])
+
+	rp.output <- UpdateMessage{Cause: CauseDNSPublish, ToUpdate: []string{"10.0.0.3"}}
+	rp.output <- UpdateMessage{Cause: CauseDNSPublish, ToRemove: []string{"10.0.0.3"}}
+	rp.output <- UpdateMessage{Cause: CauseDNSPublish, ToUpdate: []string{"10.0.0.4"}}
+
+	require.Eventually(t, func() bool { return len(received()) == 3 }, time.Second, time.Millisecond)
+	require.Equal(t, UpdateMessage{Cause: CauseDNSPublish, ToUpdate: []string{"10.0.0.4"}}, received()[2])
+	require.Equal(t, map[string]string{"10.0.0.1": "", "10.0.0.4": ""}, peer.snapshot())
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestRunner_Wait(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	rp := runnerParams{
+		closed: new(atomic.Bool),
+		action: make(chan updatePeer),
+		output: make(chan UpdateMessage),
+	}
+
+	done := make(chan error, 1)
+	cfg := Config{Interval: time.Hour, QueueSize: 10, RetryInterval: time.Millisecond}
+	go func() { done <- runner(log, cfg, rp)(ctx) }()
+
+	good := &testPeer{table: make(map[string]string)}
+	flaky := &testPeer{table: make(map[string]string)}
+	flaky.fail.Store(true)
+
+	rp.action <- updatePeer{Peer: "good", Action: addPeer, writer: good.write}
+	rp.action <- updatePeer{Peer: "flaky", Action: addPeer, writer: flaky.write}
+
+	// ожидание закрывает окно раньше, адреса вне таблицы не ждём
+	rp.output <- UpdateMessage{Cause: CauseDNSPublish, ToUpdate: []string{"10.0.0.1"}}
+
+	item := newWaiter(ctx, []string{"10.0.0.1", "10.6.6.6"})
+	rp.output <- UpdateMessage{wait: item}
+
+	require.Eventually(t, func() bool { return len(good.snapshot()) == 1 }, time.Second, time.Millisecond)
+	require.Never(t, func() bool { return isClosed(item.done) }, 20*time.Millisecond, time.Millisecond)
+
+	// пир восстановился и получил адрес
+	flaky.fail.Store(false)
+	require.Eventually(t, func() bool { return isClosed(item.done) }, time.Second, time.Millisecond)
+
+	// уже отправленные адреса не ждут, удалённый пир не задерживает ожидание
+	flaky.fail.Store(true)
+	rp.output <- UpdateMessage{Cause: CauseDNSPublish, ToUpdate: []string{"10.0.0.2"}}
+
+	item = newWaiter(ctx, []string{"10.0.0.2"})
+	rp.output <- UpdateMessage{wait: item}
+	require.Never(t, func() bool { return isClosed(item.done) }, 20*time.Millisecond, time.Millisecond)
+
+	rp.action <- updatePeer{Peer: "flaky", Action: remPeer}
+	require.Eventually(t, func() bool { return isClosed(item.done) }, time.Second, time.Millisecond)
+
+	item = newWaiter(ctx, []string{"10.0.0.1"})
+	rp.output <- UpdateMessage{wait: item}
+	require.Eventually(t, func() bool { return isClosed(item.done) }, time.Second, time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestPeerQueue_ForgetWaiter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	down := &testPeer{table: make(map[string]string)}
+	down.fail.Store(true)
+
+	q := newPeerQueue(ctx, log, Config{QueueSize: 10, RetryInterval: time.Millisecond}, "down", down.write)
+	defer q.stop()
+
+	q.push(ctx, UpdateMessage{Cause: CauseDNSPublish, ToUpdate: []string{"10.0.0.1"}}, nil)
+
+	waiting := func() int {
+		q.lock.Lock()
+		defer q.lock.Unlock()
+
+		return len(q.waiting)
+	}
+
+	// пир не поднимается, ожидающие с истёкшим контекстом не копятся
+	for range 100 {
+		wait, stop := context.WithTimeout(ctx, time.Millisecond)
+		item := newWaiter(wait, []string{"10.0.0.1"})
+		item.expect(1)
+		q.watch(item)
+
+		<-wait.Done()
+		stop()
+	}
+
+	require.Eventually(t, func() bool { return waiting() == 0 }, time.Second, time.Millisecond)
+	require.Empty(t, down.snapshot())
+}
+
+func isClosed(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestPeerQueue_Diff(t *testing.T) {
+	q := &peerQueue{
+		desired:    map[string]string{"10.0.0.1": "cdn", "10.0.0.2": "", "10.0.0.3": "office"},
+		advertised: map[string]string{"10.0.0.1": "cdn", "10.0.0.3": "", "10.0.0.4": ""},
+	}
+
+	require.Equal(t, UpdateMessage{
+		Cause:    CauseResync,
+		ToUpdate: []string{"10.0.0.2", "10.0.0.3"},
+		ToRemove: []string{"10.0.0.4"},
+		Groups:   map[string]string{"10.0.0.3": "office"},
+	}, q.diff(CauseResync))
+}
@@ -2,6 +2,8 @@ package broadcast
 
 import (
 	"context"
+	"maps"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -24,6 +26,7 @@ type server struct {
 // Service represents an interface that combines Broadcaster, PeerManager, and the base service.Service functionalities.
 type Service interface {
 	Broadcaster
+	Waiter
 	PeerManager
 	service.Service
 }
@@ -32,8 +35,15 @@ type Service interface {
 // for cancellation and deadlines.
 type PeerWriter func(ctx context.Context, message UpdateMessage) error
 
+// Config describes broadcaster settings.
+// Interval is the window to coalesce updates, peers receive one net diff per window, zero disables batching.
+// The window is closed early when somebody waits for delivery of items.
+// QueueSize limits pending messages of every peer, on overflow the peer is resynchronized with the full table.
+// RetryInterval is the initial delay before a failed peer is resynchronized, it doubles up to a minute.
 type Config struct {
-	Interval time.Duration `env:"INTERVAL" default:"90s"`
+	Interval      time.Duration `env:"INTERVAL"       default:"90s"`
+	QueueSize     int           `env:"QUEUE_SIZE"     default:"1024"`
+	RetryInterval time.Duration `env:"RETRY_INTERVAL" default:"1s"`
 }
 
 type actionType uint8
@@ -60,7 +70,7 @@ func New(cfg Config, log *logger.Logger) Service {
 
 		Logger: out,
 		Service: service.NewLauncher("broadcaster",
-			runner(out, runnerParams{closed: closed, action: action, output: output}),
+			runner(out, cfg, runnerParams{closed: closed, action: action, output: output}),
 			func(ctx context.Context) { out.InfoContext(ctx, "shutdown gracefully") }),
 	}
 }
@@ -71,15 +81,47 @@ type runnerParams struct {
 	output chan UpdateMessage
 }
 
-func runner(log *logger.Logger, rp runnerParams) service.Launcher {
+func runner(log *logger.Logger, cfg Config, rp runnerParams) service.Launcher {
 	return func(ctx context.Context) error {
 		var (
-			list []string
-			peer = make(map[string]PeerWriter)
+			list = make(map[string]string)
+			peer = make(map[string]*peerQueue)
+
+			// sent is the table already sent to peers, changes of the list are sent at the end of the window
+			sent    = make(map[string]string)
+			cause   UpdateCause
+			pending bool
+			timer   = time.NewTimer(cfg.Interval)
+			window  <-chan time.Time
 		)
 
-		ticker := time.NewTimer(time.Millisecond)
-		defer ticker.Stop()
+		timer.Stop()
+		defer timer.Stop()
+
+		flush := func() {
+			msg := diffTable(cause, list, sent)
+			pending, sent = false, maps.Clone(list)
+
+			if len(msg.ToUpdate) == 0 && len(msg.ToRemove) == 0 {
+				log.InfoContext(ctx, "ignore empty window, changes cancelled out",
+					logger.String("cause", msg.Cause.String()))
+
+				return
+			}
+
+			log.InfoContext(ctx, "would sent to peers",
+				logger.Int("peers", len(peer)),
+				logger.String("cause", msg.Cause.String()),
+				logger.Int("update-count", len(msg.ToUpdate)),
+				logger.Int("remove-count", len(msg.ToRemove)),
+				logger.Any("update-list", msg.ToUpdate),
+				logger.Any("remove-list", msg.ToRemove))
+
+			// доставка выполняется в очереди каждого пира и не блокирует остальных
+			for _, queue := range peer {
+				queue.push(ctx, msg, list)
+			}
+		}
 
 		log.InfoContext(ctx, "prepare")
 
@@ -93,6 +135,10 @@ func runner(log *logger.Logger, rp runnerParams) service.Launcher {
 				close(rp.action)
 				close(rp.output)
 
+				for _, queue := range peer {
+					queue.stop()
+				}
+
 				return nil
 
 			case msg := <-rp.action:
@@ -101,36 +147,55 @@ func runner(log *logger.Logger, rp runnerParams) service.Launcher {
 					log.InfoContext(ctx, "try update peer",
 						logger.String("peer", msg.Peer))
 
-					if _, ok := peer[msg.Peer]; ok {
+					// новая сессия не содержит наших маршрутов, поэтому всегда отправляем полную таблицу
+					if queue, ok := peer[msg.Peer]; ok {
 						log.InfoContext(ctx, "update exists peer",
 							logger.String("peer", msg.Peer),
 							logger.Int("updates", len(list)))
 
-						peer[msg.Peer] = msg.writer
-
-						continue loop
+						queue.stop()
 					}
 
-					peer[msg.Peer] = msg.writer
-
 					log.InfoContext(ctx, "try to send initial table",
 						logger.String("peer", msg.Peer),
 						logger.Int("updates", len(list)))
 
-					if err := msg.writer(ctx, UpdateMessage{ToUpdate: list}); err != nil {
-						log.ErrorContext(ctx, "could not send initial table", logger.Err(err))
-					}
+					peer[msg.Peer] = newPeerQueue(ctx, log, cfg, msg.Peer, msg.writer)
+					peer[msg.Peer].resync(list)
 
 					log.InfoContext(ctx, "current peers", logger.Int("count", len(peer)))
 
 				case remPeer:
 					log.InfoContext(ctx, "remove peer writer", logger.String("peer", msg.Peer))
-					delete(peer, msg.Peer)
+
+					if queue, ok := peer[msg.Peer]; ok {
+						queue.stop()
+						delete(peer, msg.Peer)
+					}
 				default:
 					log.ErrorContext(ctx, "unknown Action", logger.Any("Action", msg))
 				}
 
+			case <-window:
+				window = nil
+
+				flush()
+
 			case msg := <-rp.output:
+				if msg.wait != nil {
+					// ожидающий не должен ждать конца окна, изменения отправляются сразу
+					if pending {
+						timer.Stop()
+						window = nil
+
+						flush()
+					}
+
+					watch(list, peer, msg.wait)
+
+					continue loop
+				}
+
 				if len(msg.ToUpdate) == 0 && len(msg.ToRemove) == 0 {
 					log.InfoContext(ctx, "ignore empty message update",
 						logger.String("cause", msg.Cause.String()))
@@ -138,36 +203,49 @@ func runner(log *logger.Logger, rp runnerParams) service.Launcher {
 					continue loop
 				}
 
-				list = updateList(log, list, msg)
+				updateList(log, list, msg)
 
-				log.InfoContext(ctx, "would sent to peers",
-					logger.Int("peers", len(peer)),
-					logger.Int("update-count", len(msg.ToUpdate)),
-					logger.Int("remove-count", len(msg.ToRemove)),
-					logger.Any("update-list", msg.ToUpdate),
-					logger.Any("remove-list", msg.ToRemove))
+				switch {
+				case !pending:
+					pending, cause = true, msg.Cause
+				case cause != msg.Cause:
+					cause = CauseBatch
+				}
 
-				for name, writer := range peer {
-					if err := writer(ctx, msg); err != nil {
-						log.ErrorContext(ctx, "could not send update table", logger.Err(err))
-						continue loop
-					}
+				if cfg.Interval <= 0 {
+					flush()
 
-					log.InfoContext(ctx, "message send successfully",
-						logger.String("peer", name),
-						logger.Int("update-count", len(msg.ToUpdate)),
-						logger.Int("remove-count", len(msg.ToRemove)),
-						logger.Any("update-list", msg.ToUpdate),
-						logger.Any("remove-list", msg.ToRemove))
+					continue loop
+				}
+
+				// изменения копятся до конца окна, пиры получают одну итоговую разницу
+				if window == nil {
+					timer.Reset(cfg.Interval)
+					window = timer.C
 				}
 			}
 		}
 	}
 }
 
-func updateList(log *logger.Logger, list []string, msg UpdateMessage) []string {
+// watch registers the waiter in every peer queue, items that are not in the table are not waited for.
+func watch(list map[string]string, peer map[string]*peerQueue, item *waiter) {
+	item.items = slices.DeleteFunc(item.items, func(name string) bool {
+		_, ok := list[name]
+
+		return !ok
+	})
+
+	item.expect(len(peer))
+	for _, queue := range peer {
+		queue.watch(item)
+	}
+}
+
+// updateList applies the message to the current table, the table maps items to their route groups.
+func updateList(log *logger.Logger, list map[string]string, msg UpdateMessage) {
 	if len(msg.ToUpdate) == 0 && len(msg.ToRemove) == 0 {
-		return list
+		return
 	}
 
 	log.Info("before update",
@@ -175,32 +253,10 @@ func updateList(log *logger.Logger, list []string, msg UpdateMessage) []string {
 		logger.Int("msg.remove", len(msg.ToRemove)),
 		logger.Int("list", len(list)))
 
-	// Создаем карту для отслеживания элементов списка
-	listMap := make(map[string]bool)
-	for _, item := range list {
-		listMap[item] = true
-	}
-
-	// Удаляем элементы, которые должны быть удалены
-	for _, item := range msg.ToRemove {
-		delete(listMap, item)
-	}
-
-	// Добавляем новые элементы
-	for _, item := range msg.ToUpdate {
-		listMap[item] = true
-	}
-
-	// Создаем обновленный список из карты
-	updatedList := make([]string, 0, len(listMap))
-	for item := range listMap {
-		updatedList = append(updatedList, item)
-	}
+	applyTable(list, msg)
 
 	log.Info("after update",
 		logger.Int("msg.update", len(msg.ToUpdate)),
 		logger.Int("msg.remove", len(msg.ToRemove)),
-		logger.Int("list", len(updatedList)))
-
-	return updatedList
+		logger.Int("list", len(list)))
 }
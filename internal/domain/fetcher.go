@@ -1,58 +1,337 @@
 package domain
 
 import (
+	"bufio"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/im-kulikov/go-bones"
+	"github.com/im-kulikov/go-bones/logger"
+	"github.com/klauspost/compress/zstd"
 )
 
+// Config describes the initial domain list: List is used as is, otherwise the list is fetched from Link.
+// Format is the syntax of the fetched list, see ParseFormat.
+// Cache is the directory for the last good copy of the list, MaxSize limits the decoded list.
 type Config struct {
 	Link    string        `env:"LINK"`
 	List    []string      `env:"LIST"`
-	Timeout time.Duration `env:"TIMEOUT" default:"30s"`
+	Format  string        `env:"FORMAT"   default:"auto"`
+	Cache   string        `env:"CACHE"`
+	MaxSize int64         `env:"MAX_SIZE" default:"67108864"`
+	Timeout time.Duration `env:"TIMEOUT"  default:"30s"`
 
 	*http.Client
 }
 
-func Fetch(cfg Config) ([]string, error) {
-	return FetchContext(context.Background(), cfg)
+// ErrTooLarge is returned for lists larger than the maximum size.
+const ErrTooLarge bones.Error = "list exceeds maximum size"
+
+// magic numbers of compressed files served without Content-Encoding.
+const (
+	gzipMagic = "\x1f\x8b"
+	zstdMagic = "\x28\xb5\x2f\xfd"
+)
+
+// Fetcher reads domain lists from URLs and local files.
+// HTTP lists are requested conditionally with ETag and Last-Modified of the last good copy,
+// gzip and zstd bodies are decoded. The last good copy is kept in memory and in the cache directory,
+// it is used when the list host is unreachable.
+type Fetcher struct {
+	client  *http.Client
+	cache   string
+	maxSize int64
+	log     *logger.Logger
+
+	lock   sync.Mutex
+	copies map[string]*listCopy
 }
 
-func FetchContext(top context.Context, cfg Config) (
+// listCopy is the last good copy of a list with validators of its response.
+type listCopy struct {
+	Location string `json:"location"`
+	ETag     string `json:"etag,omitempty"`
+	Modified string `json:"modified,omitempty"`
+
+	data []byte
+}
+
+func Fetch(cfg Config, log *logger.Logger) ([]string, error) {
+	return FetchContext(context.Background(), cfg, log)
+}
+
+func FetchContext(top context.Context, cfg Config, log *logger.Logger) (
 	[]string, error,
 ) {
 	var err error
 	if len(cfg.List) > 0 {
-		return cfg.List, nil
+		list := ParseList([]byte(strings.Join(cfg.List, "\n")), FormatPlain)
+		if len(list.Invalid) > 0 {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidDomain, list.Invalid)
+		}
+
+		return list.Domains, nil
+	}
+
+	var format Format
+	if format, err = ParseFormat(cfg.Format); err != nil {
+		return nil, err
+	} else if cfg.Link == "" {
+		return nil, fmt.Errorf("could not parse domain link(%q): link is empty", cfg.Link)
+	} else if cfg.MaxSize <= 0 {
+		return nil, fmt.Errorf("could not fetch domain link(%q): max size should be positive", cfg.Link)
 	}
 
 	ctx, cancel := context.WithTimeout(top, cfg.Timeout)
 	defer cancel()
 
-	var uri *url.URL
-	if uri, err = url.Parse(cfg.Link); err != nil || cfg.Link == "" {
-		return nil, fmt.Errorf("could not parse domain link(%q): %w", cfg.Link, err)
+	var list List
+	if list, err = NewFetcher(cfg.Client, cfg.Cache, cfg.MaxSize, log).Load(ctx, cfg.Link, format); err != nil {
+		return nil, err
+	}
+
+	// недопустимые строки отбрасываются, чтобы не попасть в хранилище
+	return list.Domains, nil
+}
+
+// NewFetcher creates a fetcher, the default client is used when the client is nil,
+// the last good copies are kept only in memory when the cache directory is empty.
+func NewFetcher(client *http.Client, cache string, maxSize int64, log *logger.Logger) *Fetcher {
+	if client == nil {
+		client = new(http.Client)
+	}
+
+	return &Fetcher{
+		client:  client,
+		cache:   cache,
+		maxSize: maxSize,
+		log:     log,
+		copies:  make(map[string]*listCopy),
+	}
+}
+
+// Read reads the list from the location: `http://` or `https://` URL, `file://` URL or a local path.
+func (f *Fetcher) Read(ctx context.Context, location string) ([]byte, error) {
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		file, err := os.Open(strings.TrimPrefix(location, "file://"))
+		if err != nil {
+			return nil, fmt.Errorf("could not read list(%q): %w", location, err)
+		}
+
+		defer func() { _ = file.Close() }()
+
+		return f.decode(location, file, "")
+	}
+
+	last := f.last(ctx, location)
+	next, err := f.fetch(ctx, location, last)
+
+	switch {
+	case err == nil:
+		f.keep(ctx, next)
+
+		return next.data, nil
+	case last == nil:
+		return nil, err
+	default:
+		// сохранённая копия лучше пустого списка, например при старте без доступа к источнику
+		f.log.WarnContext(ctx, "could not fetch list, last good copy is used",
+			logger.String("location", location),
+			logger.Err(err))
+
+		return last.data, nil
+	}
+}
+
+// fetch requests the list, the last copy is returned when the list was not modified.
+func (f *Fetcher) fetch(ctx context.Context, location string, last *listCopy) (*listCopy, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request(%q): %w", location, err)
+	}
+
+	// явный заголовок отключает прозрачную распаковку транспорта, поэтому тело декодируется здесь
+	req.Header.Set("Accept-Encoding", "gzip, zstd")
+	if last != nil && last.ETag != "" {
+		req.Header.Set("If-None-Match", last.ETag)
 	}
 
-	var req *http.Request
-	if req, err = http.NewRequestWithContext(ctx, http.MethodGet, uri.String(), nil); err != nil {
-		return nil, fmt.Errorf("could not create request(%q): %w", cfg.Link, err)
+	if last != nil && last.Modified != "" {
+		req.Header.Set("If-Modified-Since", last.Modified)
 	}
 
-	var res *http.Response
-	if res, err = new(http.Client).Do(req); err != nil {
-		return nil, fmt.Errorf("could not fetch response(%q): %w", cfg.Link, err)
+	res, err := f.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch list(%q): %w", location, err)
 	}
 
 	defer func() { _ = res.Body.Close() }()
-	var data []byte
-	if data, err = io.ReadAll(res.Body); err != nil || res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("%d: %s => %w", res.StatusCode, string(data), err)
+
+	switch {
+	case res.StatusCode == http.StatusNotModified && last != nil:
+		return last, nil
+	case res.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("could not fetch list(%q): unexpected status %d", location, res.StatusCode)
+	}
+
+	data, err := f.decode(location, res.Body, res.Header.Get("Content-Encoding"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &listCopy{
+		Location: location,
+		ETag:     res.Header.Get("ETag"),
+		Modified: res.Header.Get("Last-Modified"),
+		data:     data,
+	}, nil
+}
+
+// decode decodes the body by the content encoding or by the magic number of gzip and zstd files,
+// the decoded body is limited by the maximum size.
+func (f *Fetcher) decode(location string, body io.Reader, encoding string) ([]byte, error) {
+	buf := bufio.NewReader(body)
+	magic, _ := buf.Peek(len(zstdMagic))
+
+	var reader io.Reader = buf
+	switch encoding = strings.ToLower(strings.TrimSpace(encoding)); {
+	case encoding == "gzip", encoding == "x-gzip", encoding == "" && strings.HasPrefix(string(magic), gzipMagic):
+		gz, err := gzip.NewReader(buf)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode list(%q): %w", location, err)
+		}
+
+		defer func() { _ = gz.Close() }()
+
+		reader = gz
+	case encoding == "zstd", encoding == "" && string(magic) == zstdMagic:
+		dec, err := zstd.NewReader(buf, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("could not decode list(%q): %w", location, err)
+		}
+
+		defer dec.Close()
+
+		reader = dec
+	case encoding == "", encoding == "identity":
+	default:
+		return nil, fmt.Errorf("could not decode list(%q): unsupported encoding %q", location, encoding)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(reader, f.maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("could not read list(%q): %w", location, err)
+	} else if int64(len(data)) > f.maxSize {
+		return nil, fmt.Errorf("%w(%q): more than %d bytes", ErrTooLarge, location, f.maxSize)
+	}
+
+	return data, nil
+}
+
+// cachePath returns the path of the cached list, the extension is `.json` for validators and `.list` for the data.
+func (f *Fetcher) cachePath(location, ext string) string {
+	sum := sha256.Sum256([]byte(location))
+
+	return filepath.Join(f.cache, hex.EncodeToString(sum[:])+ext)
+}
+
+// last returns the last good copy of the list, the copy is loaded from the cache directory after restart.
+func (f *Fetcher) last(ctx context.Context, location string) *listCopy {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if item, ok := f.copies[location]; ok || f.cache == "" {
+		return item
+	}
+
+	item := new(listCopy)
+	meta, err := os.ReadFile(f.cachePath(location, ".json"))
+	if err == nil {
+		err = json.Unmarshal(meta, item)
+	}
+
+	if err == nil {
+		item.data, err = os.ReadFile(f.cachePath(location, ".list"))
+	}
+
+	if err != nil || item.Location != location {
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			f.log.WarnContext(ctx, "could not read cached list", logger.String("location", location), logger.Err(err))
+		}
+
+		return nil
+	}
+
+	f.copies[location] = item
+
+	return item
+}
+
+// keep remembers the good copy of the list and writes it into the cache directory.
+func (f *Fetcher) keep(ctx context.Context, item *listCopy) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.copies[item.Location] == item {
+		return
+	}
+
+	f.copies[item.Location] = item
+	if f.cache == "" {
+		return
+	}
+
+	meta, err := json.Marshal(item)
+	if err == nil {
+		err = os.MkdirAll(f.cache, 0o750)
+	}
+
+	// данные пишутся раньше валидаторов, чтобы валидаторы не ссылались на старую копию
+	if err == nil {
+		err = writeFile(f.cachePath(item.Location, ".list"), item.data)
+	}
+
+	if err == nil {
+		err = writeFile(f.cachePath(item.Location, ".json"), meta)
+	}
+
+	if err != nil {
+		f.log.WarnContext(ctx, "could not cache list", logger.String("location", item.Location), logger.Err(err))
+	}
+}
+
+// writeFile replaces the file atomically.
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Close()
+	} else {
+		_ = tmp.Close()
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		_ = os.Remove(tmp.Name())
 	}
 
-	return strings.Split(string(data), "\n"), nil
+	return err
 }
@@ -0,0 +1,231 @@
+package domain
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Format is a syntax of domain lists.
+type Format string
+
+// Supported formats of domain lists, FormatAuto detects the format by the content of the list.
+const (
+	FormatAuto    Format = "auto"
+	FormatPlain   Format = "plain"
+	FormatHosts   Format = "hosts"
+	FormatDnsmasq Format = "dnsmasq"
+	FormatAdGuard Format = "adguard"
+	FormatV2fly   Format = "v2fly"
+)
+
+// detectLines limits lines inspected by Detect.
+const detectLines = 100
+
+// entry is a parsed line of a list: domains, an included list or nothing for comments and unsupported rules.
+type entry struct {
+	names   []string
+	include string
+}
+
+// parser parses a trimmed non-empty line, false is returned for lines invalid in the format.
+type parser func(line string) (entry, bool)
+
+// ParseFormat parses the format name, the empty name means FormatAuto.
+func ParseFormat(value string) (Format, error) {
+	switch format := Format(strings.ToLower(strings.TrimSpace(value))); format {
+	case "":
+		return FormatAuto, nil
+	case FormatAuto, FormatPlain, FormatHosts, FormatDnsmasq, FormatAdGuard, FormatV2fly:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown list format %q: expected auto, plain, hosts, dnsmasq, adguard or v2fly", value)
+	}
+}
+
+// Detect returns the format of the list by the first lines with format-specific syntax, FormatPlain otherwise.
+// V2fly lists without prefixed lines can't be told apart from plain lists and should be configured explicitly.
+func Detect(data []byte) Format {
+	var checked int
+	for line := range strings.Lines(string(data)) {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if checked++; checked > detectLines {
+			break
+		}
+
+		switch fields := strings.Fields(line); {
+		case hasPrefix(line, "||", "@@", "!"):
+			return FormatAdGuard
+		case hasPrefix(line, "ipset=/", "nftset=/", "server=/"):
+			return FormatDnsmasq
+		case hasPrefix(line, "full:", "domain:", "include:", "keyword:", "regexp:"):
+			return FormatV2fly
+		case len(fields) > 1 && net.ParseIP(fields[0]) != nil:
+			return FormatHosts
+		}
+	}
+
+	return FormatPlain
+}
+
+func hasPrefix(line string, prefixes ...string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parserOf(format Format) parser {
+	switch format {
+	case FormatHosts:
+		return parseHosts
+	case FormatDnsmasq:
+		return parseDnsmasq
+	case FormatAdGuard:
+		return parseAdGuard
+	case FormatV2fly:
+		return parseV2fly
+	default:
+		return parsePlain
+	}
+}
+
+// withSubdomains returns the name and the wildcard covering its subdomains.
+func withSubdomains(name string) []string {
+	return []string{name, wildcardPrefix + Normalize(name)}
+}
+
+// parsePlain parses a domain per line, `#` starts a comment.
+func parsePlain(line string) (entry, bool) {
+	if index := strings.IndexByte(line, '#'); index >= 0 {
+		line = line[:index]
+	}
+
+	if line = strings.TrimSpace(line); line == "" {
+		return entry{}, true
+	}
+
+	return entry{names: []string{line}}, !strings.ContainsAny(line, " \t")
+}
+
+// parseHosts parses `address name [aliases...]` lines of hosts files, loopback names are skipped.
+func parseHosts(line string) (entry, bool) {
+	if index := strings.IndexByte(line, '#'); index >= 0 {
+		line = line[:index]
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return entry{}, true
+	} else if len(fields) == 1 || net.ParseIP(fields[0]) == nil {
+		return entry{}, false
+	}
+
+	var out entry
+	for _, name := range fields[1:] {
+		switch Normalize(name) {
+		case "localhost", "localhost.localdomain", "local", "broadcasthost",
+			"ip6-localhost", "ip6-loopback", "ip6-localnet", "ip6-mcastprefix",
+			"ip6-allnodes", "ip6-allrouters", "ip6-allhosts":
+		default:
+			out.names = append(out.names, name)
+		}
+	}
+
+	return out, true
+}
+
+// parseDnsmasq parses `ipset=/a.com/b.com/set`, `nftset=/a.com/4#inet#fw4#set` and `server=/a.com/1.1.1.1` lines,
+// dnsmasq matches subdomains as well, other options are skipped.
+func parseDnsmasq(line string) (entry, bool) {
+	// `#` внутри nftset является разделителем, комментарием считается только начало строки
+	option, value, ok := strings.Cut(line, "=")
+	if strings.HasPrefix(line, "#") || !ok {
+		return entry{}, true
+	}
+
+	switch strings.TrimSpace(option) {
+	case "ipset", "nftset", "server":
+	default:
+		return entry{}, true
+	}
+
+	parts := strings.Split(strings.TrimSpace(value), "/")
+	if len(parts) < 3 || parts[0] != "" {
+		return entry{}, false
+	}
+
+	var out entry
+	for _, name := range parts[1 : len(parts)-1] {
+		if name != "" {
+			out.names = append(out.names, withSubdomains(name)...)
+		}
+	}
+
+	return out, len(out.names) > 0
+}
+
+// parseAdGuard parses `||domain^` rules matching the domain and its subdomains, hosts and plain lines,
+// comments, exceptions, cosmetic rules and rules with modifiers are skipped.
+func parseAdGuard(line string) (entry, bool) {
+	switch {
+	case hasPrefix(line, "!", "#", "@@", "["), strings.Contains(line, "##"), strings.Contains(line, "#@#"):
+		return entry{}, true
+	case strings.Contains(line, "$"):
+		// модификаторы сужают правило до клиентов или типов запросов, маршрутизировать по нему нельзя
+		return entry{}, true
+	case strings.HasPrefix(line, "||"):
+		name := strings.TrimSuffix(strings.TrimSuffix(line[2:], "|"), "^")
+		if IsWildcard(name) {
+			return entry{names: []string{name}}, true
+		}
+
+		return entry{names: withSubdomains(name)}, true
+	case strings.HasPrefix(line, "|"), strings.HasPrefix(line, "/"):
+		// правила по URL и регулярные выражения не описывают домен
+		return entry{}, true
+	case len(strings.Fields(line)) > 1:
+		return parseHosts(line)
+	default:
+		return parsePlain(line)
+	}
+}
+
+// parseV2fly parses lines of domain-list-community: `domain:` (default) matches subdomains as well,
+// `full:` matches the name only, `include:` includes another list, attributes like `@ads` are ignored,
+// `keyword:` and `regexp:` rules are skipped.
+func parseV2fly(line string) (entry, bool) {
+	if index := strings.IndexByte(line, '#'); index >= 0 {
+		line = line[:index]
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return entry{}, true
+	}
+
+	kind, value, ok := strings.Cut(fields[0], ":")
+	if !ok {
+		kind, value = "domain", fields[0]
+	}
+
+	switch kind {
+	case "domain":
+		return entry{names: withSubdomains(value)}, true
+	case "full":
+		return entry{names: []string{value}}, true
+	case "include":
+		// список подключается из того же каталога, выход за его пределы запрещён
+		return entry{include: value}, value != "" && !strings.ContainsAny(value, `/\`) && !strings.HasPrefix(value, ".")
+	case "keyword", "regexp":
+		return entry{}, true
+	default:
+		return entry{}, false
+	}
+}
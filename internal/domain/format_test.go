@@ -0,0 +1,104 @@
+package domain
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetect(t *testing.T) {
+	cases := map[string]struct {
+		data   string
+		format Format
+	}{
+		"plain":   {"# comment\nexample.com\nexample.org\n", FormatPlain},
+		"hosts":   {"example.com\n0.0.0.0 example.org\n||example.net^\n", FormatHosts},
+		"adguard": {"! title\nexample.com\n||example.org^\n0.0.0.0 example.net\n", FormatAdGuard},
+		"dnsmasq": {"# comment\nserver=/example.com/1.1.1.1\n", FormatDnsmasq},
+		"v2fly":   {"example.com\nfull:www.example.org\n", FormatV2fly},
+		// одиночный адрес без имени не является строкой hosts
+		"address": {"127.0.0.1\nexample.com\n", FormatPlain},
+		"limit":   {strings.Repeat("example.com\n", detectLines) + "||example.org^\n", FormatPlain},
+	}
+
+	for name, tt := range cases {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tt.format, Detect([]byte(tt.data)))
+		})
+	}
+}
+
+func TestParseList(t *testing.T) {
+	t.Run("hosts", func(t *testing.T) {
+		list := ParseList([]byte(strings.Join([]string{
+			"127.0.0.1 localhost",
+			"0.0.0.0 Example.com www.example.com # comment",
+			"0.0.0.0 example.org bad!alias 10.0.0.1",
+			"0.0.0.0 bad!name",
+			"example.net",
+		}, "\n")), FormatHosts)
+
+		require.Equal(t, []string{"example.com", "example.org", "www.example.com"}, list.Domains)
+		require.Equal(t, []string{"0.0.0.0 bad!name", "example.net"}, list.Invalid)
+	})
+
+	t.Run("dnsmasq", func(t *testing.T) {
+		list := ParseList([]byte(strings.Join([]string{
+			"server=/a.com/",
+			"server=/b.com/1.1.1.1",
+			"ipset=/c.com/d.com/set",
+			"nftset=/e.com/4#inet#fw4#set",
+			"cache-size=1000",
+			"server=1.1.1.1",
+			"server=//1.1.1.1",
+		}, "\n")), FormatDnsmasq)
+
+		require.Equal(t, []string{
+			"*.a.com", "*.b.com", "*.c.com", "*.d.com", "*.e.com",
+			"a.com", "b.com", "c.com", "d.com", "e.com",
+		}, list.Domains)
+		require.Equal(t, []string{"server=1.1.1.1", "server=//1.1.1.1"}, list.Invalid)
+	})
+
+	t.Run("adguard", func(t *testing.T) {
+		list := ParseList([]byte(strings.Join([]string{
+			"! comment",
+			"||a.com^",
+			"||b.com^|",
+			"||*.c.com^",
+			"||d.com^$important",
+			"@@||e.com^",
+			"example.org##.banner",
+			"|https://f.com/path",
+			"/regexp/",
+			"0.0.0.0 g.com",
+			"h.com",
+		}, "\n")), FormatAdGuard)
+
+		require.Equal(t, []string{"*.a.com", "*.b.com", "*.c.com", "a.com", "b.com", "g.com", "h.com"}, list.Domains)
+		require.Empty(t, list.Invalid)
+	})
+
+	t.Run("v2fly", func(t *testing.T) {
+		list := ParseList([]byte(strings.Join([]string{
+			"a.com @ads",
+			"full:www.b.com",
+			"keyword:cdn",
+			"regexp:^c\\.com$",
+			"include:other",
+			"include:",
+			"include:../secret",
+			"include:dir/list",
+			`include:dir\list`,
+			"include:.hidden",
+			"unknown:d.com",
+		}, "\n")), FormatV2fly)
+
+		require.Equal(t, []string{"*.a.com", "a.com", "www.b.com"}, list.Domains)
+		require.Equal(t, []string{"other"}, list.Includes)
+		require.Equal(t, []string{
+			"include:", "include:../secret", "include:dir/list", `include:dir\list`, "include:.hidden", "unknown:d.com",
+		}, list.Invalid)
+	})
+}
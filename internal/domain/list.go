@@ -0,0 +1,120 @@
+package domain
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// List contains sorted unique domains and wildcards of a parsed list,
+// Invalid contains lines that could not be parsed, Includes contains names of lists included by v2fly lists.
+type List struct {
+	Domains  []string
+	Invalid  []string
+	Includes []string
+}
+
+// maxIncludes limits lists loaded by a single Load call.
+const maxIncludes = 256
+
+// ParseList parses the list of the format, every domain is normalized and validated, invalid names are dropped.
+// Comments and rules that could not be expressed as domains are skipped.
+func ParseList(data []byte, format Format) List {
+	if format == FormatAuto || format == "" {
+		format = Detect(data)
+	}
+
+	var (
+		out   List
+		parse = parserOf(format)
+	)
+
+	for line := range strings.Lines(string(data)) {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		item, ok := parse(line)
+		names := make([]string, 0, len(item.names))
+		for _, name := range item.names {
+			// адрес не является доменом, хотя Validate его пропускает
+			if name = Normalize(name); Validate(name) == nil && net.ParseIP(name) == nil {
+				names = append(names, name)
+			}
+		}
+
+		// неверный псевдоним hosts не должен терять остальные имена строки,
+		// ошибкой считается строка без единого верного имени
+		switch {
+		case !ok, len(item.names) > 0 && len(names) == 0:
+			out.Invalid = append(out.Invalid, line)
+		case item.include != "":
+			out.Includes = append(out.Includes, item.include)
+		default:
+			out.Domains = append(out.Domains, names...)
+		}
+	}
+
+	slices.Sort(out.Domains)
+	out.Domains = slices.Compact(out.Domains)
+
+	return out
+}
+
+// Load reads and parses the list, lists included by `include:` lines of v2fly lists
+// are read from the same directory as the location and merged into the result.
+func (f *Fetcher) Load(ctx context.Context, location string, format Format) (List, error) {
+	var (
+		out   List
+		seen  = make(map[string]bool)
+		queue = []string{location}
+	)
+
+	for len(queue) > 0 {
+		current := queue[0]
+		if queue = queue[1:]; seen[current] {
+			continue
+		} else if len(seen) >= maxIncludes {
+			return List{}, fmt.Errorf("could not load list(%q): more than %d included lists", location, maxIncludes)
+		}
+
+		seen[current] = true
+
+		data, err := f.Read(ctx, current)
+		if err != nil {
+			return List{}, err
+		}
+
+		list := ParseList(data, format)
+		out.Domains = append(out.Domains, list.Domains...)
+		out.Invalid = append(out.Invalid, list.Invalid...)
+		for _, name := range list.Includes {
+			queue = append(queue, sibling(current, name))
+		}
+
+		// подключать списки умеет только v2fly
+		format = FormatV2fly
+	}
+
+	slices.Sort(out.Domains)
+	out.Domains = slices.Compact(out.Domains)
+
+	return out, nil
+}
+
+// sibling returns the location of the named list in the same directory as the location.
+func sibling(location, name string) string {
+	if uri, err := url.Parse(location); err == nil && (uri.Scheme == "http" || uri.Scheme == "https") {
+		return uri.ResolveReference(&url.URL{Path: name}).String()
+	}
+
+	if path, ok := strings.CutPrefix(location, "file://"); ok {
+		return "file://" + filepath.Join(filepath.Dir(path), name)
+	}
+
+	return filepath.Join(filepath.Dir(location), name)
+}
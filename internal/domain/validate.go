@@ -17,11 +17,18 @@ var domainRegexp = regexp.MustCompile(
 	`^([a-zA-Z0-9_]{1}[a-zA-Z0-9_-]{0,62}){1}(\.[a-zA-Z0-9_]{1}[a-zA-Z0-9_-]{0,62})*[._]?$`)
 
 // Validate will validate the given string as a DNS name.
+// Wildcard patterns like `*.example.com` are allowed, the `*` label must be the leftmost one.
 func Validate(domain string) error {
 	if domain == "" || len(strings.ReplaceAll(domain, ".", "")) > 255 {
 		return fmt.Errorf("%w: domain is empty", ErrInvalidDomain)
 	}
 
+	if IsWildcard(domain) {
+		if domain = strings.TrimPrefix(domain, wildcardPrefix); !strings.Contains(domain, ".") {
+			return fmt.Errorf("%w: wildcard should cover at least second-level domain", ErrInvalidDomain)
+		}
+	}
+
 	if value, err := idna.Lookup.ToASCII(domain); err != nil {
 		return errors.Join(ErrInvalidDomain, err)
 	} else if domainRegexp.MatchString(value) {
@@ -0,0 +1,36 @@
+package domain
+
+import "strings"
+
+// wildcardPrefix is the leading label of a wildcard pattern, e.g. `*.example.com`.
+const wildcardPrefix = "*."
+
+// Normalize lowercases the name and removes the trailing dot of a fully qualified name.
+func Normalize(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// IsWildcard reports whether the name is a wildcard pattern like `*.example.com`.
+func IsWildcard(name string) bool {
+	return strings.HasPrefix(name, wildcardPrefix)
+}
+
+// Wildcards returns every wildcard pattern that could cover the name, from the closest to the farthest one.
+// For `a.b.example.com` it returns `*.b.example.com`, `*.example.com` and `*.com`.
+func Wildcards(name string) []string {
+	name = Normalize(name)
+	if IsWildcard(name) {
+		return nil
+	}
+
+	var out []string
+	for {
+		index := strings.IndexByte(name, '.')
+		if index < 0 {
+			return out
+		}
+
+		name = name[index+1:]
+		out = append(out, wildcardPrefix+name)
+	}
+}
@@ -2,11 +2,14 @@ package resolver
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"maps"
 	"math/rand/v2"
+	"net"
+	"os"
 	"slices"
-	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -15,15 +18,73 @@ import (
 	"github.com/miekg/dns"
 	"golang.org/x/sync/errgroup"
 
+	"github.com/im-kulikov/resolvex/internal/domain"
 	"github.com/im-kulikov/resolvex/internal/storage"
 )
 
+// Config describes resolver settings.
+// Servers contains plain DNS servers (`host:port`), DoH servers (`https://host/dns-query`)
+// and DoT servers (`tls://host:853`, the certificate name could be set by `?name=server-name`).
+// DoHMethod selects the HTTP method used for DoH servers (POST or GET).
+// RootCAs contains PEM files of CA certificates to verify DoH and DoT servers instead of system roots.
+// MinTTL and MaxTTL clamp the lowest TTL of answers, it is used to refresh domains and expire addresses:
+// an address expires one TTL after the refresh, so rotated addresses are not withdrawn right away.
+// DomainTTL overrides clamps per domain, entries have `pattern=min:max` format, e.g. `*.example.com=5m:30m`.
+// Domains are refreshed when their TTL expires: Timeout limits resolution of a single domain,
+// Workers limits the number of domains resolved at once, RateLimit limits queries per second
+// to every server (zero means no limit) and Jitter delays every refresh by a random duration
+// to spread domains with the same TTL.
+// Strategy selects servers for every domain: `all`, `fastest:N` (N servers with the lowest latency),
+// `round-robin` or `primary` (the first available server in the configured order, the next ones are secondary).
+// Health opens the circuit of a failing server, it is skipped until a probe after the cooldown succeeds.
+// Consensus decides which addresses of different servers are accepted: `union` of all answers,
+// `quorum:N` (an address must be returned by at least N servers) or `trusted` (answers of encrypted servers win).
+// DNSSEC enables validation of answers, bogus answers are not published.
+// Forwarder serves client queries with the same servers and publishes addresses of managed domains from answers.
+// Dnstap receives answers of recursive resolvers and publishes addresses of managed domains from them.
+// Discovery limits subdomains of wildcards discovered per second from answers of the forwarder and dnstap,
+// zero disables discovery from client traffic.
 type Config struct {
-	Servers []string      `env:"SERVERS"`
-	Timeout time.Duration `env:"TIMEOUT" default:"15s"`
+	Servers   []string      `env:"SERVERS"`
+	Timeout   time.Duration `env:"TIMEOUT"    default:"15s"`
+	DoHMethod string        `env:"DOH_METHOD" default:"POST"`
+	RootCAs   []string      `env:"ROOT_CAS"`
+
+	Workers   int           `env:"WORKERS"    default:"32"`
+	RateLimit float64       `env:"RATE_LIMIT" default:"50"`
+	Jitter    time.Duration `env:"JITTER"     default:"5s"`
+
+	Strategy  string       `env:"STRATEGY"  default:"all"`
+	Health    HealthConfig `env:"HEALTH"`
+	Consensus string       `env:"CONSENSUS" default:"union"`
+	DNSSEC    DNSSECConfig `env:"DNSSEC"`
+
+	Forwarder ForwarderConfig `env:"FORWARDER"`
+	Dnstap    DnstapConfig    `env:"DNSTAP"`
+	Discovery float64         `env:"DISCOVERY" default:"1"`
+
+	MinTTL    time.Duration `env:"MIN_TTL"    default:"1m"`
+	MaxTTL    time.Duration `env:"MAX_TTL"    default:"1h"`
+	DomainTTL []string      `env:"DOMAIN_TTL"`
+
+	upstreams []upstream
+	pool      *pool
+	consensus consensus
+	validator *validator
+	clamp     ttlClamp
+	clamps    map[string]ttlClamp // pattern => clamp
 }
 
-const defaultDomain = "google"
+const (
+	defaultDomain = "google"
+
+	// ErrNoServers is returned when circuits of all servers are open.
+	ErrNoServers bones.Error = "no available dns servers"
+	// ErrNoQuorum is returned when fewer servers than the quorum answered with addresses.
+	ErrNoQuorum bones.Error = "servers did not reach quorum"
+	// ErrBogus is returned when DNSSEC validation of the answer failed.
+	ErrBogus bones.Error = "dnssec validation failed"
+)
 
 // nolint:gochecknoglobals
 var defaultDNS atomic.Pointer[string]
@@ -33,178 +94,394 @@ func (c *Config) Validate(ctx context.Context, log *logger.Logger) error {
 		return fmt.Errorf("provide list of dns servers")
 	}
 
+	err := c.prepare()
+	if err != nil {
+		return err
+	}
+
 	msg := new(dns.Msg)
 	msg.SetQuestion(dns.Fqdn(defaultDomain), dns.TypeA)
 	msg.SetEdns0(4096, true)
 
-	for _, server := range c.Servers {
-		if err := bones.ExtractError(dns.ExchangeContext(ctx, msg, server)); err != nil {
-			return fmt.Errorf("dns server(%q) failed: %w", server, err)
+	// недоступный сервер не мешает запуску: его цепь размыкается до успешной пробы
+	var healthy []string
+	for _, server := range c.pool.members {
+		if err = bones.ExtractError(server.exchange(ctx, log, c.Health, msg)); err != nil {
+			server.trip(time.Now())
+
+			log.WarnContext(ctx, "dns server is unavailable",
+				logger.String("server", server.String()),
+				logger.Err(err))
+
+			continue
 		}
 
-		log.DebugContext(ctx, "server pass", logger.String("server", server))
+		healthy = append(healthy, server.String())
+
+		log.DebugContext(ctx, "server pass", logger.String("server", server.String()))
 	}
 
-	index := rand.IntN(len(c.Servers)) // nolint:gosec
-	defaultDNS.Store(&c.Servers[index])
+	if len(healthy) == 0 {
+		log.ErrorContext(ctx, "all dns servers are unavailable, resolver is degraded")
+
+		return nil
+	}
+
+	index := rand.IntN(len(healthy)) // nolint:gosec
+	defaultDNS.Store(&healthy[index])
 
 	return nil
 }
 
-type resolveParams struct {
-	*logger.Logger
+// prepare parses upstreams, their pool and TTL clamps, upstreams set beforehand are kept.
+func (c *Config) prepare() error {
+	switch {
+	case c.Timeout <= 0:
+		return fmt.Errorf("timeout should be positive")
+	case c.Workers <= 0:
+		return fmt.Errorf("number of workers should be positive")
+	case c.RateLimit < 0 || c.Jitter < 0 || c.Discovery < 0:
+		return fmt.Errorf("rate limit, jitter and discovery should not be negative")
+	}
+
+	var err error
+	if len(c.upstreams) == 0 {
+		if c.upstreams, err = c.newUpstreams(); err != nil {
+			return err
+		}
+	}
+
+	if c.pool, err = c.newPool(c.upstreams); err != nil {
+		return err
+	}
+
+	if c.consensus, err = c.newConsensus(); err != nil {
+		return err
+	}
+
+	// кворум больше числа опрашиваемых серверов не собирается никогда, и ничего не публикуется
+	if c.consensus.policy == consensusQuorum && c.consensus.quorum > c.pool.width() {
+		return fmt.Errorf("consensus %q requires %d servers, but strategy %q queries %d of %d servers",
+			c.Consensus, c.consensus.quorum, c.pool.strategy, c.pool.width(), len(c.pool.members))
+	}
+
+	if c.validator, err = c.newValidator(); err != nil {
+		return err
+	}
+
+	if c.clamp, c.clamps, err = c.newClamps(); err != nil {
+		return err
+	}
 
-	cnt *atomic.Int32
-	out chan dnsResult
+	return nil
 }
 
 type request struct {
 	domain  string
-	server  string
+	server  *member
 	message *dns.Msg
 }
 
-func (rp *resolveParams) resolveDomain(ctx context.Context, req request) func() error {
-	return func() error {
-		defer rp.cnt.Add(-1)
+// exchange sends the request to the server, failed requests are results too.
+func (c *Config) exchange(ctx context.Context, log *logger.Logger, req request) dnsResult {
+	log.DebugContext(ctx, "try to resolve",
+		logger.String("server", req.server.String()),
+		logger.String("domain", req.domain))
 
-		rp.DebugContext(ctx, "try to resolve",
-			logger.String("server", req.server),
-			logger.String("domain", req.domain))
+	val := dnsResult{New: storage.Item{Domain: req.domain}, Server: req.server.String(), Trusted: req.server.trusted}
 
-		res, err := dns.ExchangeContext(ctx, req.message, req.server)
-		if err != nil {
-			if strings.Contains(err.Error(), "i/o timeout") {
-				return nil
-			}
+	res, err := req.server.exchange(ctx, log, c.Health, req.message)
+	if err == nil && c.validator != nil && (res.Rcode == dns.RcodeSuccess || res.Rcode == dns.RcodeNameError) {
+		// поддельный ответ не должен попасть в хранилище, он становится ошибкой
+		if val.DNSSEC, err = c.validator.verify(ctx, c.queryOf(log, req.server), req.domain, res); err != nil {
+			res = nil
+		}
+	}
 
-			rp.ErrorContext(ctx, "could not resolve domain",
-				logger.String("server", req.server),
+	switch {
+	case err != nil:
+		// ошибка тоже является результатом, она попадает в статус домена
+		val.Err = err
+
+		if !isTimeout(err) {
+			log.ErrorContext(ctx, "could not resolve domain",
+				logger.String("server", req.server.String()),
 				logger.String("domain", req.domain),
 				logger.Err(err))
+		}
+	case res.Rcode == dns.RcodeNameError:
+		val.Rcode, val.TTL = res.Rcode, negativeTTL(res)
+	default:
+		val.Rcode, val.Chain = res.Rcode, cnameChain(req.domain, res.Answer)
+	}
 
-			return nil
+	for _, ra := range answerOf(res) {
+		val.Names = append(val.Names, ra.Header().Name)
+
+		// для расписания используется наименьший TTL адресов в ответе
+		switch ro := ra.(type) {
+		case *dns.A:
+			val.TTL = lowestTTL(val.TTL, ro.Hdr.Ttl, len(val.New.Record))
+			val.New.Record = append(val.New.Record, ro.A.String())
+		case *dns.AAAA:
+			val.TTL = lowestTTL(val.TTL, ro.Hdr.Ttl, len(val.New.Record))
+			val.New.Record = append(val.New.Record, ro.AAAA.String())
+		case *dns.CNAME:
+			val.Names = append(val.Names, ro.Target)
 		}
+	}
+
+	return val
+}
+
+// queryOf returns a function to query DNSSEC records from the server, the server should not validate them itself.
+func (c *Config) queryOf(log *logger.Logger, server *member) queryFunc {
+	return func(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(name), qtype)
+		msg.SetEdns0(4096, true)
+		msg.CheckingDisabled = true
 
-		val := dnsResult{New: storage.Item{Domain: req.domain}}
-		for _, ra := range res.Answer {
-			if ro, ok := ra.(*dns.A); ok {
-				val.TTL = ro.Hdr.Ttl
-				val.New.Record = append(val.New.Record, ro.A.String())
-			}
+		return server.exchange(ctx, log, c.Health, msg)
+	}
+}
+
+// resolve queries A and AAAA records of the domain from servers selected by the strategy within Timeout,
+// returns the item to publish and names seen in answers.
+func (c *Config) resolve(top context.Context, log *logger.Logger, name string) (storage.PublishItem, []string) {
+	ctx, cancel := context.WithTimeout(top, c.Timeout)
+	defer cancel()
+
+	var (
+		run  errgroup.Group
+		lock sync.Mutex
+		out  []dnsResult
+	)
+
+	servers := c.pool.pick(time.Now())
+	if len(servers) == 0 {
+		out = append(out, dnsResult{New: storage.Item{Domain: name}, Err: ErrNoServers})
+	}
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(name), qtype)
+		msg.SetEdns0(4096, true)
+		msg.CheckingDisabled = c.validator != nil
+
+		for _, server := range servers {
+			run.Go(func() error {
+				res := c.exchange(ctx, log, request{domain: name, server: server, message: msg})
+
+				lock.Lock()
+				out = append(out, res)
+				lock.Unlock()
+
+				return nil
+			})
 		}
+	}
 
-		rp.DebugContext(ctx, "try to send answer",
-			logger.String("server", req.server),
-			logger.String("domain", req.domain))
+	_ = run.Wait()
 
-		if err = ctx.Err(); err != nil {
-			return err
+	out, disagreement := c.consensus.agree(name, out)
+	if disagreement != nil {
+		attrs := []any{
+			logger.String("domain", name),
+			logger.Any("answers", disagreement.Answers),
+			logger.Any("rejected", disagreement.Rejected),
 		}
 
-		if err = ctx.Err(); err != nil {
-			return err
+		if len(disagreement.Rejected) > 0 {
+			log.WarnContext(ctx, "servers disagree, addresses rejected", attrs...)
+		} else {
+			log.InfoContext(ctx, "servers disagree", attrs...)
 		}
+	}
 
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case rp.out <- val:
-			return nil
+	now := time.Now()
+	seen := make(map[string]struct{})
+	classes := make(map[string]resultClass)
+	lst := make(map[string]storage.PublishItem)
+	for _, res := range out {
+		for _, item := range res.Names {
+			seen[item] = struct{}{}
 		}
+
+		c.collect(lst, classes, res, now)
 	}
-}
 
-func (c *Config) resolveDomains(
-	top context.Context,
-	log *logger.Logger,
-	store storage.DNS,
-) (int32, error) {
-	run, ctx := errgroup.WithContext(top)
+	item := lst[name]
+	item.Disagreement = disagreement
 
-	inc := new(atomic.Int32)
-	cli := resolveParams{cnt: new(atomic.Int32), out: make(chan dnsResult, 1000), Logger: log}
-	for _, domain := range store.ExpiredDomains() {
-		inc.Add(1)
+	// поддельный ответ вместе с пустым (например, AAAA) не должен отзывать адреса домена
+	index := slices.IndexFunc(out, func(res dnsResult) bool { return errors.Is(res.Err, ErrBogus) })
+	if index >= 0 && classes[name] < resultAnswered {
+		item.Rcode, item.Error, item.DNSSEC = "", errorStatus(out[index].Err), storage.DNSSECBogus
+		clear(item.Record)
+	}
 
-		log.DebugContext(ctx, "run resolve for domain",
-			logger.String("domain", domain))
+	return item, slices.Collect(maps.Keys(seen))
+}
 
-		msg := new(dns.Msg)
-		msg.SetQuestion(dns.Fqdn(domain), dns.TypeA)
-		msg.SetEdns0(4096, true)
+// cnameChain returns the chain of CNAME records from the answer, starting from the queried domain.
+func cnameChain(name string, answer []dns.RR) []string {
+	targets := make(map[string]string)
+	for _, ra := range answer {
+		if ro, ok := ra.(*dns.CNAME); ok {
+			targets[domain.Normalize(ro.Hdr.Name)] = domain.Normalize(ro.Target)
+		}
+	}
 
-		for _, server := range c.Servers {
-			log.DebugContext(ctx, "run resolver for server",
-				logger.String("server", server),
-				logger.String("domain", domain))
+	var chain []string
+	for current := domain.Normalize(name); ; {
+		next, ok := targets[current]
+		if !ok {
+			break
+		}
 
-			cli.cnt.Add(1)
-			run.Go(cli.resolveDomain(ctx, request{domain: domain, server: server, message: msg}))
+		if chain == nil {
+			chain = append(chain, current)
 		}
+
+		// цепочка может зациклиться, в том числе на себя, повторяющиеся имена не добавляем
+		if slices.Contains(chain, next) {
+			break
+		}
+
+		chain = append(chain, next)
+		current = next
 	}
 
-	if inc.Load() == 0 {
-		log.InfoContext(ctx, "nothing to do")
+	return chain
+}
 
-		return 0, nil
+// lowestTTL returns the lowest TTL of address records, count is the number of records seen before.
+func lowestTTL(current, ttl uint32, count int) uint32 {
+	if count == 0 {
+		return ttl
 	}
 
-	now := time.Now()
-	lst := make(map[string]storage.PublishItem)
-	run.Go(func() error {
-		tick := time.NewTimer(time.Second)
-
-	loop:
-		for {
-			select {
-			case <-ctx.Done():
-				log.DebugContext(ctx, "context done")
-				tick.Stop()
-				close(cli.out)
-				break loop
-			case <-tick.C:
-				log.DebugContext(ctx, "wait for results")
-				tick.Reset(time.Second)
-
-				if cli.cnt.Load() <= 0 {
-					close(cli.out)
-					break loop
-				}
-			case res, ok := <-cli.out:
-				if !ok {
-					continue loop
-				}
-
-				newExpires := time.Now().Add(time.Hour)
-				if _, ok = lst[res.New.Domain]; !ok {
-					lst[res.New.Domain] = storage.PublishItem{
-						Domain: res.New.Domain,
-						Record: make(map[string]time.Time),
-						Expire: now.Add(time.Second * time.Duration(res.TTL)),
-					}
-				}
-
-				log.DebugContext(ctx, "received message", logger.Any("message", res))
-				for _, address := range res.New.Record {
-					var oldExpires time.Time
-					if oldExpires, ok = lst[res.New.Domain].Record[address]; !ok {
-						lst[res.New.Domain].Record[address] = newExpires
-					} else if oldExpires.Before(newExpires) {
-						lst[res.New.Domain].Record[address] = newExpires
-					}
-				}
-			}
+	return min(current, ttl)
+}
+
+// resultClass orders results of a domain, the better class wins when results of servers differ.
+type resultClass int
+
+const (
+	resultFailed resultClass = iota + 1
+	resultNegative
+	resultEmpty
+	resultAnswered
+)
+
+func (r dnsResult) class() resultClass {
+	switch {
+	case r.Err != nil || (r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError):
+		return resultFailed
+	case r.Rcode == dns.RcodeNameError:
+		return resultNegative
+	case len(r.New.Record) == 0:
+		return resultEmpty
+	default:
+		return resultAnswered
+	}
+}
+
+// collect merges the result into the domain item to publish.
+func (c *Config) collect(
+	lst map[string]storage.PublishItem,
+	classes map[string]resultClass,
+	res dnsResult,
+	now time.Time,
+) {
+	item, exists := lst[res.New.Domain]
+	if !exists {
+		item = storage.PublishItem{Domain: res.New.Domain, Record: make(map[string]time.Time)}
+	}
+
+	// домен обновляется, когда истекает TTL ответа с учётом ограничений, адреса живут на TTL дольше,
+	// для NXDOMAIN используется отрицательный TTL (RFC 2308), для ошибок - минимальный
+	class, expires := res.class(), now.Add(c.clampTTL(res.New.Domain, res.TTL))
+	addressExpires := c.expiry(res.New.Domain, res.TTL, now)
+	switch current := classes[res.New.Domain]; {
+	case class > current:
+		// пустой ответ (например, AAAA для IPv4-only домена) не должен влиять на время жизни ответа с адресами
+		classes[res.New.Domain] = class
+		item.Expire = expires
+		item.Rcode, item.Error = dns.RcodeToString[res.Rcode], ""
+
+		if res.Err != nil {
+			item.Rcode, item.Error = "", errorStatus(res.Err)
 		}
 
+		item.DNSSEC = res.DNSSEC
+	case class == current:
+		// ответы одного класса: статус проверки - наименее защищённый из них
+		item.DNSSEC = weaker(item.DNSSEC, res.DNSSEC)
+
+		if class != resultFailed && expires.Before(item.Expire) {
+			item.Expire = expires
+		}
+	}
+
+	for _, address := range res.New.Record {
+		if old, ok := item.Record[address]; !ok || old.Before(addressExpires) {
+			item.Record[address] = addressExpires
+		}
+	}
+
+	// ответы разных серверов могут отличаться, сохраняем самую длинную цепочку
+	if len(res.Chain) > len(item.Chain) {
+		item.Chain = res.Chain
+	}
+
+	lst[res.New.Domain] = item
+}
+
+// weaker returns the less secure of DNSSEC validation statuses, empty status is unknown.
+func weaker(a, b string) string {
+	order := []string{storage.DNSSECBogus, storage.DNSSECInsecure, storage.DNSSECSecure}
+	switch first, second := slices.Index(order, a), slices.Index(order, b); {
+	case first < 0, second >= 0 && second < first:
+		return b
+	default:
+		return a
+	}
+}
+
+// answerOf returns answer records of the response, failed and negative responses have no answers.
+func answerOf(res *dns.Msg) []dns.RR {
+	if res == nil || res.Rcode != dns.RcodeSuccess {
 		return nil
-	})
+	}
 
-	if err := run.Wait(); err != nil {
-		return 0, fmt.Errorf("something went wrong: %w", err)
+	return res.Answer
+}
+
+// negativeTTL returns TTL of the negative answer: the lowest of SOA TTL and its MINIMUM field (RFC 2308).
+func negativeTTL(res *dns.Msg) uint32 {
+	for _, ra := range res.Ns {
+		if soa, ok := ra.(*dns.SOA); ok {
+			return min(soa.Hdr.Ttl, soa.Minttl)
+		}
 	}
 
-	store.Publish(slices.Collect(maps.Values(lst)))
+	return 0
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+
+	return errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, os.ErrDeadlineExceeded) ||
+		(errors.As(err, &netErr) && netErr.Timeout())
+}
+
+func errorStatus(err error) string {
+	if isTimeout(err) {
+		return "timeout"
+	}
 
-	return inc.Load(), nil
+	return err.Error()
 }
@@ -0,0 +1,255 @@
+package resolver
+
+import (
+	"context"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/im-kulikov/go-bones/logger"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+
+	"github.com/im-kulikov/resolvex/internal/storage"
+)
+
+func TestCnameChain(t *testing.T) {
+	answer := make([]dns.RR, 0, 4)
+	for _, line := range []string{
+		"edge.cdn.net. 60 IN CNAME edge.Akamai.net.",
+		"www.example.com. 60 IN CNAME edge.cdn.net.",
+		"edge.akamai.net. 60 IN A 10.0.0.1",
+		"loop.example.com. 60 IN CNAME loop.example.com.",
+	} {
+		rr, err := dns.NewRR(line)
+		require.NoError(t, err)
+
+		answer = append(answer, rr)
+	}
+
+	require.Equal(t,
+		[]string{"www.example.com", "edge.cdn.net", "edge.akamai.net"},
+		cnameChain("WWW.example.com.", answer))
+
+	require.Nil(t, cnameChain("edge.akamai.net", answer))
+	require.Equal(t, []string{"loop.example.com"}, cnameChain("loop.example.com", answer))
+}
+
+type testUpstream map[uint16][]string
+
+func (u testUpstream) Exchange(_ context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	res := new(dns.Msg)
+	res.SetReply(msg)
+
+	for _, line := range u[msg.Question[0].Qtype] {
+		rr, err := dns.NewRR(line)
+		if err != nil {
+			return nil, err
+		}
+
+		if rr.Header().Name == msg.Question[0].Name {
+			res.Answer = append(res.Answer, rr)
+		}
+	}
+
+	return res, nil
+}
+
+func (u testUpstream) String() string { return "test" }
+
+type testStore struct {
+	sync.Mutex
+
+	domains   []string
+	wildcards []string
+	published []storage.PublishItem
+	changes   chan struct{}
+	changed   []storage.Schedule
+}
+
+func (s *testStore) AllDomains() []string { return s.domains }
+
+func (s *testStore) Publish(domains []storage.PublishItem) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.published = append(s.published, domains...)
+}
+
+func (s *testStore) Observe(names ...string) []string {
+	// без wildcard список не меняется, тесты планировщика читают его без блокировки
+	added := s.Covered(names...)
+	if len(added) > 0 {
+		s.domains = append(s.domains, added...)
+	}
+
+	return added
+}
+
+func (s *testStore) Covered(names ...string) []string {
+	var out []string
+	for _, name := range names {
+		for _, pattern := range s.wildcards {
+			if strings.HasSuffix(name, pattern[1:]) && !slices.Contains(s.domains, name) {
+				out = append(out, name)
+
+				break
+			}
+		}
+	}
+
+	return out
+}
+
+func (s *testStore) Managed(names ...string) []string {
+	var out []string
+	for _, name := range names {
+		if slices.Contains(s.domains, name) {
+			out = append(out, name)
+		}
+	}
+
+	return out
+}
+
+func (s *testStore) Schedules() []storage.Schedule {
+	out := make([]storage.Schedule, 0, len(s.domains))
+	for _, name := range s.domains {
+		out = append(out, storage.Schedule{Domain: name})
+	}
+
+	return out
+}
+
+func (s *testStore) Changes() <-chan struct{} { return s.changes }
+
+func (s *testStore) PopChanges() []storage.Schedule {
+	s.Lock()
+	defer s.Unlock()
+
+	out := s.changed
+	s.changed = nil
+
+	return out
+}
+
+// resolveAll resolves every domain of the store and returns published items.
+func resolveAll(cfg *Config, log *logger.Logger, store *testStore) map[string]storage.PublishItem {
+	out := make(map[string]storage.PublishItem)
+	for _, name := range store.domains {
+		out[name], _ = cfg.resolve(context.Background(), log, name)
+	}
+
+	return out
+}
+
+func TestConfig_ResolveTTL(t *testing.T) {
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	cfg := Config{
+		Timeout:   time.Second,
+		Workers:   1,
+		MinTTL:    time.Minute,
+		MaxTTL:    time.Hour,
+		DomainTTL: []string{"*.cdn.com=10s:30s"},
+		upstreams: []upstream{testUpstream{
+			dns.TypeA: {
+				"example.com. 300 IN A 10.0.0.1",
+				"example.com. 90 IN A 10.0.0.2",
+				"edge.cdn.com. 5 IN A 10.0.1.1",
+			},
+		}},
+	}
+
+	require.NoError(t, cfg.prepare())
+
+	store := &testStore{domains: []string{"example.com", "edge.cdn.com"}}
+	start := time.Now()
+
+	items := resolveAll(&cfg, log, store)
+	require.Len(t, items, 2)
+
+	expect := map[string]time.Duration{"example.com": 90 * time.Second, "edge.cdn.com": 10 * time.Second}
+	for _, item := range items {
+		ttl := expect[item.Domain]
+		require.WithinRange(t, item.Expire, start.Add(ttl), time.Now().Add(ttl), item.Domain)
+
+		// адреса переживают обновление ещё на один TTL
+		for _, expires := range item.Record {
+			require.Equal(t, item.Expire.Add(ttl), expires, item.Domain)
+		}
+	}
+}
+
+func TestConfig_Clamps(t *testing.T) {
+	for _, wrong := range []Config{
+		{MinTTL: time.Hour, MaxTTL: time.Minute},
+		{DomainTTL: []string{"example.com"}},
+		{DomainTTL: []string{"example.com=1m"}},
+		{DomainTTL: []string{"example.com=1h:1m"}},
+	} {
+		_, _, err := wrong.newClamps()
+		require.Error(t, err)
+	}
+
+	cfg := Config{MinTTL: time.Minute}
+	cfg.clamp, cfg.clamps, _ = cfg.newClamps()
+	require.Equal(t, time.Minute, cfg.clampTTL("example.com", 0))
+	require.Equal(t, 24*time.Hour, cfg.clampTTL("example.com", 86400))
+}
+
+type funcUpstream func(msg *dns.Msg) (*dns.Msg, error)
+
+func (u funcUpstream) Exchange(_ context.Context, msg *dns.Msg) (*dns.Msg, error) { return u(msg) }
+
+func (u funcUpstream) String() string { return "func" }
+
+func TestConfig_ResolveStatus(t *testing.T) {
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	cfg := Config{
+		Timeout: time.Second,
+		Workers: 1,
+		MinTTL:  time.Minute,
+		MaxTTL:  time.Hour,
+		upstreams: []upstream{funcUpstream(func(msg *dns.Msg) (*dns.Msg, error) {
+			res := new(dns.Msg)
+			res.SetReply(msg)
+
+			switch msg.Question[0].Name {
+			case "typo.example.com.":
+				soa, err := dns.NewRR("example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 600")
+				require.NoError(t, err)
+
+				res.Rcode, res.Ns = dns.RcodeNameError, []dns.RR{soa}
+			case "broken.example.com.":
+				res.Rcode = dns.RcodeServerFailure
+			default:
+				return nil, os.ErrDeadlineExceeded
+			}
+
+			return res, nil
+		})},
+	}
+
+	require.NoError(t, cfg.prepare())
+
+	store := &testStore{domains: []string{"typo.example.com", "broken.example.com", "slow.example.com"}}
+	start := time.Now()
+
+	items := resolveAll(&cfg, log, store)
+	require.Len(t, items, 3)
+
+	// отрицательный TTL берётся из SOA: min(TTL, MINIMUM)
+	require.Equal(t, "NXDOMAIN", items["typo.example.com"].Rcode)
+	require.False(t, items["typo.example.com"].Failed())
+	require.WithinRange(t, items["typo.example.com"].Expire, start.Add(10*time.Minute), time.Now().Add(10*time.Minute))
+
+	require.Equal(t, "SERVFAIL", items["broken.example.com"].Rcode)
+	require.True(t, items["broken.example.com"].Failed())
+	require.WithinRange(t, items["broken.example.com"].Expire, start.Add(time.Minute), time.Now().Add(time.Minute))
+
+	require.Equal(t, "timeout", items["slow.example.com"].Error)
+	require.True(t, items["slow.example.com"].Failed())
+}
@@ -0,0 +1,156 @@
+package resolver
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/im-kulikov/resolvex/internal/storage"
+)
+
+const (
+	// consensusUnion accepts addresses returned by any server.
+	consensusUnion = "union"
+	// consensusQuorum accepts addresses returned by at least N servers, e.g. `quorum:2`.
+	consensusQuorum = "quorum"
+	// consensusTrusted accepts only answers of encrypted (DoH and DoT) servers when there are any.
+	consensusTrusted = "trusted"
+
+	// defaultQuorum is the number of servers used by `quorum` policy without explicit number.
+	defaultQuorum = 2
+)
+
+// consensus decides which addresses returned by different servers are accepted.
+type consensus struct {
+	policy string
+	quorum int
+}
+
+// newConsensus parses Consensus policy: `union`, `quorum:N` or `trusted`.
+func (c *Config) newConsensus() (consensus, error) {
+	name, count, found := strings.Cut(strings.ToLower(strings.TrimSpace(c.Consensus)), ":")
+	switch {
+	case name == "" || (name == consensusUnion && !found):
+		return consensus{policy: consensusUnion}, nil
+	case name == consensusTrusted && !found:
+		return consensus{policy: consensusTrusted}, nil
+	case name == consensusQuorum && !found:
+		return consensus{policy: consensusQuorum, quorum: defaultQuorum}, nil
+	case name == consensusQuorum:
+		num, err := strconv.Atoi(count)
+		if err != nil || num <= 0 {
+			return consensus{}, fmt.Errorf("could not parse consensus %q: expected quorum:N", c.Consensus)
+		}
+
+		return consensus{policy: consensusQuorum, quorum: num}, nil
+	default:
+		return consensus{}, fmt.Errorf("unsupported consensus %q: expected union, quorum:N or trusted", c.Consensus)
+	}
+}
+
+// agree applies the policy to results of the domain, returns accepted results
+// and describes disagreement of servers, it is nil when servers agree.
+func (c consensus) agree(name string, list []dnsResult) ([]dnsResult, *storage.Disagreement) {
+	answers := make(map[string][]string)            // server => addresses
+	support := make(map[string]map[string]struct{}) // address => servers
+	trusted := make(map[string]bool)                // server => encrypted
+
+	var hasTrusted bool
+	for _, res := range list {
+		if res.class() == resultFailed {
+			continue
+		}
+
+		trusted[res.Server], hasTrusted = res.Trusted, hasTrusted || res.Trusted
+		if res.Rcode != dns.RcodeSuccess {
+			continue
+		}
+
+		answers[res.Server] = append(answers[res.Server], res.New.Record...)
+		for _, address := range res.New.Record {
+			if support[address] == nil {
+				support[address] = make(map[string]struct{})
+			}
+
+			support[address][res.Server] = struct{}{}
+		}
+	}
+
+	accepted := func(string) bool { return true }
+	switch c.policy {
+	case consensusQuorum:
+		accepted = func(address string) bool { return len(support[address]) >= c.quorum }
+	case consensusTrusted:
+		// ответ зашифрованных серверов нельзя подменить по пути, поэтому он побеждает
+		if !hasTrusted {
+			break
+		}
+
+		list = slices.DeleteFunc(slices.Clone(list), func(res dnsResult) bool { return !res.Trusted })
+		accepted = func(address string) bool {
+			for server := range support[address] {
+				if trusted[server] {
+					return true
+				}
+			}
+
+			return false
+		}
+	}
+
+	var rejected []string
+	for _, address := range slices.Sorted(maps.Keys(support)) {
+		if !accepted(address) {
+			rejected = append(rejected, address)
+		}
+	}
+
+	out := make([]dnsResult, 0, len(list))
+	for _, res := range list {
+		res.New.Record = slices.DeleteFunc(slices.Clone(res.New.Record), func(address string) bool {
+			return !accepted(address)
+		})
+
+		out = append(out, res)
+	}
+
+	var disagreement *storage.Disagreement
+	if len(rejected) > 0 || differ(answers) {
+		disagreement = &storage.Disagreement{Answers: answers, Rejected: rejected}
+	}
+
+	// адреса есть, но серверов для кворума не хватило: это ошибка, старые адреса сохраняются
+	if c.policy == consensusQuorum && len(support) > 0 && len(answers) < c.quorum {
+		return []dnsResult{{New: storage.Item{Domain: name}, Err: ErrNoQuorum}}, disagreement
+	}
+
+	return out, disagreement
+}
+
+// differ sorts addresses of every server and reports whether servers returned different addresses.
+func differ(answers map[string][]string) bool {
+	var (
+		first []string
+		found bool
+		other bool
+	)
+
+	for server, list := range answers {
+		slices.Sort(list)
+		list = slices.Compact(list)
+		answers[server] = list
+
+		switch {
+		case !found:
+			first, found = list, true
+		case !slices.Equal(first, list):
+			other = true
+		}
+	}
+
+	return other
+}
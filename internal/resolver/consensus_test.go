@@ -0,0 +1,125 @@
+package resolver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+
+	"github.com/im-kulikov/resolvex/internal/storage"
+)
+
+func answer(server string, trusted bool, records ...string) dnsResult {
+	return dnsResult{
+		New:     storage.Item{Domain: "example.com", Record: records},
+		Rcode:   dns.RcodeSuccess,
+		TTL:     60,
+		Server:  server,
+		Trusted: trusted,
+	}
+}
+
+func records(list []dnsResult) []string {
+	var out []string
+	for _, res := range list {
+		out = append(out, res.New.Record...)
+	}
+
+	return out
+}
+
+func TestConsensus_Agree(t *testing.T) {
+	for _, wrong := range []string{"random", "quorum:0", "quorum:x", "union:2", "trusted:1"} {
+		_, err := (&Config{Consensus: wrong}).newConsensus()
+		require.Error(t, err, wrong)
+	}
+
+	// отравленный сервер возвращает чужой адрес
+	results := []dnsResult{
+		answer("plain-a", false, "10.0.0.1", "10.0.0.2"),
+		answer("plain-b", false, "10.0.0.1", "10.6.6.6"),
+		answer("doh", true, "10.0.0.1", "10.0.0.2"),
+		{New: storage.Item{Domain: "example.com"}, Server: "broken", Err: ErrNoServers},
+	}
+
+	union, err := (&Config{Consensus: "union"}).newConsensus()
+	require.NoError(t, err)
+
+	out, disagreement := union.agree("example.com", results)
+	require.ElementsMatch(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.1", "10.6.6.6", "10.0.0.1", "10.0.0.2"}, records(out))
+	require.NotNil(t, disagreement)
+	require.Empty(t, disagreement.Rejected)
+	require.Equal(t, map[string][]string{
+		"plain-a": {"10.0.0.1", "10.0.0.2"},
+		"plain-b": {"10.0.0.1", "10.6.6.6"},
+		"doh":     {"10.0.0.1", "10.0.0.2"},
+	}, disagreement.Answers)
+
+	quorum, err := (&Config{Consensus: "quorum:2"}).newConsensus()
+	require.NoError(t, err)
+
+	out, disagreement = quorum.agree("example.com", results)
+	require.ElementsMatch(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.1", "10.0.0.1", "10.0.0.2"}, records(out))
+	require.Equal(t, []string{"10.6.6.6"}, disagreement.Rejected)
+
+	// ответил только один сервер: кворума нет, это ошибка
+	out, disagreement = quorum.agree("example.com", results[:1])
+	require.Len(t, out, 1)
+	require.ErrorIs(t, out[0].Err, ErrNoQuorum)
+	require.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, disagreement.Rejected)
+
+	trusted, err := (&Config{Consensus: "trusted"}).newConsensus()
+	require.NoError(t, err)
+
+	out, disagreement = trusted.agree("example.com", results)
+	require.Len(t, out, 1)
+	require.Equal(t, "doh", out[0].Server)
+	require.Equal(t, []string{"10.6.6.6"}, disagreement.Rejected)
+
+	// без зашифрованных серверов используются все ответы
+	out, _ = trusted.agree("example.com", results[:2])
+	require.Len(t, out, 2)
+
+	// серверы согласны
+	out, disagreement = quorum.agree("example.com", []dnsResult{
+		answer("plain-a", false, "10.0.0.2", "10.0.0.1"),
+		answer("plain-b", false, "10.0.0.1", "10.0.0.2"),
+	})
+	require.Len(t, out, 2)
+	require.Nil(t, disagreement)
+}
+
+func TestConfig_PrepareQuorum(t *testing.T) {
+	servers := []upstream{testUpstream{}, testUpstream{}, testUpstream{}}
+	for _, tc := range []struct {
+		consensus string
+		strategy  string
+		servers   int
+		valid     bool
+	}{
+		{consensus: "quorum:2", servers: 3, valid: true},
+		{consensus: "quorum:3", strategy: "all", servers: 3, valid: true},
+		{consensus: "quorum:2", strategy: "fastest:2", servers: 3, valid: true},
+		{consensus: "union", strategy: "primary", servers: 1, valid: true},
+		{consensus: "quorum:4", servers: 3},
+		{consensus: "quorum", servers: 1},
+		{consensus: "quorum:2", strategy: "primary", servers: 3},
+		{consensus: "quorum:2", strategy: "round-robin", servers: 3},
+		{consensus: "quorum:2", strategy: "fastest:1", servers: 3},
+	} {
+		cfg := Config{
+			Timeout:   time.Second,
+			Workers:   1,
+			Consensus: tc.consensus,
+			Strategy:  tc.strategy,
+			upstreams: servers[:tc.servers],
+		}
+
+		if err := cfg.prepare(); tc.valid {
+			require.NoError(t, err, tc)
+		} else {
+			require.ErrorContains(t, err, "requires", tc)
+		}
+	}
+}
@@ -0,0 +1,550 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/im-kulikov/resolvex/internal/storage"
+)
+
+// DNSSECConfig describes validation of answers: when Validate is set, RRSIG chains of answers
+// are verified up to TrustAnchors, DS or DNSKEY records of the root zone (the root KSKs by default).
+// Bogus answers are failures: addresses of the domain are not changed.
+type DNSSECConfig struct {
+	Validate     bool     `env:"VALIDATE"`
+	TrustAnchors []string `env:"TRUST_ANCHORS"`
+}
+
+const (
+	// dnssecMaxCache limits how long validated keys of a zone are cached.
+	dnssecMaxCache = time.Hour
+	// dnssecMaxDepth limits the length of the chain of trust.
+	dnssecMaxDepth = 16
+	// dnssecMaxOwners limits cached zones of owner names.
+	dnssecMaxOwners = 4096
+)
+
+// rootAnchors are DS records of the root zone KSK-2017 and KSK-2024.
+// nolint:gochecknoglobals
+var rootAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// queryFunc sends a query with the DO bit to the server that returned the answer.
+type queryFunc func(ctx context.Context, name string, qtype uint16) (*dns.Msg, error)
+
+// zoneKeys describes validated keys of a zone, insecure zones have no keys.
+type zoneKeys struct {
+	keys    []*dns.DNSKEY
+	secure  bool
+	expires time.Time
+}
+
+// zoneCut describes the zone of an owner name found by its SOA record.
+type zoneCut struct {
+	zone    string
+	expires time.Time
+}
+
+// validator verifies chains of trust, validated keys of zones are shared between servers.
+type validator struct {
+	sync.Mutex
+
+	anchors []*dns.DS
+	zones   map[string]zoneKeys // zone => validated keys
+	owners  map[string]zoneCut  // owner name => zone
+}
+
+func (c *Config) newValidator() (*validator, error) {
+	if !c.DNSSEC.Validate {
+		return nil, nil // nolint:nilnil
+	}
+
+	list := c.DNSSEC.TrustAnchors
+	if len(list) == 0 {
+		list = rootAnchors
+	}
+
+	out := &validator{zones: make(map[string]zoneKeys), owners: make(map[string]zoneCut)}
+	for _, entry := range list {
+		rr, err := dns.NewRR(strings.TrimSpace(entry))
+		if err != nil || rr == nil {
+			return nil, fmt.Errorf("could not parse trust anchor %q: %w", entry, err)
+		}
+
+		switch anchor := rr.(type) {
+		case *dns.DS:
+			out.anchors = append(out.anchors, anchor)
+		case *dns.DNSKEY:
+			out.anchors = append(out.anchors, anchor.ToDS(dns.SHA256))
+		default:
+			return nil, fmt.Errorf("trust anchor %q should be DS or DNSKEY record", entry)
+		}
+
+		if out.anchors[len(out.anchors)-1].Hdr.Name != "." {
+			return nil, fmt.Errorf("trust anchor %q should belong to the root zone", entry)
+		}
+	}
+
+	return out, nil
+}
+
+func bogus(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrBogus, fmt.Sprintf(format, args...))
+}
+
+type rrsetKey struct {
+	name  string
+	rtype uint16
+}
+
+// rrsets groups records by owner and type, signatures are grouped by the covered type.
+func rrsets(list []dns.RR) (map[rrsetKey][]dns.RR, map[rrsetKey][]*dns.RRSIG) {
+	sets := make(map[rrsetKey][]dns.RR)
+	sigs := make(map[rrsetKey][]*dns.RRSIG)
+	for _, rr := range list {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			key := rrsetKey{name: dns.CanonicalName(sig.Hdr.Name), rtype: sig.TypeCovered}
+			sigs[key] = append(sigs[key], sig)
+
+			continue
+		}
+
+		key := rrsetKey{name: dns.CanonicalName(rr.Header().Name), rtype: rr.Header().Rrtype}
+		sets[key] = append(sets[key], rr)
+	}
+
+	return sets, sigs
+}
+
+// check verifies the RRset by one of signatures made by the keys.
+func check(set []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY, now time.Time) error {
+	for _, sig := range sigs {
+		if !sig.ValidityPeriod(now) {
+			continue
+		}
+
+		for _, key := range keys {
+			if key.KeyTag() == sig.KeyTag && key.Algorithm == sig.Algorithm && sig.Verify(key, set) == nil {
+				return nil
+			}
+		}
+	}
+
+	return bogus("no valid signature of %s %s", set[0].Header().Name, dns.TypeToString[set[0].Header().Rrtype])
+}
+
+// verify validates the answer and returns its status, bogus answers are returned as errors.
+// Positive answers are validated by signatures of every RRset made by the zone of its owner,
+// negative answers by signed NSEC and NSEC3 records matching or covering the name.
+func (v *validator) verify(ctx context.Context, query queryFunc, name string, res *dns.Msg) (string, error) {
+	now := time.Now()
+
+	sets, sigs := rrsets(res.Answer)
+	if len(sets) == 0 {
+		return v.verifyDenial(ctx, query, name, res, now)
+	}
+
+	status := storage.DNSSECSecure
+	for key, set := range sets {
+		// зона берётся из SOA, а не из подписи: иначе ключ ample.com подписал бы example.com
+		zone, err := v.zoneOf(ctx, query, key.name, now)
+		if errors.Is(err, ErrBogus) {
+			return storage.DNSSECBogus, err
+		} else if err != nil {
+			return "", err
+		}
+
+		keys, err := v.keys(ctx, query, zone, now, 0)
+		if err != nil {
+			return storage.DNSSECBogus, err
+		}
+
+		if !keys.secure {
+			status = storage.DNSSECInsecure
+
+			continue
+		}
+
+		signed := slices.DeleteFunc(slices.Clone(sigs[key]), func(sig *dns.RRSIG) bool {
+			return dns.CanonicalName(sig.SignerName) != zone || !dns.IsSubDomain(sig.SignerName, key.name)
+		})
+
+		if err = check(set, signed, keys.keys, now); err != nil {
+			return storage.DNSSECBogus, err
+		}
+	}
+
+	return status, nil
+}
+
+// verifyDenial validates signatures of the negative answer.
+func (v *validator) verifyDenial(ctx context.Context, query queryFunc, name string, res *dns.Msg, now time.Time) (
+	string,
+	error,
+) {
+	zone := ""
+	for _, rr := range res.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			zone = dns.CanonicalName(soa.Hdr.Name)
+		}
+	}
+
+	if zone == "" || !dns.IsSubDomain(zone, name) {
+		var err error
+		if zone, err = v.zoneOf(ctx, query, name, now); errors.Is(err, ErrBogus) {
+			return storage.DNSSECBogus, err
+		} else if err != nil {
+			return "", err
+		}
+	}
+
+	keys, err := v.keys(ctx, query, zone, now, 0)
+	switch {
+	case err != nil:
+		return storage.DNSSECBogus, err
+	case !keys.secure:
+		return storage.DNSSECInsecure, nil
+	}
+
+	qtype := dns.TypeA
+	if len(res.Question) > 0 {
+		qtype = res.Question[0].Qtype
+	}
+
+	sets, sigs := rrsets(res.Ns)
+
+	var proven bool
+	for key, set := range sets {
+		if key.rtype != dns.TypeNSEC && key.rtype != dns.TypeNSEC3 {
+			continue
+		}
+
+		if err = check(set, sigs[key], keys.keys, now); err != nil {
+			return storage.DNSSECBogus, err
+		}
+
+		// подписанную запись зоны можно переиграть для любого имени, поэтому она должна относиться к имени
+		for _, rr := range set {
+			proven = proven || denies(rr, dns.Fqdn(name), zone, qtype, res.Rcode == dns.RcodeNameError)
+		}
+	}
+
+	if !proven {
+		return storage.DNSSECBogus, bogus("negative answer of %s has no signed denial of the name", name)
+	}
+
+	return storage.DNSSECSecure, nil
+}
+
+// denies reports whether the denial record proves the negative answer: NXDOMAIN is proven by records
+// covering the name or its ancestor in the zone, NODATA by the record of the name without the type.
+func denies(rr dns.RR, name, zone string, qtype uint16, nxdomain bool) bool {
+	switch item := rr.(type) {
+	case *dns.NSEC:
+		if !nxdomain {
+			return dns.CanonicalName(item.Hdr.Name) == dns.CanonicalName(name) && nodata(item.TypeBitMap, qtype)
+		}
+
+		return covers(item.Hdr.Name, item.NextDomain, name)
+	case *dns.NSEC3:
+		if !nxdomain {
+			return item.Match(name) && nodata(item.TypeBitMap, qtype)
+		}
+
+		// доказательство NSEC3 покрывает ближайшее несуществующее имя, а не обязательно сам запрос
+		for current := name; dns.IsSubDomain(zone, current) && current != zone; {
+			if item.Cover(current) {
+				return true
+			}
+
+			index, end := dns.NextLabel(current, 0)
+			if end {
+				break
+			}
+
+			current = current[index:]
+		}
+
+		return false
+	default:
+		return false
+	}
+}
+
+func nodata(types []uint16, qtype uint16) bool {
+	return !slices.Contains(types, qtype) && !slices.Contains(types, dns.TypeCNAME)
+}
+
+// covers reports whether the name is between the owner and the next name of the NSEC record in canonical order,
+// the last record of the zone points to the apex.
+func covers(owner, next, name string) bool {
+	if compareNames(owner, next) < 0 {
+		return compareNames(owner, name) < 0 && compareNames(name, next) < 0
+	}
+
+	return compareNames(owner, name) < 0 && dns.IsSubDomain(next, name)
+}
+
+// compareNames compares names in canonical DNS order (RFC 4034, section 6.1).
+func compareNames(a, b string) int {
+	left, right := dns.SplitDomainName(dns.CanonicalName(a)), dns.SplitDomainName(dns.CanonicalName(b))
+	slices.Reverse(left)
+	slices.Reverse(right)
+
+	return slices.Compare(left, right)
+}
+
+// zoneOf returns the zone of the name by its SOA record validated by the zone keys, zones of names are cached.
+func (v *validator) zoneOf(ctx context.Context, query queryFunc, name string, now time.Time) (string, error) {
+	name = dns.CanonicalName(name)
+
+	v.Lock()
+	cached, ok := v.owners[name]
+	v.Unlock()
+
+	if ok && now.Before(cached.expires) {
+		return cached.zone, nil
+	}
+
+	res, err := query(ctx, name, dns.TypeSOA)
+	if err != nil {
+		return "", err
+	}
+
+	sets, sigs := rrsets(append(slices.Clone(res.Answer), res.Ns...))
+	for key, set := range sets {
+		if key.rtype != dns.TypeSOA || !dns.IsSubDomain(key.name, name) {
+			continue
+		}
+
+		// SOA приходит от того же сервера, что и ответ: подписанная зона подтверждает его своими ключами,
+		// а неподписанную должен доказать родитель, иначе сервер выдумает разрез и понизит ответ до insecure
+		keys, err := v.keys(ctx, query, key.name, now, 0)
+		if err != nil {
+			return "", err
+		}
+
+		if keys.secure {
+			signed := slices.DeleteFunc(slices.Clone(sigs[key]), func(sig *dns.RRSIG) bool {
+				return dns.CanonicalName(sig.SignerName) != key.name
+			})
+
+			if err = check(set, signed, keys.keys, now); err != nil {
+				return "", err
+			}
+		}
+
+		cut := zoneCut{
+			zone:    key.name,
+			expires: now.Add(min(time.Duration(set[0].Header().Ttl)*time.Second, dnssecMaxCache)),
+		}
+
+		v.Lock()
+		// имена приходят от клиентов, поэтому кеш не растёт бесконечно
+		if len(v.owners) >= dnssecMaxOwners {
+			clear(v.owners)
+		}
+
+		v.owners[name] = cut
+		v.Unlock()
+
+		return cut.zone, nil
+	}
+
+	return "", fmt.Errorf("could not find zone of %s", name)
+}
+
+// keys returns validated keys of the zone: the root zone is validated by trust anchors,
+// other zones by DS records of the parent zone, which is found by the signer of DS records.
+func (v *validator) keys(ctx context.Context, query queryFunc, zone string, now time.Time, depth int) (
+	zoneKeys,
+	error,
+) {
+	v.Lock()
+	cached, ok := v.zones[zone]
+	v.Unlock()
+
+	if ok && now.Before(cached.expires) {
+		return cached, nil
+	}
+
+	if depth > dnssecMaxDepth {
+		return zoneKeys{}, bogus("chain of trust of %s is too long", zone)
+	}
+
+	var (
+		anchors []*dns.DS
+		ttl     = uint32(dnssecMaxCache / time.Second)
+	)
+
+	if zone == "." {
+		anchors = v.anchors
+	} else {
+		res, err := query(ctx, zone, dns.TypeDS)
+		if err != nil {
+			return zoneKeys{}, err
+		}
+
+		var proven bool
+		if anchors, proven, ttl, err = v.delegation(ctx, query, zone, res, now, depth); err != nil {
+			return zoneKeys{}, err
+		}
+
+		if proven {
+			return v.store(zone, zoneKeys{}, ttl, now), nil
+		}
+	}
+
+	res, err := query(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return zoneKeys{}, err
+	}
+
+	sets, sigs := rrsets(res.Answer)
+	set := sets[rrsetKey{name: zone, rtype: dns.TypeDNSKEY}]
+
+	var trusted, keys []*dns.DNSKEY
+	for _, rr := range set {
+		key, ok := rr.(*dns.DNSKEY)
+		if !ok {
+			continue
+		}
+
+		keys = append(keys, key)
+		ttl = min(ttl, key.Hdr.Ttl)
+
+		for _, anchor := range anchors {
+			if ds := key.ToDS(anchor.DigestType); ds != nil && anchor.KeyTag == ds.KeyTag &&
+				anchor.Algorithm == ds.Algorithm && strings.EqualFold(anchor.Digest, ds.Digest) {
+				trusted = append(trusted, key)
+			}
+		}
+	}
+
+	if len(trusted) == 0 {
+		return zoneKeys{}, bogus("no DNSKEY of %s matches DS records", zone)
+	}
+
+	if err = check(set, sigs[rrsetKey{name: zone, rtype: dns.TypeDNSKEY}], trusted, now); err != nil {
+		return zoneKeys{}, err
+	}
+
+	return v.store(zone, zoneKeys{keys: keys, secure: true}, ttl, now), nil
+}
+
+// delegation validates DS records of the zone by keys of the parent zone,
+// proven is set when the parent zone is insecure or proves that the zone is not signed.
+func (v *validator) delegation(
+	ctx context.Context,
+	query queryFunc,
+	zone string,
+	res *dns.Msg,
+	now time.Time,
+	depth int,
+) ([]*dns.DS, bool, uint32, error) {
+	sets, sigs := rrsets(append(slices.Clone(res.Answer), res.Ns...))
+
+	// родительская зона - это подписавший DS или NSEC записи
+	parent := ""
+	for key, list := range sigs {
+		if key.rtype == dns.TypeDS || key.rtype == dns.TypeNSEC || key.rtype == dns.TypeNSEC3 {
+			parent = dns.CanonicalName(list[0].SignerName)
+		}
+	}
+
+	if parent == "" {
+		for _, rr := range res.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				parent = dns.CanonicalName(soa.Hdr.Name)
+			}
+		}
+	}
+
+	if parent == "" || parent == zone || !dns.IsSubDomain(parent, zone) {
+		return nil, false, 0, bogus("could not find parent zone of %s", zone)
+	}
+
+	keys, err := v.keys(ctx, query, parent, now, depth+1)
+	switch {
+	case err != nil:
+		return nil, false, 0, err
+	case !keys.secure:
+		return nil, true, uint32(dnssecMaxCache / time.Second), nil
+	}
+
+	if set := sets[rrsetKey{name: zone, rtype: dns.TypeDS}]; len(set) > 0 {
+		if err = check(set, sigs[rrsetKey{name: zone, rtype: dns.TypeDS}], keys.keys, now); err != nil {
+			return nil, false, 0, err
+		}
+
+		out := make([]*dns.DS, 0, len(set))
+		for _, rr := range set {
+			if ds, ok := rr.(*dns.DS); ok {
+				out = append(out, ds)
+			}
+		}
+
+		return out, false, set[0].Header().Ttl, nil
+	}
+
+	// DS нет: родитель должен подписанно доказать отсутствие DS или отказ от подписи (NSEC3 opt-out)
+	for key, set := range sets {
+		if key.rtype != dns.TypeNSEC && key.rtype != dns.TypeNSEC3 {
+			continue
+		}
+
+		if err = check(set, sigs[key], keys.keys, now); err != nil {
+			return nil, false, 0, err
+		}
+
+		for _, rr := range set {
+			if unsigned(rr, zone) {
+				return nil, true, rr.Header().Ttl, nil
+			}
+		}
+	}
+
+	return nil, false, 0, bogus("parent zone %s does not prove that %s is not signed", parent, zone)
+}
+
+// unsigned reports whether the denial record proves that the zone has no DS records.
+func unsigned(rr dns.RR, zone string) bool {
+	switch item := rr.(type) {
+	case *dns.NSEC:
+		return dns.CanonicalName(item.Hdr.Name) == zone && unsignedCut(item.TypeBitMap)
+	case *dns.NSEC3:
+		if item.Match(zone) {
+			return unsignedCut(item.TypeBitMap)
+		}
+
+		return item.Flags&1 == 1 && item.Cover(zone)
+	default:
+		return false
+	}
+}
+
+// unsignedCut reports whether the type bitmap describes an unsigned delegation: NS records without DS at the name,
+// which is not an apex of a zone. Denials of other names of the parent zone can't be replayed as a zone cut.
+func unsignedCut(types []uint16) bool {
+	return slices.Contains(types, dns.TypeNS) && !slices.Contains(types, dns.TypeSOA) &&
+		!slices.Contains(types, dns.TypeDS)
+}
+
+func (v *validator) store(zone string, keys zoneKeys, ttl uint32, now time.Time) zoneKeys {
+	keys.expires = now.Add(min(time.Duration(ttl)*time.Second, dnssecMaxCache))
+
+	v.Lock()
+	v.zones[zone] = keys
+	v.Unlock()
+
+	return keys
+}
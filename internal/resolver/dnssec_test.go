@@ -0,0 +1,241 @@
+package resolver
+
+import (
+	"context"
+	"crypto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/im-kulikov/go-bones/logger"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+
+	"github.com/im-kulikov/resolvex/internal/storage"
+)
+
+type testZone struct {
+	name string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZone(t *testing.T, name string) *testZone {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+
+	priv, err := key.Generate(256)
+	require.NoError(t, err)
+
+	return &testZone{name: name, key: key, priv: priv.(crypto.Signer)}
+}
+
+func (z *testZone) sign(t *testing.T, set ...dns.RR) []dns.RR {
+	now := time.Now()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: set[0].Header().Ttl},
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.name,
+		Algorithm:  z.key.Algorithm,
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		Expiration: uint32(now.Add(time.Hour).Unix()),
+	}
+	require.NoError(t, sig.Sign(z.priv, set))
+
+	return append(set, sig)
+}
+
+func (z *testZone) ds() dns.RR { return z.key.ToDS(dns.SHA256) }
+
+func (z *testZone) soa(t *testing.T) dns.RR {
+	rr, err := dns.NewRR(z.name + " 300 IN SOA ns." + z.name + " admin." + z.name + " 1 7200 900 1209600 300")
+	require.NoError(t, err)
+
+	return rr
+}
+
+func parseRRs(t *testing.T, lines ...string) []dns.RR {
+	out := make([]dns.RR, 0, len(lines))
+	for _, line := range lines {
+		rr, err := dns.NewRR(line)
+		require.NoError(t, err)
+
+		out = append(out, rr)
+	}
+
+	return out
+}
+
+type zoneAnswer struct {
+	rcode  int
+	answer []dns.RR
+	ns     []dns.RR
+}
+
+// signedZones returns the upstream serving the signed hierarchy: `.` -> `com.` -> `example.com.` and `ample.com.`,
+// `plain.com.` is not signed, and the DS record of the root zone.
+func signedZones(t *testing.T) (upstream, string) {
+	root, com, example := newTestZone(t, "."), newTestZone(t, "com."), newTestZone(t, "example.com.")
+	ample := newTestZone(t, "ample.com.")
+
+	// подпись от другой записи делает ответ поддельным
+	forged := example.sign(t, parseRRs(t, "fake.example.com. 60 IN A 10.0.0.1")...)
+	forged[0] = parseRRs(t, "fake.example.com. 60 IN A 10.6.6.6")[0]
+
+	answers := map[rrsetKey]zoneAnswer{
+		{".", dns.TypeDNSKEY}:                  {answer: root.sign(t, root.key)},
+		{"com.", dns.TypeDS}:                   {answer: root.sign(t, com.ds())},
+		{"com.", dns.TypeDNSKEY}:               {answer: com.sign(t, com.key)},
+		{"example.com.", dns.TypeDS}:           {answer: com.sign(t, example.ds())},
+		{"example.com.", dns.TypeDNSKEY}:       {answer: example.sign(t, example.key)},
+		{"ample.com.", dns.TypeDS}:             {answer: com.sign(t, ample.ds())},
+		{"ample.com.", dns.TypeDNSKEY}:         {answer: ample.sign(t, ample.key)},
+		{"sibling.example.com.", dns.TypeA}:    {answer: ample.sign(t, parseRRs(t, "sibling.example.com. 60 IN A 10.6.6.7")...)},
+		{"replayed.example.com.", dns.TypeA}:   {rcode: dns.RcodeNameError, ns: append(example.sign(t, example.soa(t)), example.sign(t, parseRRs(t, "www.example.com. 300 IN NSEC example.com. A RRSIG NSEC")...)...)},
+		{"www.example.com.", dns.TypeA}:        {answer: example.sign(t, parseRRs(t, "www.example.com. 60 IN A 10.0.0.1")...)},
+		{"fake.example.com.", dns.TypeA}:       {answer: forged},
+		{"stripped.example.com.", dns.TypeA}:   {answer: parseRRs(t, "stripped.example.com. 60 IN A 10.0.0.2")},
+		{"stripped.example.com.", dns.TypeSOA}: {ns: example.sign(t, example.soa(t))},
+		{"plain.com.", dns.TypeA}:              {answer: parseRRs(t, "plain.com. 60 IN A 10.0.0.3")},
+		{"plain.com.", dns.TypeSOA}:            {answer: parseRRs(t, "plain.com. 300 IN SOA ns.plain.com. admin.plain.com. 1 7200 900 1209600 300")},
+		{"forged.example.com.", dns.TypeA}:     {rcode: dns.RcodeNameError, ns: []dns.RR{example.soa(t)}},
+		{"missing.example.com.", dns.TypeA}:    {rcode: dns.RcodeNameError, ns: append(example.sign(t, example.soa(t)), example.sign(t, parseRRs(t, "example.com. 300 IN NSEC www.example.com. NS SOA RRSIG NSEC DNSKEY")...)...)},
+		{"plain.com.", dns.TypeDS}:             {ns: append(com.sign(t, com.soa(t)), com.sign(t, parseRRs(t, "plain.com. 300 IN NSEC z.com. NS RRSIG NSEC")...)...)},
+		// сервер выдумывает разрез зоны и доказывает отсутствие DS чужими записями NSEC
+		{"cut.example.com.", dns.TypeA}:         {answer: parseRRs(t, "cut.example.com. 60 IN A 10.6.6.8")},
+		{"cut.example.com.", dns.TypeSOA}:       {answer: parseRRs(t, "cut.example.com. 300 IN SOA ns.cut.example.com. admin.cut.example.com. 1 7200 900 1209600 300")},
+		{"cut.example.com.", dns.TypeDS}:        {ns: append(example.sign(t, example.soa(t)), example.sign(t, parseRRs(t, "cut.example.com. 300 IN NSEC www.example.com. A RRSIG NSEC")...)...)},
+		{"apex.example.com.", dns.TypeA}:        {answer: parseRRs(t, "apex.example.com. 60 IN A 10.6.6.9")},
+		{"apex.example.com.", dns.TypeSOA}:      {answer: parseRRs(t, "apex.example.com. 300 IN SOA ns.apex.example.com. admin.apex.example.com. 1 7200 900 1209600 300")},
+		{"apex.example.com.", dns.TypeDS}:       {ns: append(example.sign(t, example.soa(t)), example.sign(t, parseRRs(t, "apex.example.com. 300 IN NSEC www.example.com. NS SOA RRSIG NSEC DNSKEY")...)...)},
+		{"www.example.com.", dns.TypeAAAA}:      {ns: append(example.sign(t, example.soa(t)), example.sign(t, parseRRs(t, "www.example.com. 300 IN NSEC example.com. A RRSIG NSEC")...)...)},
+		{"fake.example.com.", dns.TypeAAAA}:     {ns: append(example.sign(t, example.soa(t)), example.sign(t, parseRRs(t, "fake.example.com. 300 IN NSEC www.example.com. A RRSIG NSEC")...)...)},
+		{"stripped.example.com.", dns.TypeAAAA}: {ns: append(example.sign(t, example.soa(t)), example.sign(t, parseRRs(t, "stripped.example.com. 300 IN NSEC www.example.com. A RRSIG NSEC")...)...)},
+	}
+
+	server := funcUpstream(func(msg *dns.Msg) (*dns.Msg, error) {
+		res := new(dns.Msg)
+		res.SetReply(msg)
+
+		item, ok := answers[rrsetKey{name: dns.CanonicalName(msg.Question[0].Name), rtype: msg.Question[0].Qtype}]
+		res.Rcode, res.Answer, res.Ns = item.rcode, item.answer, item.ns
+
+		// SOA имени внутри зоны отдаётся в authority, как у настоящих серверов
+		for _, zone := range []*testZone{example, ample, com} {
+			if !ok && msg.Question[0].Qtype == dns.TypeSOA && dns.IsSubDomain(zone.name, msg.Question[0].Name) {
+				res.Ns, ok = zone.sign(t, zone.soa(t)), true
+			}
+		}
+
+		return res, nil
+	})
+
+	return server, root.ds().String()
+}
+
+func TestValidator_Verify(t *testing.T) {
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	server, anchor := signedZones(t)
+
+	for _, wrong := range [][]string{{"wrong"}, {"example.com. IN A 10.0.0.1"}, {"com. IN DS 1 8 2 AA"}} {
+		_, err := (&Config{DNSSEC: DNSSECConfig{Validate: true, TrustAnchors: wrong}}).newValidator()
+		require.Error(t, err, wrong)
+	}
+
+	cfg := Config{DNSSEC: DNSSECConfig{Validate: true, TrustAnchors: []string{anchor}}}
+	list, err := cfg.newPool([]upstream{server})
+	require.NoError(t, err)
+
+	cfg.validator, err = cfg.newValidator()
+	require.NoError(t, err)
+
+	query := cfg.queryOf(log, list.members[0])
+	for name, expect := range map[string]string{
+		"www.example.com":      storage.DNSSECSecure,
+		"missing.example.com":  storage.DNSSECSecure,
+		"plain.com":            storage.DNSSECInsecure,
+		"fake.example.com":     storage.DNSSECBogus,
+		"stripped.example.com": storage.DNSSECBogus,
+		"forged.example.com":   storage.DNSSECBogus,
+		// ключ ample.com не подписывает example.com, хотя имя оканчивается на ample.com
+		"sibling.example.com": storage.DNSSECBogus,
+		// подписанная NSEC запись не покрывает запрошенное имя
+		"replayed.example.com": storage.DNSSECBogus,
+		// NSEC без NS и NSEC вершины зоны не доказывают неподписанное делегирование
+		"cut.example.com":  storage.DNSSECBogus,
+		"apex.example.com": storage.DNSSECBogus,
+	} {
+		res, err := query(context.Background(), name, dns.TypeA)
+		require.NoError(t, err)
+
+		status, err := cfg.validator.verify(context.Background(), query, name, res)
+		require.Equal(t, expect, status, name)
+
+		if expect == storage.DNSSECBogus {
+			require.ErrorIs(t, err, ErrBogus, name)
+		} else {
+			require.NoError(t, err, name)
+		}
+	}
+
+	// другой якорь доверия не подтверждает ключ корневой зоны
+	other, _ := signedZones(t)
+	cfg.validator, err = (&Config{DNSSEC: DNSSECConfig{Validate: true, TrustAnchors: []string{anchor}}}).newValidator()
+	require.NoError(t, err)
+
+	query = cfg.queryOf(log, &member{upstream: other})
+	res, err := query(context.Background(), "www.example.com", dns.TypeA)
+	require.NoError(t, err)
+
+	_, err = cfg.validator.verify(context.Background(), query, "www.example.com", res)
+	require.ErrorIs(t, err, ErrBogus)
+}
+
+func TestValidator_Unsigned(t *testing.T) {
+	for line, expect := range map[string]bool{
+		"sub.example.com. 300 IN NSEC www.example.com. NS RRSIG NSEC":            true,
+		"sub.example.com. 300 IN NSEC www.example.com. NS DS RRSIG NSEC":         false,
+		"sub.example.com. 300 IN NSEC www.example.com. A RRSIG NSEC":             false,
+		"sub.example.com. 300 IN NSEC www.example.com. NS SOA RRSIG NSEC DNSKEY": false,
+		"www.example.com. 300 IN NSEC zzz.example.com. NS RRSIG NSEC":            false,
+	} {
+		require.Equal(t, expect, unsigned(parseRRs(t, line)[0], "sub.example.com."), line)
+	}
+
+	// запись NSEC3 вершины зоны сопоставляется с именем, но делегированием не является
+	hash := dns.HashName("sub.example.com.", dns.SHA1, 0, "")
+	for bitmap, expect := range map[string]bool{"NS": true, "NS SOA DNSKEY": false, "A": false} {
+		rr := parseRRs(t, strings.ToLower(hash)+".example.com. 300 IN NSEC3 1 0 0 - AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA "+bitmap)[0]
+		require.Equal(t, expect, unsigned(rr, "sub.example.com."), bitmap)
+	}
+}
+
+func TestConfig_ResolveDNSSEC(t *testing.T) {
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	server, anchor := signedZones(t)
+
+	cfg := Config{
+		Timeout:   time.Second,
+		Workers:   1,
+		MinTTL:    time.Minute,
+		MaxTTL:    time.Hour,
+		DNSSEC:    DNSSECConfig{Validate: true, TrustAnchors: []string{anchor}},
+		upstreams: []upstream{server},
+	}
+	require.NoError(t, cfg.prepare())
+
+	item, _ := cfg.resolve(context.Background(), log, "www.example.com")
+	require.False(t, item.Failed())
+	require.Equal(t, storage.DNSSECSecure, item.DNSSEC)
+	require.Len(t, item.Record, 1)
+
+	// поддельный ответ не публикуется
+	item, _ = cfg.resolve(context.Background(), log, "fake.example.com")
+	require.True(t, item.Failed())
+	require.Equal(t, storage.DNSSECBogus, item.DNSSEC)
+	require.Empty(t, item.Record)
+}
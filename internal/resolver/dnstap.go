@@ -0,0 +1,173 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/im-kulikov/go-bones/logger"
+	"github.com/im-kulikov/go-bones/service"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/im-kulikov/resolvex/internal/storage"
+)
+
+// DnstapConfig describes the dnstap receiver, it is disabled when Address is empty.
+// Network is `unix` (Address is the socket path) or `tcp` (Address is `host:port`),
+// Timeout limits the Frame Streams handshake of every connection.
+type DnstapConfig struct {
+	Network string        `env:"NETWORK" default:"unix"`
+	Address string        `env:"ADDRESS"`
+	Timeout time.Duration `env:"TIMEOUT" default:"5s"`
+}
+
+const dnstapName = "dnstap-receiver"
+
+// receiver reads dnstap frames of recursive resolvers and publishes addresses of managed domains from responses.
+type receiver struct {
+	snooper
+}
+
+// NewDnstap creates a dnstap receiver, only CLIENT_RESPONSE messages are used as answers:
+// RESOLVER_RESPONSE messages are raw replies of upstream servers, which are not validated by the resolver yet.
+func NewDnstap(cfg Config, log *logger.Logger, store storage.DNS) (service.Service, error) {
+	out := logger.Named(log, dnstapName)
+
+	switch {
+	case cfg.Dnstap.Address == "":
+	case cfg.Dnstap.Network != "unix" && cfg.Dnstap.Network != "tcp":
+		return nil, fmt.Errorf("%s: unsupported network %q: expected unix or tcp", dnstapName, cfg.Dnstap.Network)
+	case cfg.Dnstap.Timeout <= 0:
+		return nil, fmt.Errorf("%s: timeout should be positive", dnstapName)
+	}
+
+	if cfg.Dnstap.Address != "" && cfg.pool == nil {
+		if err := cfg.prepare(); err != nil {
+			return nil, err
+		}
+	}
+
+	rcv := &receiver{snooper: newSnooper(&cfg, out, store)}
+
+	return optionalService{
+		enabled: cfg.Dnstap.Address != "",
+		Service: service.NewLauncher(dnstapName, rcv.run, func(ctx context.Context) {
+			out.InfoContext(ctx, "gracefully shutdown")
+		}),
+	}, nil
+}
+
+// run accepts connections of resolvers until the context is done.
+func (r *receiver) run(ctx context.Context) error {
+	// сокет остаётся после предыдущего запуска, без удаления его не занять
+	if r.Dnstap.Network == "unix" {
+		if err := os.Remove(r.Dnstap.Address); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%s: could not remove socket: %w", dnstapName, err)
+		}
+	}
+
+	lis, err := new(net.ListenConfig).Listen(ctx, r.Dnstap.Network, r.Dnstap.Address)
+	if err != nil {
+		return fmt.Errorf("%s: could not prepare listener: %w", dnstapName, err)
+	}
+
+	context.AfterFunc(ctx, func() { _ = lis.Close() })
+
+	r.log.InfoContext(ctx, "listening",
+		logger.String("network", r.Dnstap.Network),
+		logger.String("address", r.Dnstap.Address))
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return fmt.Errorf("%s: could not accept connection: %w", dnstapName, err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			r.serve(ctx, conn)
+		}()
+	}
+}
+
+// serve reads frames of a single resolver connection.
+func (r *receiver) serve(ctx context.Context, conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	remote := conn.RemoteAddr().String()
+	reader, err := dnstap.NewReader(conn, &dnstap.ReaderOptions{Bidirectional: true, Timeout: r.Dnstap.Timeout})
+	if err != nil {
+		r.log.WarnContext(ctx, "could not open frame stream", logger.String("remote", remote), logger.Err(err))
+
+		return
+	}
+
+	r.log.InfoContext(ctx, "resolver connected", logger.String("remote", remote))
+
+	buf := make([]byte, dnstap.MaxPayloadSize)
+	for {
+		size, err := reader.ReadFrame(buf)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && ctx.Err() == nil {
+				r.log.WarnContext(ctx, "could not read frame", logger.String("remote", remote), logger.Err(err))
+			}
+
+			r.log.InfoContext(ctx, "resolver disconnected", logger.String("remote", remote))
+
+			return
+		}
+
+		r.frame(ctx, buf[:size])
+	}
+}
+
+// frame publishes addresses of the response carried by the frame, other messages are ignored.
+func (r *receiver) frame(ctx context.Context, buf []byte) {
+	var frame dnstap.Dnstap
+	if err := proto.Unmarshal(buf, &frame); err != nil {
+		r.log.DebugContext(ctx, "could not parse frame", logger.Err(err))
+
+		return
+	}
+
+	msg := frame.GetMessage()
+	if frame.GetType() != dnstap.Dnstap_MESSAGE || msg == nil {
+		return
+	}
+
+	if msg.GetType() != dnstap.Message_CLIENT_RESPONSE {
+		return
+	}
+
+	res := new(dns.Msg)
+	if err := res.Unpack(msg.GetResponseMessage()); err != nil {
+		r.log.DebugContext(ctx, "could not parse response", logger.Err(err))
+
+		return
+	}
+
+	// ответ клиенту резолвер уже проверил, именно эти адреса получили пользователи
+	chain, managed, covered := r.lookup(res)
+	if managed = append(managed, r.discover(ctx, covered)...); len(managed) > 0 {
+		r.publish(ctx, chain, managed, res)
+	}
+}
@@ -0,0 +1,107 @@
+package resolver
+
+import (
+	"context"
+	"maps"
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/im-kulikov/go-bones/logger"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/im-kulikov/resolvex/internal/storage"
+)
+
+func dnstapFrame(t *testing.T, kind dnstap.Message_Type, name string, lines ...string) []byte {
+	res := new(dns.Msg)
+	res.SetQuestion(name, dns.TypeA)
+	res.Response = true
+	res.Answer = parseRRs(t, lines...)
+
+	buf, err := res.Pack()
+	require.NoError(t, err)
+
+	frame, err := proto.Marshal(&dnstap.Dnstap{
+		Type:    dnstap.Dnstap_MESSAGE.Enum(),
+		Message: &dnstap.Message{Type: kind.Enum(), ResponseMessage: buf},
+	})
+	require.NoError(t, err)
+
+	return frame
+}
+
+func TestDnstap_Receive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	path := filepath.Join(t.TempDir(), "dnstap.sock")
+	cfg := Config{
+		Timeout:   time.Second,
+		Workers:   1,
+		MinTTL:    time.Minute,
+		MaxTTL:    time.Hour,
+		Dnstap:    DnstapConfig{Network: "unix", Address: path, Timeout: time.Second},
+		upstreams: []upstream{testUpstream{}},
+	}
+
+	store := &testStore{domains: []string{"www.example.com", "example.org"}}
+	svc, err := NewDnstap(cfg, log, store)
+	require.NoError(t, err)
+
+	done := make(chan error, 1)
+	go func() { done <- svc.Start(ctx) }()
+
+	var conn net.Conn
+	require.Eventually(t, func() bool {
+		conn, err = net.Dial("unix", path)
+
+		return err == nil
+	}, time.Second, time.Millisecond)
+
+	writer, err := dnstap.NewWriter(conn, &dnstap.WriterOptions{Bidirectional: true, Timeout: time.Second})
+	require.NoError(t, err)
+
+	for _, frame := range [][]byte{
+		// запрос клиента не содержит ответа
+		dnstapFrame(t, dnstap.Message_CLIENT_QUERY, "example.org.", "example.org. 60 IN A 10.0.0.9"),
+		// неуправляемый домен
+		dnstapFrame(t, dnstap.Message_CLIENT_RESPONSE, "google.com.", "google.com. 60 IN A 10.0.0.8"),
+		dnstapFrame(t, dnstap.Message_CLIENT_RESPONSE, "www.example.com.",
+			"www.example.com. 60 IN CNAME edge.cdn.net.",
+			"edge.cdn.net. 60 IN A 10.0.0.1"),
+		// ответ авторитетного сервера резолверу ещё не проверен и клиентам мог не достаться
+		dnstapFrame(t, dnstap.Message_RESOLVER_RESPONSE, "example.org.", "example.org. 60 IN A 10.0.0.2"),
+		dnstapFrame(t, dnstap.Message_CLIENT_RESPONSE, "example.org.", "example.org. 60 IN A 10.0.0.3"),
+	} {
+		_, err = writer.WriteFrame(frame)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, writer.Close())
+
+	published := func() []storage.PublishItem {
+		store.Lock()
+		defer store.Unlock()
+
+		return append([]storage.PublishItem(nil), store.published...)
+	}
+
+	require.Eventually(t, func() bool { return len(published()) == 2 }, time.Second, time.Millisecond)
+
+	items := published()
+	require.Equal(t, "www.example.com", items[0].Domain)
+	require.Contains(t, items[0].Record, "10.0.0.1")
+	require.Zero(t, items[0].Expire)
+	require.Equal(t, "example.org", items[1].Domain)
+	require.Equal(t, []string{"10.0.0.3"}, slices.Collect(maps.Keys(items[1].Record)))
+
+	cancel()
+	require.NoError(t, <-done)
+}
@@ -0,0 +1,267 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/im-kulikov/go-bones/logger"
+	"github.com/im-kulikov/go-bones/service"
+	"github.com/miekg/dns"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/im-kulikov/resolvex/internal/broadcast"
+	"github.com/im-kulikov/resolvex/internal/storage"
+)
+
+// ForwarderConfig describes the DNS forwarder, it is disabled when Address is empty.
+// Address is used by UDP and TCP listeners, Timeout limits forwarding of a single query.
+// RouteWait enables route-before-answer mode: the answer is held until all BGP peers were sent
+// new addresses of managed domains, but not longer than RouteWait, zero disables the mode.
+type ForwarderConfig struct {
+	Address   string        `env:"ADDRESS"`
+	Timeout   time.Duration `env:"TIMEOUT"    default:"5s"`
+	RouteWait time.Duration `env:"ROUTE_WAIT"`
+}
+
+const forwarderName = "dns-forwarder"
+
+// forwarder forwards client queries to servers and publishes addresses of managed domains from answers.
+type forwarder struct {
+	snooper
+
+	routes broadcast.Waiter
+}
+
+// NewForwarder creates a DNS server that forwards client queries to servers selected by the strategy.
+// Routes are used to hold answers in route-before-answer mode.
+func NewForwarder(
+	cfg Config,
+	log *logger.Logger,
+	store storage.DNS,
+	routes broadcast.Waiter,
+) (service.Service, error) {
+	out := logger.Named(log, forwarderName)
+
+	switch {
+	case cfg.Forwarder.Address == "":
+	case cfg.Forwarder.Timeout <= 0:
+		return nil, fmt.Errorf("%s: timeout should be positive", forwarderName)
+	case cfg.Forwarder.RouteWait < 0:
+		return nil, fmt.Errorf("%s: route wait should not be negative", forwarderName)
+	}
+
+	if cfg.Forwarder.Address != "" && cfg.pool == nil {
+		if err := cfg.prepare(); err != nil {
+			return nil, err
+		}
+	}
+
+	fwd := &forwarder{snooper: newSnooper(&cfg, out, store), routes: routes}
+
+	return optionalService{
+		enabled: cfg.Forwarder.Address != "",
+		Service: service.NewLauncher(forwarderName, fwd.run, func(ctx context.Context) {
+			out.InfoContext(ctx, "gracefully shutdown")
+		}),
+	}, nil
+}
+
+// run serves UDP and TCP listeners until the context is done.
+func (f *forwarder) run(top context.Context) error {
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) { f.serve(top, w, req) })
+
+	var run errgroup.Group
+	for _, network := range []string{"udp", "tcp"} {
+		srv := &dns.Server{Addr: f.Forwarder.Address, Net: network, Handler: handler}
+
+		run.Go(func() error {
+			if err := srv.ListenAndServe(); err != nil {
+				return fmt.Errorf("%s: could not serve %s: %w", forwarderName, network, err)
+			}
+
+			return nil
+		})
+
+		context.AfterFunc(top, func() { _ = srv.Shutdown() })
+	}
+
+	f.log.InfoContext(top, "listening", logger.String("address", f.Forwarder.Address))
+
+	return run.Wait()
+}
+
+// serve answers the client and then publishes addresses of the answer,
+// in route-before-answer mode addresses are published and delivered to peers first.
+func (f *forwarder) serve(top context.Context, w dns.ResponseWriter, req *dns.Msg) {
+	ctx, cancel := context.WithTimeout(top, f.Forwarder.Timeout)
+	defer cancel()
+
+	// клиент получает копию ответа, для проверки и адресов нужен ответ целиком, с подписями
+	var answer *dns.Msg
+	res, server, err := f.forward(ctx, req)
+	switch {
+	case err != nil:
+		if !isTimeout(err) && !errors.Is(err, ErrNoServers) {
+			f.log.ErrorContext(ctx, "could not forward query",
+				logger.String("client", w.RemoteAddr().String()),
+				logger.Err(err))
+		}
+
+		answer = new(dns.Msg)
+		answer.SetRcode(req, dns.RcodeServerFailure)
+	case f.validator != nil && !signed(req):
+		answer = stripDNSSEC(req, res)
+	default:
+		answer = res.Copy()
+	}
+
+	// ответ по UDP не должен превышать размер, который клиент готов принять
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil {
+			size = max(size, int(opt.UDPSize()))
+		}
+
+		answer.Truncate(size)
+	}
+
+	holding := f.Forwarder.RouteWait > 0 && server != nil
+	if holding {
+		f.hold(top, f.snoop(ctx, server, res))
+	}
+
+	if err = w.WriteMsg(answer); err != nil {
+		f.log.WarnContext(ctx, "could not write answer",
+			logger.String("client", w.RemoteAddr().String()),
+			logger.Err(err))
+	}
+
+	if !holding && server != nil {
+		f.snoop(ctx, server, res)
+	}
+}
+
+// hold waits until peers were sent the addresses, but not longer than RouteWait.
+func (f *forwarder) hold(top context.Context, addresses []string) {
+	if len(addresses) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(top, f.Forwarder.RouteWait)
+	defer cancel()
+
+	start := time.Now()
+	if err := f.routes.Wait(ctx, addresses...); err != nil {
+		// клиент получает ответ в любом случае, маршрут догонит его позже
+		f.log.WarnContext(top, "routes were not delivered in time, answer is released",
+			logger.Any("addresses", addresses),
+			logger.Duration("delay", time.Since(start)),
+			logger.Err(err))
+
+		return
+	}
+
+	f.log.DebugContext(top, "routes delivered, answer is released",
+		logger.Any("addresses", addresses),
+		logger.Duration("delay", time.Since(start)))
+}
+
+// forward sends the query to servers selected by the strategy one by one until one of them answers.
+func (f *forwarder) forward(ctx context.Context, req *dns.Msg) (*dns.Msg, *member, error) {
+	query := req.Copy()
+
+	// для проверки подписей нужны RRSIG, даже если клиент о них не просил
+	if f.validator != nil && !signed(req) {
+		if opt := query.IsEdns0(); opt != nil {
+			opt.SetDo()
+		} else {
+			query.SetEdns0(4096, true)
+		}
+	}
+
+	err := error(ErrNoServers)
+	servers := f.pool.pick(time.Now())
+	for i, server := range servers {
+		var res *dns.Msg
+		if res, err = server.exchange(ctx, f.log, f.Health, query); err != nil {
+			continue
+		}
+
+		// остальные серверы не спрашивали, их пробы освобождаются
+		for _, rest := range servers[i+1:] {
+			rest.release()
+		}
+
+		res.Id = req.Id
+
+		return res, server, nil
+	}
+
+	return nil, nil, err
+}
+
+// signed reports whether the client asked for DNSSEC records.
+func signed(req *dns.Msg) bool {
+	opt := req.IsEdns0()
+
+	return opt != nil && opt.Do()
+}
+
+// stripDNSSEC returns the copy of the answer without DNSSEC records the client did not ask for.
+func stripDNSSEC(req, res *dns.Msg) *dns.Msg {
+	out := res.Copy()
+
+	var qtype uint16
+	if len(req.Question) > 0 {
+		qtype = req.Question[0].Qtype
+	}
+
+	strip := func(list []dns.RR) []dns.RR {
+		return slices.DeleteFunc(list, func(rr dns.RR) bool {
+			switch rr.Header().Rrtype {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				return qtype != rr.Header().Rrtype
+			default:
+				return false
+			}
+		})
+	}
+
+	out.Answer, out.Ns, out.Extra = strip(out.Answer), strip(out.Ns), strip(out.Extra)
+	if req.IsEdns0() == nil {
+		out.Extra = slices.DeleteFunc(out.Extra, func(rr dns.RR) bool { return rr.Header().Rrtype == dns.TypeOPT })
+	} else if opt := out.IsEdns0(); opt != nil {
+		opt.SetDo(false)
+	}
+
+	return out
+}
+
+// snoop publishes addresses of the answer for managed domains and returns them,
+// routes exist as soon as the client gets the answer.
+func (f *forwarder) snoop(ctx context.Context, server *member, res *dns.Msg) []string {
+	chain, managed, covered := f.lookup(res)
+	if len(managed) == 0 && len(covered) == 0 {
+		return nil
+	}
+
+	if f.validator != nil {
+		if _, err := f.validator.verify(ctx, f.queryOf(f.log, server), chain[0], res); err != nil {
+			f.log.WarnContext(ctx, "forwarded answer is bogus, addresses are not published",
+				logger.String("domain", chain[0]),
+				logger.String("server", server.String()),
+				logger.Err(err))
+
+			return nil
+		}
+	}
+
+	// поддомены добавляются только после проверки, поддельный ответ не создаёт доменов
+	managed = append(managed, f.discover(ctx, covered)...)
+
+	return f.publish(ctx, chain, managed, res)
+}
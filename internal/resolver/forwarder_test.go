@@ -0,0 +1,228 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/im-kulikov/go-bones/logger"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+type cnameUpstream []string
+
+func (u cnameUpstream) Exchange(_ context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	res := new(dns.Msg)
+	res.SetReply(msg)
+	res.Id = 0
+
+	for _, line := range u {
+		rr, err := dns.NewRR(line)
+		if err != nil {
+			return nil, err
+		}
+
+		res.Answer = append(res.Answer, rr)
+	}
+
+	return res, nil
+}
+
+func (u cnameUpstream) String() string { return "cname" }
+
+type testWriter struct {
+	dns.ResponseWriter
+
+	written *dns.Msg
+}
+
+func (w *testWriter) RemoteAddr() net.Addr { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+
+func (w *testWriter) WriteMsg(msg *dns.Msg) error {
+	w.written = msg
+
+	return nil
+}
+
+func TestForwarder_Serve(t *testing.T) {
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	cfg := Config{
+		Timeout:   time.Second,
+		Workers:   1,
+		MinTTL:    time.Minute,
+		MaxTTL:    time.Hour,
+		Health:    HealthConfig{Failures: 3, Cooldown: time.Minute},
+		Forwarder: ForwarderConfig{Address: "127.0.0.1:0", Timeout: time.Second},
+		upstreams: []upstream{cnameUpstream{
+			"www.example.com. 60 IN CNAME edge.cdn.net.",
+			"edge.cdn.net. 300 IN A 10.0.0.1",
+		}},
+	}
+
+	require.NoError(t, cfg.prepare())
+
+	store := &testStore{domains: []string{"www.example.com", "edge.cdn.net"}}
+	fwd := &forwarder{snooper: snooper{Config: &cfg, log: log, store: store}}
+
+	req := new(dns.Msg)
+	req.SetQuestion("WWW.example.com.", dns.TypeA)
+
+	out := new(testWriter)
+	start := time.Now()
+	fwd.serve(context.Background(), out, req)
+
+	// клиент получает ответ со своим ID
+	require.NotNil(t, out.written)
+	require.Equal(t, req.Id, out.written.Id)
+	require.Len(t, out.written.Answer, 2)
+
+	// адреса цепочки принадлежат обоим доменам, расписание не меняется
+	require.Len(t, store.published, 2)
+	for _, item := range store.published {
+		require.Contains(t, []string{"www.example.com", "edge.cdn.net"}, item.Domain)
+		require.Zero(t, item.Expire)
+		require.Len(t, item.Record, 1)
+		require.WithinDuration(t, start.Add(10*time.Minute), item.Record["10.0.0.1"], time.Second)
+	}
+
+	// домен не отслеживается, адреса не публикуются
+	store.published = nil
+	store.domains = []string{"example.org"}
+	fwd.serve(context.Background(), out, req)
+	require.Empty(t, store.published)
+
+	// серверы недоступны, клиент получает SERVFAIL
+	cfg.pool.members[0].trip(time.Now())
+	fwd.serve(context.Background(), out, req)
+	require.Equal(t, dns.RcodeServerFailure, out.written.Rcode)
+	require.Equal(t, req.Id, out.written.Id)
+}
+
+func TestForwarder_Discovery(t *testing.T) {
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	server, anchor := signedZones(t)
+
+	cfg := Config{
+		Timeout:   time.Second,
+		Workers:   1,
+		MinTTL:    time.Minute,
+		MaxTTL:    time.Hour,
+		DNSSEC:    DNSSECConfig{Validate: true, TrustAnchors: []string{anchor}},
+		Forwarder: ForwarderConfig{Address: "127.0.0.1:0", Timeout: time.Second},
+		upstreams: []upstream{server},
+	}
+	require.NoError(t, cfg.prepare())
+
+	store := &testStore{wildcards: []string{"*.example.com"}}
+	fwd := &forwarder{snooper: newSnooper(&cfg, log, store)}
+	fwd.discovery = rate.NewLimiter(0, 1)
+
+	query := func(name string) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		fwd.serve(context.Background(), new(testWriter), req)
+	}
+
+	// поддельный ответ не создаёт поддомен
+	query("stripped.example.com.")
+	require.Empty(t, store.domains)
+	require.Empty(t, store.published)
+
+	query("www.example.com.")
+	require.Equal(t, []string{"www.example.com"}, store.domains)
+	require.Len(t, store.published, 1)
+
+	// лимит исчерпан, новые имена клиентов не добавляются
+	store.domains, store.published = nil, nil
+	query("www.example.com.")
+	require.Empty(t, store.domains)
+	require.Empty(t, store.published)
+}
+
+type testRoutes struct {
+	out   *testWriter
+	delay time.Duration
+	items []string
+}
+
+func (r *testRoutes) Wait(ctx context.Context, items ...string) error {
+	// ответ не должен уйти клиенту раньше маршрутов
+	if r.out.written != nil {
+		return errors.New("answer was written before routes")
+	}
+
+	r.items = append(r.items, items...)
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(r.delay):
+		return nil
+	}
+}
+
+func TestForwarder_RouteWait(t *testing.T) {
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	cfg := Config{
+		Timeout:   time.Second,
+		Workers:   1,
+		MinTTL:    time.Minute,
+		MaxTTL:    time.Hour,
+		Forwarder: ForwarderConfig{Address: "127.0.0.1:0", Timeout: time.Second, RouteWait: 50 * time.Millisecond},
+		upstreams: []upstream{cnameUpstream{
+			"example.com. 60 IN A 10.0.0.1",
+			"example.com. 60 IN A 10.0.0.2",
+		}},
+	}
+
+	require.NoError(t, cfg.prepare())
+
+	out := new(testWriter)
+	routes := &testRoutes{out: out}
+	store := &testStore{domains: []string{"example.com"}}
+	fwd := &forwarder{snooper: snooper{Config: &cfg, log: log, store: store}, routes: routes}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	fwd.serve(context.Background(), out, req)
+	require.NotNil(t, out.written)
+	require.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, routes.items)
+	require.Len(t, store.published, 1)
+
+	// маршруты не доставлены вовремя, ответ отпускается по истечении ожидания
+	out.written, routes.items, routes.delay = nil, nil, time.Hour
+
+	start := time.Now()
+	fwd.serve(context.Background(), out, req)
+	require.NotNil(t, out.written)
+	require.Len(t, out.written.Answer, 2)
+	require.Less(t, time.Since(start), time.Second)
+
+	// неуправляемый домен не ждёт маршрутов
+	out.written, routes.items, store.domains = nil, nil, nil
+	fwd.serve(context.Background(), out, req)
+	require.NotNil(t, out.written)
+	require.Empty(t, routes.items)
+}
+
+func TestStripDNSSEC(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	res := new(dns.Msg)
+	res.SetReply(req)
+	res.SetEdns0(4096, true)
+	res.Answer = parseRRs(t,
+		"example.com. 60 IN A 10.0.0.1",
+		"example.com. 60 IN RRSIG A 13 2 60 20300101000000 20200101000000 1 example.com. AAAA")
+
+	out := stripDNSSEC(req, res)
+	require.Len(t, out.Answer, 1)
+	require.Nil(t, out.IsEdns0())
+	require.Len(t, res.Answer, 2)
+}
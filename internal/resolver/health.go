@@ -0,0 +1,343 @@
+package resolver
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/im-kulikov/go-bones/logger"
+	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
+)
+
+// HealthConfig describes the circuit breaker of every server: Failures consecutive failed queries
+// open the circuit, the server is skipped for Cooldown and then a single probe decides whether to close it.
+type HealthConfig struct {
+	Failures int           `env:"FAILURES" default:"3"`
+	Cooldown time.Duration `env:"COOLDOWN" default:"30s"`
+}
+
+const (
+	// strategyAll sends every domain to all servers.
+	strategyAll = "all"
+	// strategyFastest sends every domain to N servers with the lowest latency, e.g. `fastest:2`.
+	strategyFastest = "fastest"
+	// strategyRoundRobin sends every domain to a single server in turn.
+	strategyRoundRobin = "round-robin"
+	// strategyPrimary sends every domain to the first available server in the configured order.
+	strategyPrimary = "primary"
+
+	// defaultFastest is the number of servers used by `fastest` strategy without explicit number.
+	defaultFastest = 2
+	// healthWeight is the weight of the last query in moving averages of latency and error rate.
+	healthWeight = 0.2
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// healthStats describes queries to a server.
+type healthStats struct {
+	latency  time.Duration // moving average of successful queries
+	errRate  float64       // moving average of failed queries
+	queries  uint64
+	errors   uint64
+	timeouts uint64
+}
+
+// health keeps statistics and the circuit state of a server.
+type health struct {
+	sync.Mutex
+	healthStats
+
+	failures int // consecutive failures
+	state    circuitState
+	since    time.Time // when the circuit was opened
+	probing  bool
+}
+
+// member is a server of the pool with its rate limit and health.
+type member struct {
+	upstream
+
+	limit   *rate.Limiter // nil means no limit
+	health  health
+	trusted bool // answers of encrypted servers could not be spoofed on the way
+}
+
+// available reports whether the server could be queried: the circuit is closed
+// or the cooldown passed and nobody probes the server yet.
+func (m *member) available(cfg HealthConfig, now time.Time) bool {
+	m.health.Lock()
+	defer m.health.Unlock()
+
+	switch m.health.state {
+	case circuitOpen:
+		return now.Sub(m.health.since) >= cfg.Cooldown
+	case circuitHalfOpen:
+		return !m.health.probing
+	default:
+		return true
+	}
+}
+
+// acquire returns false when the server became unavailable, the first query after the cooldown becomes a probe.
+func (m *member) acquire(cfg HealthConfig, now time.Time) bool {
+	m.health.Lock()
+	defer m.health.Unlock()
+
+	switch m.health.state {
+	case circuitOpen:
+		if now.Sub(m.health.since) < cfg.Cooldown {
+			return false
+		}
+
+		m.health.state, m.health.probing = circuitHalfOpen, true
+	case circuitHalfOpen:
+		if m.health.probing {
+			return false
+		}
+
+		m.health.probing = true
+	}
+
+	return true
+}
+
+// observe updates statistics by the result of the query and returns the circuit state when it changes.
+func (m *member) observe(cfg HealthConfig, latency time.Duration, err error, now time.Time) (circuitState, bool) {
+	m.health.Lock()
+	defer m.health.Unlock()
+
+	h := &m.health
+	h.queries++
+
+	failed := 0.0
+	if err != nil {
+		failed, h.errors = 1, h.errors+1
+		if isTimeout(err) {
+			h.timeouts++
+		}
+	} else if h.latency == 0 {
+		h.latency = latency
+	} else {
+		h.latency += time.Duration(healthWeight * float64(latency-h.latency))
+	}
+
+	h.errRate += healthWeight * (failed - h.errRate)
+
+	before := h.state
+	switch {
+	case err == nil:
+		h.failures, h.state, h.probing = 0, circuitClosed, false
+	case h.state == circuitHalfOpen:
+		// проба не прошла, ждём ещё один период
+		h.state, h.since, h.probing = circuitOpen, now, false
+	default:
+		if h.failures++; cfg.Failures > 0 && h.failures >= cfg.Failures {
+			h.state, h.since = circuitOpen, now
+		}
+	}
+
+	return h.state, before != h.state
+}
+
+// release frees the probe of the server when the query was not sent.
+func (m *member) release() {
+	m.health.Lock()
+	defer m.health.Unlock()
+
+	m.health.probing = false
+}
+
+// trip opens the circuit of the server right away.
+func (m *member) trip(now time.Time) {
+	m.health.Lock()
+	defer m.health.Unlock()
+
+	m.health.state, m.health.since, m.health.probing = circuitOpen, now, false
+}
+
+func (m *member) stats() healthStats {
+	m.health.Lock()
+	defer m.health.Unlock()
+
+	return m.health.healthStats
+}
+
+// exchange waits for the rate limit, sends the query and tracks the health of the server.
+func (m *member) exchange(ctx context.Context, log *logger.Logger, cfg HealthConfig, msg *dns.Msg) (*dns.Msg, error) {
+	if m.limit != nil {
+		if err := m.limit.Wait(ctx); err != nil {
+			m.release()
+
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			// запрос не успеет уйти до истечения таймаута, считаем это таймаутом
+			return nil, fmt.Errorf("rate limit of server exceeded: %w", context.DeadlineExceeded)
+		}
+	}
+
+	start := time.Now()
+	res, err := m.Exchange(ctx, msg)
+
+	// остановка сервиса не говорит ничего о здоровье сервера
+	if errors.Is(err, context.Canceled) {
+		m.release()
+
+		return nil, err
+	}
+
+	if state, changed := m.observe(cfg, time.Since(start), err, time.Now()); changed {
+		stats := m.stats()
+		attrs := []any{
+			logger.String("server", m.String()),
+			logger.String("circuit", state.String()),
+			logger.Duration("latency", stats.latency),
+			logger.Float64("error_rate", stats.errRate),
+			logger.Uint64("queries", stats.queries),
+			logger.Uint64("errors", stats.errors),
+			logger.Uint64("timeouts", stats.timeouts),
+		}
+
+		if state == circuitOpen {
+			log.WarnContext(ctx, "dns server is unhealthy", attrs...)
+		} else {
+			log.InfoContext(ctx, "dns server is healthy again", attrs...)
+		}
+	}
+
+	return res, err
+}
+
+// pool selects servers for every domain by the strategy, servers with open circuit are skipped.
+type pool struct {
+	HealthConfig
+
+	members  []*member
+	strategy string
+	fastest  int
+	next     atomic.Uint64
+}
+
+// newPool wraps upstreams by rate limits and health tracking, Strategy is `all`, `fastest:N`,
+// `round-robin` or `primary`.
+func (c *Config) newPool(list []upstream) (*pool, error) {
+	out := &pool{HealthConfig: c.Health, strategy: strategyAll}
+
+	if c.Strategy != "" {
+		name, count, found := strings.Cut(strings.ToLower(strings.TrimSpace(c.Strategy)), ":")
+		switch out.strategy = name; {
+		case name == strategyFastest && !found:
+			out.fastest = defaultFastest
+		case name == strategyFastest:
+			num, err := strconv.Atoi(count)
+			if err != nil || num <= 0 {
+				return nil, fmt.Errorf("could not parse strategy %q: expected fastest:N", c.Strategy)
+			}
+
+			out.fastest = num
+		case found || !slices.Contains([]string{strategyAll, strategyRoundRobin, strategyPrimary}, name):
+			return nil, fmt.Errorf("unsupported strategy %q: expected all, fastest:N, round-robin or primary", c.Strategy)
+		}
+	}
+
+	for _, item := range list {
+		server := &member{upstream: item}
+		switch item.(type) {
+		case *dohUpstream, *dotUpstream:
+			server.trusted = true
+		}
+
+		if c.RateLimit > 0 {
+			server.limit = rate.NewLimiter(rate.Limit(c.RateLimit), max(1, int(c.RateLimit)))
+		}
+
+		out.members = append(out.members, server)
+	}
+
+	return out, nil
+}
+
+// width returns the number of servers queried for every domain when all of them are available.
+func (p *pool) width() int {
+	switch p.strategy {
+	case strategyRoundRobin, strategyPrimary:
+		return min(1, len(p.members))
+	case strategyFastest:
+		return min(p.fastest, len(p.members))
+	default:
+		return len(p.members)
+	}
+}
+
+// pick returns servers to resolve a domain, the result is empty when all servers are unavailable.
+func (p *pool) pick(now time.Time) []*member {
+	var candidates []*member
+	switch p.strategy {
+	case strategyRoundRobin:
+		start := int(p.next.Add(1) - 1) // nolint:gosec
+		for i := range p.members {
+			if item := p.members[(start+i)%len(p.members)]; item.available(p.HealthConfig, now) {
+				candidates = append(candidates, item)
+			}
+		}
+	default:
+		for _, item := range p.members {
+			if item.available(p.HealthConfig, now) {
+				candidates = append(candidates, item)
+			}
+		}
+	}
+
+	limit := len(candidates)
+	switch p.strategy {
+	case strategyRoundRobin, strategyPrimary:
+		limit = 1
+	case strategyFastest:
+		// серверы без статистики идут первыми, чтобы измерить их задержку
+		slices.SortStableFunc(candidates, func(a, b *member) int {
+			return cmp.Compare(a.stats().latency, b.stats().latency)
+		})
+
+		limit = p.fastest
+	}
+
+	out := make([]*member, 0, min(limit, len(candidates)))
+	for _, item := range candidates {
+		if len(out) >= limit {
+			break
+		}
+
+		if item.acquire(p.HealthConfig, now) {
+			out = append(out, item)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,151 @@
+package resolver
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/im-kulikov/go-bones/logger"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+type namedUpstream struct {
+	name string
+	fail bool
+}
+
+func (u *namedUpstream) Exchange(_ context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if u.fail {
+		return nil, os.ErrDeadlineExceeded
+	}
+
+	res := new(dns.Msg)
+	res.SetReply(msg)
+
+	return res, nil
+}
+
+func (u *namedUpstream) String() string { return u.name }
+
+func names(list []*member) []string {
+	out := make([]string, 0, len(list))
+	for _, item := range list {
+		out = append(out, item.String())
+	}
+
+	return out
+}
+
+func TestPool_Circuit(t *testing.T) {
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	server := &namedUpstream{name: "a", fail: true}
+	cfg := Config{Health: HealthConfig{Failures: 2, Cooldown: time.Minute}}
+
+	list, err := cfg.newPool([]upstream{server})
+	require.NoError(t, err)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+
+	item, now := list.members[0], time.Now()
+	for range 2 {
+		require.Equal(t, []string{"a"}, names(list.pick(now)))
+
+		_, err = item.exchange(context.Background(), log, cfg.Health, msg)
+		require.Error(t, err)
+	}
+
+	// цепь разомкнута, до окончания паузы сервер не используется
+	require.Empty(t, list.pick(now))
+	require.Equal(t, circuitOpen, item.health.state)
+	require.Equal(t, uint64(2), item.stats().timeouts)
+
+	// после паузы запрос становится пробой, вторая проба одновременно не допускается
+	later := time.Now().Add(time.Minute)
+	require.Equal(t, []string{"a"}, names(list.pick(later)))
+	require.Empty(t, list.pick(later))
+
+	_, err = item.exchange(context.Background(), log, cfg.Health, msg)
+	require.Error(t, err)
+	require.Equal(t, circuitOpen, item.health.state)
+
+	item.health.since = time.Now().Add(-time.Minute)
+	require.Equal(t, []string{"a"}, names(list.pick(time.Now())))
+
+	server.fail = false
+	_, err = item.exchange(context.Background(), log, cfg.Health, msg)
+	require.NoError(t, err)
+	require.Equal(t, circuitClosed, item.health.state)
+	require.Positive(t, item.stats().latency)
+}
+
+func TestPool_Strategy(t *testing.T) {
+	servers := []upstream{&namedUpstream{name: "a"}, &namedUpstream{name: "b"}, &namedUpstream{name: "c"}}
+	health := HealthConfig{Failures: 3, Cooldown: time.Minute}
+	now := time.Now()
+
+	for _, wrong := range []string{"random", "fastest:0", "fastest:x", "all:2"} {
+		_, err := (&Config{Strategy: wrong}).newPool(servers)
+		require.Error(t, err, wrong)
+	}
+
+	list, err := (&Config{Strategy: "all", Health: health}).newPool(servers)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b", "c"}, names(list.pick(now)))
+
+	list, err = (&Config{Strategy: "primary", Health: health}).newPool(servers)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, names(list.pick(now)))
+
+	// основной сервер недоступен, используется следующий
+	list.members[0].trip(now)
+	require.Equal(t, []string{"b"}, names(list.pick(now)))
+
+	list, err = (&Config{Strategy: "round-robin", Health: health}).newPool(servers)
+	require.NoError(t, err)
+	list.members[1].trip(now)
+	require.Equal(t, []string{"a"}, names(list.pick(now)))
+	require.Equal(t, []string{"c"}, names(list.pick(now)))
+	require.Equal(t, []string{"c"}, names(list.pick(now)))
+	require.Equal(t, []string{"a"}, names(list.pick(now)))
+
+	list, err = (&Config{Strategy: "fastest", Health: health}).newPool(servers)
+	require.NoError(t, err)
+	list.members[0].health.latency = 30 * time.Millisecond
+	list.members[1].health.latency = 10 * time.Millisecond
+	list.members[2].health.latency = 20 * time.Millisecond
+	require.Equal(t, []string{"b", "c"}, names(list.pick(now)))
+
+	list.fastest = 1
+	list.members[1].trip(now)
+	require.Equal(t, []string{"c"}, names(list.pick(now)))
+}
+
+func TestConfig_ValidateDegraded(t *testing.T) {
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	cfg := Config{
+		Servers:   []string{"a", "b"},
+		Timeout:   time.Second,
+		Workers:   1,
+		Health:    HealthConfig{Failures: 3, Cooldown: time.Minute},
+		upstreams: []upstream{&namedUpstream{name: "a", fail: true}, &namedUpstream{name: "b"}},
+	}
+
+	// недоступный сервер не останавливает запуск
+	require.NoError(t, cfg.Validate(context.Background(), log))
+	require.Equal(t, circuitOpen, cfg.pool.members[0].health.state)
+	require.Equal(t, []string{"b"}, names(cfg.pool.pick(time.Now())))
+
+	item, _ := cfg.resolve(context.Background(), log, "example.com")
+	require.False(t, item.Failed())
+
+	// все серверы недоступны: запуск продолжается, домены получают ошибку
+	cfg.upstreams[1].(*namedUpstream).fail = true
+	require.NoError(t, cfg.Validate(context.Background(), log))
+
+	item, _ = cfg.resolve(context.Background(), log, "example.com")
+	require.True(t, item.Failed())
+	require.Equal(t, string(ErrNoServers), item.Error)
+}
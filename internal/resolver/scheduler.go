@@ -0,0 +1,276 @@
+package resolver
+
+import (
+	"container/heap"
+	"context"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/im-kulikov/go-bones/logger"
+
+	"github.com/im-kulikov/resolvex/internal/storage"
+)
+
+const (
+	// publishInterval defines how often resolved domains are published into the store.
+	publishInterval = time.Second
+	// publishBatch publishes resolved domains before the interval when there are enough of them.
+	publishBatch = 256
+	// idleWait is used when there is nothing to dispatch, any event wakes the scheduler up earlier.
+	idleWait = time.Hour
+)
+
+// entry is a domain waiting for refresh.
+type entry struct {
+	domain string
+	expire time.Time // refresh time reported by the store
+	due    time.Time // refresh time with jitter
+	index  int
+}
+
+// queue is a min-heap of domains ordered by refresh time.
+type queue []*entry
+
+func (q queue) Len() int { return len(q) }
+
+func (q queue) Less(i, j int) bool { return q[i].due.Before(q[j].due) }
+
+func (q queue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index, q[j].index = i, j
+}
+
+func (q *queue) Push(x any) {
+	item := x.(*entry) // nolint:forcetypeassert
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *queue) Pop() any {
+	old := *q
+	last := len(old) - 1
+	item := old[last]
+	old[last] = nil
+	*q = old[:last]
+
+	return item
+}
+
+type resolved struct {
+	domain string
+	item   storage.PublishItem
+	names  []string
+}
+
+// scheduler refreshes domains when their TTL expires, domains are resolved by a bounded number of workers.
+// It must be used from a single goroutine, only workers run concurrently.
+type scheduler struct {
+	*Config
+
+	log   *logger.Logger
+	store storage.DNS
+
+	queue   queue
+	entries map[string]*entry // domain => queued entry
+	running map[string]bool   // domain => removed while it was resolved
+
+	pending  []storage.PublishItem
+	observed map[string]struct{}
+}
+
+func (c *Config) newScheduler(log *logger.Logger, store storage.DNS) *scheduler {
+	return &scheduler{
+		Config:   c,
+		log:      log,
+		store:    store,
+		entries:  make(map[string]*entry),
+		running:  make(map[string]bool),
+		observed: make(map[string]struct{}),
+	}
+}
+
+// due returns refresh time of the domain with random jitter, expired domains are refreshed right away.
+func (s *scheduler) due(expire, now time.Time) time.Time {
+	when := expire
+	if when.Before(now) {
+		when = now
+	}
+
+	if s.Jitter > 0 {
+		when = when.Add(rand.N(s.Jitter)) // nolint:gosec
+	}
+
+	return when
+}
+
+// plan schedules refresh of the domain, domains being resolved are scheduled when they are done.
+func (s *scheduler) plan(name string, expire, now time.Time) {
+	if _, ok := s.running[name]; ok {
+		s.running[name] = false
+
+		return
+	}
+
+	if item, ok := s.entries[name]; ok {
+		// повторное уведомление с тем же временем не должно сдвигать домен в очереди
+		if item.expire.Equal(expire) {
+			return
+		}
+
+		item.expire, item.due = expire, s.due(expire, now)
+		heap.Fix(&s.queue, item.index)
+
+		return
+	}
+
+	item := &entry{domain: name, expire: expire, due: s.due(expire, now)}
+	s.entries[name] = item
+	heap.Push(&s.queue, item)
+}
+
+// drop removes the domain from the schedule, results of the domain being resolved are discarded.
+func (s *scheduler) drop(name string) {
+	if _, ok := s.running[name]; ok {
+		s.running[name] = true
+	}
+
+	if item, ok := s.entries[name]; ok {
+		heap.Remove(&s.queue, item.index)
+		delete(s.entries, name)
+	}
+}
+
+func (s *scheduler) apply(list []storage.Schedule, now time.Time) {
+	for _, item := range list {
+		if item.Removed {
+			s.drop(item.Domain)
+
+			continue
+		}
+
+		s.plan(item.Domain, item.Expire, now)
+	}
+}
+
+// dispatch sends due domains to idle workers and returns the number of busy workers.
+func (s *scheduler) dispatch(jobs chan<- string, busy int, now time.Time) int {
+	for busy < s.Workers && len(s.queue) > 0 && !s.queue[0].due.After(now) {
+		item := heap.Pop(&s.queue).(*entry) // nolint:forcetypeassert
+		delete(s.entries, item.domain)
+
+		s.running[item.domain] = false
+		jobs <- item.domain
+		busy++
+	}
+
+	return busy
+}
+
+// wait returns how long to sleep until the next domain should be dispatched.
+func (s *scheduler) wait(busy int, now time.Time) time.Duration {
+	if busy >= s.Workers || len(s.queue) == 0 {
+		return idleWait
+	}
+
+	return max(s.queue[0].due.Sub(now), 0)
+}
+
+// finish collects the result to publish and schedules the next refresh of the domain.
+func (s *scheduler) finish(res resolved, now time.Time) {
+	removed := s.running[res.domain]
+	delete(s.running, res.domain)
+
+	// домен удалили, пока он резолвился, публикация создала бы его заново
+	if removed {
+		return
+	}
+
+	s.pending = append(s.pending, res.item)
+	for _, name := range res.names {
+		s.observed[name] = struct{}{}
+	}
+
+	s.plan(res.domain, res.item.Expire, now)
+}
+
+// publish sends collected results into the store.
+func (s *scheduler) publish() {
+	if len(s.pending) == 0 {
+		return
+	}
+
+	s.log.Debug("publish resolved domains", logger.Int("domains", len(s.pending)))
+
+	s.store.Publish(s.pending)
+
+	// поддомены, подходящие под wildcard, попадут в расписание через уведомление об изменениях
+	s.store.Observe(slices.Collect(maps.Keys(s.observed))...)
+
+	s.pending, s.observed = nil, make(map[string]struct{})
+}
+
+// run resolves domains until the context is done.
+func (s *scheduler) run(ctx context.Context) {
+	s.apply(s.store.Schedules(), time.Now())
+
+	s.log.InfoContext(ctx, "scheduler started",
+		logger.Int("domains", len(s.queue)),
+		logger.Int("workers", s.Workers))
+
+	var wg sync.WaitGroup
+
+	// каждый воркер отдаёт не больше одного результата до следующего задания, поэтому done не блокируется
+	jobs := make(chan string)
+	done := make(chan resolved, s.Workers)
+	for range s.Workers {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for name := range jobs {
+				item, names := s.resolve(ctx, s.log, name)
+				done <- resolved{domain: name, item: item, names: names}
+			}
+		}()
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	flush := time.NewTicker(publishInterval)
+	defer flush.Stop()
+
+	for busy := 0; ; {
+		select {
+		case <-ctx.Done():
+			s.log.InfoContext(ctx, "try gracefully shutdown")
+
+			// результаты прерванных запросов не публикуем, домены обновятся после перезапуска
+			s.publish()
+			close(jobs)
+			wg.Wait()
+
+			return
+		case <-s.store.Changes():
+			s.apply(s.store.PopChanges(), time.Now())
+		case res := <-done:
+			busy--
+			s.finish(res, time.Now())
+
+			if len(s.pending) >= publishBatch {
+				s.publish()
+			}
+		case <-flush.C:
+			s.publish()
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		busy = s.dispatch(jobs, busy, now)
+		timer.Reset(s.wait(busy, now))
+	}
+}
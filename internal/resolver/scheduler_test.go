@@ -0,0 +1,150 @@
+package resolver
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/im-kulikov/go-bones/logger"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+
+	"github.com/im-kulikov/resolvex/internal/storage"
+)
+
+func TestScheduler_Queue(t *testing.T) {
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	cfg := Config{Workers: 1}
+	now := time.Now()
+
+	sch := cfg.newScheduler(log, &testStore{})
+	sch.plan("c.com", now.Add(3*time.Minute), now)
+	sch.plan("a.com", now.Add(time.Minute), now)
+	sch.plan("b.com", now.Add(2*time.Minute), now)
+	sch.plan("d.com", time.Time{}, now)
+
+	// новое время обновления меняет порядок, удалённый домен пропадает из очереди
+	sch.plan("c.com", now.Add(30*time.Second), now)
+	sch.apply([]storage.Schedule{{Domain: "b.com", Removed: true}}, now)
+
+	jobs := make(chan string, 4)
+	require.Equal(t, 1, sch.dispatch(jobs, 0, now))
+	require.Equal(t, "d.com", <-jobs)
+
+	// все воркеры заняты, ждём завершения
+	require.Equal(t, idleWait, sch.wait(1, now))
+	require.Equal(t, 30*time.Second, sch.wait(0, now))
+
+	require.Equal(t, 1, sch.dispatch(jobs, 0, now.Add(time.Hour)))
+	require.Equal(t, "c.com", <-jobs)
+	require.Equal(t, 1, sch.dispatch(jobs, 0, now.Add(time.Hour)))
+	require.Equal(t, "a.com", <-jobs)
+	require.Equal(t, idleWait, sch.wait(0, now))
+
+	// домен удалили, пока он резолвился: результат не публикуется и домен не возвращается в очередь
+	sch.drop("d.com")
+	sch.finish(resolved{domain: "d.com", item: storage.PublishItem{Domain: "d.com"}}, now)
+	sch.finish(resolved{domain: "c.com", item: storage.PublishItem{Domain: "c.com", Expire: now.Add(time.Minute)}}, now)
+	require.Len(t, sch.pending, 1)
+	require.Equal(t, "c.com", sch.pending[0].Domain)
+	require.Len(t, sch.queue, 1)
+	require.Equal(t, "c.com", sch.queue[0].domain)
+}
+
+func TestScheduler_Run(t *testing.T) {
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+
+	var (
+		lock                sync.Mutex
+		active, peak, total int
+	)
+
+	cfg := Config{
+		Timeout: time.Second,
+		Workers: 2,
+		MaxTTL:  time.Hour,
+		upstreams: []upstream{funcUpstream(func(msg *dns.Msg) (*dns.Msg, error) {
+			lock.Lock()
+			active, total = active+1, total+1
+			peak = max(peak, active)
+			lock.Unlock()
+
+			defer func() {
+				lock.Lock()
+				active--
+				lock.Unlock()
+			}()
+
+			time.Sleep(10 * time.Millisecond)
+
+			rr, err := dns.NewRR(msg.Question[0].Name + " 1 IN A 10.0.0.1")
+			require.NoError(t, err)
+
+			res := new(dns.Msg)
+			res.SetReply(msg)
+
+			if msg.Question[0].Qtype == dns.TypeA {
+				res.Answer = append(res.Answer, rr)
+			}
+
+			return res, nil
+		})},
+	}
+
+	require.NoError(t, cfg.prepare())
+
+	store := &testStore{
+		domains: []string{"a.com", "b.com", "c.com", "d.com", "e.com"},
+		changes: make(chan struct{}, 1),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		cfg.newScheduler(log, store).run(ctx)
+	}()
+
+	// домен, добавленный после старта, попадает в расписание через уведомление
+	store.Lock()
+	store.changed = append(store.changed, storage.Schedule{Domain: "f.com"})
+	store.Unlock()
+	store.changes <- struct{}{}
+
+	resolvedTimes := func() map[string]int {
+		store.Lock()
+		defer store.Unlock()
+
+		out := make(map[string]int)
+		for _, item := range store.published {
+			out[item.Domain]++
+		}
+
+		return out
+	}
+
+	// TTL ответа 1s, поэтому каждый домен обновляется повторно
+	require.Eventually(t, func() bool {
+		times := resolvedTimes()
+		for _, name := range append(store.domains, "f.com") {
+			if times[name] < 2 {
+				return false
+			}
+		}
+
+		return true
+	}, 10*time.Second, 50*time.Millisecond)
+
+	cancel()
+	<-stopped
+
+	// каждый воркер одновременно резолвит один домен: A и AAAA одного сервера
+	lock.Lock()
+	defer lock.Unlock()
+
+	require.LessOrEqual(t, peak, 2*2)
+	require.Positive(t, total)
+}
@@ -2,7 +2,6 @@ package resolver
 
 import (
 	"context"
-	"time"
 
 	"github.com/im-kulikov/go-bones/logger"
 	"github.com/im-kulikov/go-bones/service"
@@ -13,44 +12,47 @@ import (
 type dnsResult struct {
 	New storage.Item
 	TTL uint32
+
+	// Rcode and Err describe the response, failed requests are results too
+	Rcode int
+	Err   error
+
+	// Names contains owner names and CNAME targets seen in the answer
+	Names []string
+	// Chain contains CNAME chain starting from the queried domain
+	Chain []string
+
+	// Server is the name of the server, Trusted is set for encrypted servers
+	Server  string
+	Trusted bool
+
+	// DNSSEC contains the validation status of the answer
+	DNSSEC string
 }
 
-const (
-	serviceName    = "resolver"
-	defaultTimeout = time.Second * 15
-)
+const serviceName = "resolver"
+
+// optionalService is skipped by the runner when it is disabled.
+type optionalService struct {
+	service.Service
+
+	enabled bool
+}
+
+func (s optionalService) Enabled() bool { return s.enabled }
 
 func New(cfg Config, log *logger.Logger, store storage.DNS) (service.Service, error) {
 	out := logger.Named(log, serviceName)
 
-	return service.NewLauncher(serviceName, func(top context.Context) error {
-		tick := time.NewTimer(time.Microsecond)
-		defer tick.Stop()
-
-		for {
-			select {
-			case <-top.Done():
-				out.InfoContext(top, "try gracefully shutdown")
-
-				return nil
-			case <-tick.C:
-				now := time.Now()
-
-				ctx, cancel := context.WithTimeout(top, defaultTimeout)
-
-				out.DebugContext(top, "start resolving")
-
-				cnt, err := cfg.resolveDomains(ctx, out, store)
-				if err != nil {
-					out.ErrorContext(top, "could not resolve", logger.Err(err))
-				} else {
-					out.InfoContext(top, "resolve done",
-						logger.Int("domains", int(cnt)),
-						logger.Any("spent", time.Since(now)))
-				}
-				cancel()
-				tick.Reset(cfg.Timeout)
-			}
+	if cfg.pool == nil {
+		if err := cfg.prepare(); err != nil {
+			return nil, err
 		}
+	}
+
+	return service.NewLauncher(serviceName, func(top context.Context) error {
+		cfg.newScheduler(out, store).run(top)
+
+		return nil
 	}, func(ctx context.Context) { out.InfoContext(ctx, "gracefully shutdown") }), nil
 }
@@ -0,0 +1,128 @@
+package resolver
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/im-kulikov/go-bones/logger"
+	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
+
+	"github.com/im-kulikov/resolvex/internal/domain"
+	"github.com/im-kulikov/resolvex/internal/storage"
+)
+
+// discoveryBurst limits subdomains discovered from a burst of client answers.
+const discoveryBurst = 10
+
+// snooper publishes addresses of answers seen by clients for managed domains.
+// Such answers only add addresses, the schedule and the status of domains are kept.
+// Subdomains of wildcards are discovered at Discovery rate, names come from clients and are not trusted.
+type snooper struct {
+	*Config
+
+	log       *logger.Logger
+	store     storage.DNS
+	discovery *rate.Limiter
+}
+
+func newSnooper(cfg *Config, log *logger.Logger, store storage.DNS) snooper {
+	out := snooper{Config: cfg, log: log, store: store}
+	if cfg.Discovery > 0 {
+		out.discovery = rate.NewLimiter(rate.Limit(cfg.Discovery), discoveryBurst)
+	}
+
+	return out
+}
+
+// lookup returns the CNAME chain of the A/AAAA answer, starting from the queried domain,
+// managed names of it and names covered by wildcards, the store is not changed.
+func (s snooper) lookup(res *dns.Msg) ([]string, []string, []string) {
+	if res.Rcode != dns.RcodeSuccess || len(res.Question) != 1 {
+		return nil, nil, nil
+	}
+
+	question := res.Question[0]
+	if question.Qclass != dns.ClassINET || (question.Qtype != dns.TypeA && question.Qtype != dns.TypeAAAA) {
+		return nil, nil, nil
+	}
+
+	name := domain.Normalize(question.Name)
+	chain := cnameChain(name, res.Answer)
+	if len(chain) == 0 {
+		chain = []string{name}
+	}
+
+	return chain, s.store.Managed(chain...), s.store.Covered(chain...)
+}
+
+// discover adds names covered by wildcards as subdomains and returns added ones, it must be called
+// only for verified answers. Names are skipped when the discovery rate is exceeded or discovery is disabled.
+func (s snooper) discover(ctx context.Context, names []string) []string {
+	if len(names) == 0 {
+		return nil
+	}
+
+	// случайные имена клиентов под wildcard не должны бесконечно пополнять хранилище
+	if s.discovery == nil || !s.discovery.AllowN(time.Now(), len(names)) {
+		s.log.DebugContext(ctx, "discovery rate exceeded, subdomains are skipped", logger.Any("domains", names))
+
+		return nil
+	}
+
+	return s.store.Observe(names...)
+}
+
+// publish publishes addresses of the answer for managed names of the chain and returns them.
+func (s snooper) publish(ctx context.Context, chain, managed []string, res *dns.Msg) []string {
+	now := time.Now()
+	items := make([]storage.PublishItem, 0, len(managed))
+	for i, owner := range chain {
+		if !slices.Contains(managed, owner) {
+			continue
+		}
+
+		// адреса принадлежат домену, если их владелец - он сам или следующее имя в цепочке
+		item := storage.PublishItem{Domain: owner, Record: make(map[string]time.Time)}
+		for _, ra := range res.Answer {
+			if !slices.Contains(chain[i:], domain.Normalize(ra.Header().Name)) {
+				continue
+			}
+
+			expires := s.expiry(owner, ra.Header().Ttl, now)
+			switch ro := ra.(type) {
+			case *dns.A:
+				item.Record[ro.A.String()] = expires
+			case *dns.AAAA:
+				item.Record[ro.AAAA.String()] = expires
+			}
+		}
+
+		if len(item.Record) > 0 {
+			items = append(items, item)
+		}
+	}
+
+	if len(items) == 0 {
+		return nil
+	}
+
+	var addresses []string
+	for _, item := range items {
+		addresses = append(addresses, slices.Collect(maps.Keys(item.Record))...)
+	}
+
+	slices.Sort(addresses)
+	addresses = slices.Compact(addresses)
+
+	s.log.DebugContext(ctx, "addresses snooped",
+		logger.String("domain", chain[0]),
+		logger.Any("managed", managed),
+		logger.Any("addresses", addresses))
+
+	s.store.Publish(items)
+
+	return addresses
+}
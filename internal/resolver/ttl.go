@@ -0,0 +1,101 @@
+package resolver
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/im-kulikov/resolvex/internal/domain"
+)
+
+// ttlClamp limits TTL of answers used to schedule refresh and expire addresses.
+type ttlClamp struct {
+	min time.Duration
+	max time.Duration
+}
+
+func (t ttlClamp) apply(ttl time.Duration) time.Duration {
+	return min(max(ttl, t.min), t.max)
+}
+
+func parseClamp(value string) (ttlClamp, error) {
+	lower, upper, ok := strings.Cut(value, ":")
+	if !ok {
+		return ttlClamp{}, fmt.Errorf("expected min:max")
+	}
+
+	var (
+		out ttlClamp
+		err error
+	)
+
+	if out.min, err = time.ParseDuration(strings.TrimSpace(lower)); err != nil {
+		return ttlClamp{}, err
+	}
+
+	if out.max, err = time.ParseDuration(strings.TrimSpace(upper)); err != nil {
+		return ttlClamp{}, err
+	}
+
+	if out.min < 0 || out.max < out.min {
+		return ttlClamp{}, fmt.Errorf("expected 0 <= min <= max")
+	}
+
+	return out, nil
+}
+
+// newClamps parses global and per domain TTL clamps from Config, zero MaxTTL means no upper limit.
+func (c *Config) newClamps() (ttlClamp, map[string]ttlClamp, error) {
+	global := ttlClamp{min: c.MinTTL, max: c.MaxTTL}
+	if global.max == 0 {
+		global.max = math.MaxInt64
+	}
+
+	if global.min < 0 || global.max < global.min {
+		return global, nil, fmt.Errorf("ttl clamp should satisfy 0 <= min(%s) <= max(%s)", global.min, global.max)
+	}
+
+	domains := make(map[string]ttlClamp, len(c.DomainTTL))
+	for _, entry := range c.DomainTTL {
+		pattern, value, ok := strings.Cut(entry, "=")
+		if pattern = domain.Normalize(strings.TrimSpace(pattern)); !ok || domain.Validate(pattern) != nil {
+			return global, nil, fmt.Errorf("could not parse domain ttl %q: expected pattern=min:max", entry)
+		}
+
+		clamp, err := parseClamp(value)
+		if err != nil {
+			return global, nil, fmt.Errorf("could not parse domain ttl %q: %w", entry, err)
+		}
+
+		domains[pattern] = clamp
+	}
+
+	return global, domains, nil
+}
+
+// expiry returns when an address of the answer expires: one more TTL after the refresh of the domain,
+// so connections to addresses rotated out by the upstream keep their routes until clients resolve the name again.
+func (c *Config) expiry(name string, ttl uint32, now time.Time) time.Time {
+	value := c.clampTTL(name, ttl)
+
+	// MaxTTL без ограничения равен MaxInt64, удвоение длительности переполнилось бы
+	return now.Add(value).Add(value)
+}
+
+// clampTTL returns TTL limited by clamps of the domain: exact match wins, then the closest wildcard.
+func (c *Config) clampTTL(name string, ttl uint32) time.Duration {
+	value := time.Duration(ttl) * time.Second
+
+	if clamp, ok := c.clamps[name]; ok {
+		return clamp.apply(value)
+	}
+
+	for _, pattern := range domain.Wildcards(name) {
+		if clamp, ok := c.clamps[pattern]; ok {
+			return clamp.apply(value)
+		}
+	}
+
+	return c.clamp.apply(value)
+}
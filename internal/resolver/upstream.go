@@ -0,0 +1,290 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// upstream exchanges DNS messages with a single configured server.
+type upstream interface {
+	Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
+	String() string
+}
+
+const (
+	// dohMediaType is the media type of DNS wire format messages (RFC 8484).
+	dohMediaType = "application/dns-message"
+	// dohMaxSize limits the size of DoH response body.
+	dohMaxSize = dns.MaxMsgSize
+
+	// dotPort is the default port of DNS-over-TLS servers (RFC 7858).
+	dotPort = "853"
+	// dotMaxIdle limits idle connections kept for reuse by every DoT server.
+	dotMaxIdle = 4
+)
+
+// plainUpstream is a classic DNS server over UDP.
+type plainUpstream string
+
+func (u plainUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	return dns.ExchangeContext(ctx, msg, string(u))
+}
+
+func (u plainUpstream) String() string { return string(u) }
+
+// dohUpstream is a DNS-over-HTTPS server (RFC 8484).
+type dohUpstream struct {
+	url    *url.URL
+	method string
+	client *http.Client
+}
+
+func (u *dohUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	// RFC 8484 рекомендует нулевой ID, чтобы ответы лучше кешировались
+	query := msg.Copy()
+	query.Id = 0
+
+	buf, err := query.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("could not pack dns message: %w", err)
+	}
+
+	var req *http.Request
+	if u.method == http.MethodGet {
+		link := *u.url
+		values := link.Query()
+		values.Set("dns", base64.RawURLEncoding.EncodeToString(buf))
+		link.RawQuery = values.Encode()
+
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, link.String(), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, u.url.String(), bytes.NewReader(buf))
+		if req != nil {
+			req.Header.Set("Content-Type", dohMediaType)
+		}
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("could not prepare request: %w", err)
+	}
+
+	req.Header.Set("Accept", dohMediaType)
+
+	res, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() { _ = res.Body.Close() }()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+
+	if kind := res.Header.Get("Content-Type"); !strings.HasPrefix(kind, dohMediaType) {
+		return nil, fmt.Errorf("unexpected content type: %q", kind)
+	}
+
+	if buf, err = io.ReadAll(io.LimitReader(res.Body, dohMaxSize+1)); err != nil {
+		return nil, fmt.Errorf("could not read response: %w", err)
+	} else if len(buf) > dohMaxSize {
+		return nil, fmt.Errorf("response is too large")
+	}
+
+	out := new(dns.Msg)
+	if err = out.Unpack(buf); err != nil {
+		return nil, fmt.Errorf("could not unpack dns message: %w", err)
+	}
+
+	out.Id = msg.Id
+
+	return out, nil
+}
+
+func (u *dohUpstream) String() string { return u.url.String() }
+
+// dotUpstream is a DNS-over-TLS server (RFC 7858), connections are kept open and reused.
+type dotUpstream struct {
+	sync.Mutex
+
+	name   string
+	addr   string
+	client *dns.Client
+	idle   []*dns.Conn
+}
+
+func (u *dotUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	conn, reused, err := u.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res, _, err := u.client.ExchangeWithConnContext(ctx, msg, conn)
+	// сервер мог закрыть простаивающее соединение, поэтому повторяем запрос через новое
+	if err != nil && reused && ctx.Err() == nil {
+		_ = conn.Close()
+
+		if conn, err = u.client.DialContext(ctx, u.addr); err != nil {
+			return nil, err
+		}
+
+		res, _, err = u.client.ExchangeWithConnContext(ctx, msg, conn)
+	}
+
+	if err != nil {
+		_ = conn.Close()
+
+		return nil, err
+	}
+
+	u.release(conn)
+
+	return res, nil
+}
+
+// acquire returns an idle connection or dials a new one.
+func (u *dotUpstream) acquire(ctx context.Context) (*dns.Conn, bool, error) {
+	u.Lock()
+	if last := len(u.idle) - 1; last >= 0 {
+		conn := u.idle[last]
+		u.idle = u.idle[:last]
+		u.Unlock()
+
+		return conn, true, nil
+	}
+	u.Unlock()
+
+	conn, err := u.client.DialContext(ctx, u.addr)
+
+	return conn, false, err
+}
+
+// release keeps the connection for reuse or closes it when there are enough idle connections.
+func (u *dotUpstream) release(conn *dns.Conn) {
+	u.Lock()
+	defer u.Unlock()
+
+	if len(u.idle) >= dotMaxIdle {
+		_ = conn.Close()
+
+		return
+	}
+
+	u.idle = append(u.idle, conn)
+}
+
+func (u *dotUpstream) String() string { return u.name }
+
+// newUpstream parses the server: `https://` URLs are DoH servers, `tls://` are DoT servers,
+// other values are `host:port` of plain servers.
+func (c *Config) newUpstream(server string, client *http.Client, config *tls.Config) (upstream, error) {
+	if !strings.Contains(server, "://") {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return nil, fmt.Errorf("dns server(%q) should be host:port: %w", server, err)
+		}
+
+		return plainUpstream(server), nil
+	}
+
+	link, err := url.Parse(server)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse dns server(%q): %w", server, err)
+	}
+
+	if link.Host == "" {
+		return nil, fmt.Errorf("dns server(%q) should contain host", server)
+	}
+
+	switch link.Scheme {
+	case "https":
+		return &dohUpstream{url: link, method: c.DoHMethod, client: client}, nil
+	case "tls":
+		// имя сервера для проверки сертификата можно переопределить, например для `tls://1.1.1.1?name=one.one.one.one`
+		config = config.Clone()
+		if config.ServerName = link.Query().Get("name"); config.ServerName == "" {
+			config.ServerName = link.Hostname()
+		}
+
+		addr := link.Host
+		if link.Port() == "" {
+			addr = net.JoinHostPort(link.Hostname(), dotPort)
+		}
+
+		return &dotUpstream{
+			name:   server,
+			addr:   addr,
+			client: &dns.Client{Net: "tcp-tls", TLSConfig: config, Timeout: c.Timeout},
+		}, nil
+	default:
+		return nil, fmt.Errorf("dns server(%q) has unsupported scheme %q", server, link.Scheme)
+	}
+}
+
+// tlsConfig returns TLS settings for DoH and DoT servers, system roots are used when no CA files are configured.
+func (c *Config) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(c.RootCAs) == 0 {
+		return config, nil
+	}
+
+	config.RootCAs = x509.NewCertPool()
+	for _, path := range c.RootCAs {
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA file(%q): %w", path, err)
+		}
+
+		if !config.RootCAs.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("CA file(%q) does not contain PEM certificates", path)
+		}
+	}
+
+	return config, nil
+}
+
+// newUpstreams prepares upstreams for every configured server.
+func (c *Config) newUpstreams() ([]upstream, error) {
+	switch c.DoHMethod = strings.ToUpper(c.DoHMethod); c.DoHMethod {
+	case "":
+		c.DoHMethod = http.MethodPost
+	case http.MethodPost, http.MethodGet:
+	default:
+		return nil, fmt.Errorf("unsupported DoH method %q: expected POST or GET", c.DoHMethod)
+	}
+
+	config, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone() // nolint:forcetypeassert
+	transport.ForceAttemptHTTP2 = true
+	transport.TLSClientConfig = config.Clone()
+
+	client := &http.Client{Transport: transport, Timeout: c.Timeout}
+
+	out := make([]upstream, 0, len(c.Servers))
+	for _, server := range c.Servers {
+		item, err := c.newUpstream(strings.TrimSpace(server), client, config)
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, item)
+	}
+
+	return out, nil
+}
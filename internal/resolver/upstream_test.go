@@ -0,0 +1,167 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func dohHandler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			buf []byte
+			err error
+		)
+
+		switch r.Method {
+		case http.MethodGet:
+			buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			require.Equal(t, dohMediaType, r.Header.Get("Content-Type"))
+			buf, err = io.ReadAll(r.Body)
+		}
+		require.NoError(t, err)
+
+		req := new(dns.Msg)
+		require.NoError(t, req.Unpack(buf))
+		require.Zero(t, req.Id)
+
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.Answer = append(res.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(10, 0, 0, 1),
+		})
+
+		if buf, err = res.Pack(); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", dohMediaType)
+		_, _ = w.Write(buf)
+	}
+}
+
+func TestUpstream_DoH(t *testing.T) {
+	srv := httptest.NewTLSServer(dohHandler(t))
+	defer srv.Close()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+
+	for _, method := range []string{http.MethodPost, http.MethodGet} {
+		t.Run(method, func(t *testing.T) {
+			cfg := Config{DoHMethod: method}
+			server, err := cfg.newUpstream(srv.URL+"/dns-query", srv.Client(), nil)
+			require.NoError(t, err)
+			require.Equal(t, srv.URL+"/dns-query", server.String())
+
+			res, err := server.Exchange(context.Background(), msg)
+			require.NoError(t, err)
+			require.Equal(t, msg.Id, res.Id)
+			require.Len(t, res.Answer, 1)
+			require.Equal(t, "10.0.0.1", res.Answer[0].(*dns.A).A.String())
+		})
+	}
+}
+
+type countListener struct {
+	net.Listener
+
+	accepted atomic.Int32
+}
+
+func (l *countListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+
+	return conn, err
+}
+
+func TestUpstream_DoT(t *testing.T) {
+	// используем сертификат тестового HTTPS сервера, он выписан на example.com и 127.0.0.1
+	cert := httptest.NewTLSServer(http.NotFoundHandler())
+	defer cert.Close()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: cert.TLS.Certificates})
+	require.NoError(t, err)
+
+	counter := &countListener{Listener: listener}
+	srv := &dns.Server{Listener: counter, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.Answer = append(res.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(10, 0, 0, 2),
+		})
+
+		_ = w.WriteMsg(res)
+	})}
+
+	go func() { _ = srv.ActivateAndServe() }()
+	defer func() { _ = srv.Shutdown() }()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Certificate())
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+
+	cfg := Config{}
+	server, err := cfg.newUpstream("tls://"+listener.Addr().String()+"?name=example.com", nil, &tls.Config{RootCAs: roots})
+	require.NoError(t, err)
+
+	for range 3 {
+		res, err := server.Exchange(context.Background(), msg)
+		require.NoError(t, err)
+		require.Len(t, res.Answer, 1)
+		require.Equal(t, "10.0.0.2", res.Answer[0].(*dns.A).A.String())
+	}
+
+	// соединение переиспользуется
+	require.Equal(t, int32(1), counter.accepted.Load())
+
+	server, err = cfg.newUpstream("tls://"+listener.Addr().String()+"?name=wrong.org", nil, &tls.Config{RootCAs: roots})
+	require.NoError(t, err)
+
+	_, err = server.Exchange(context.Background(), msg)
+	require.Error(t, err)
+}
+
+func TestConfig_Upstreams(t *testing.T) {
+	cfg := Config{Servers: []string{"1.1.1.1:53", "https://dns.google/dns-query", "tls://dns.google"}}
+	list, err := cfg.newUpstreams()
+	require.NoError(t, err)
+	require.Len(t, list, 3)
+	require.IsType(t, plainUpstream(""), list[0])
+	require.IsType(t, new(dohUpstream), list[1])
+	require.IsType(t, new(dotUpstream), list[2])
+	require.Equal(t, "dns.google:853", list[2].(*dotUpstream).addr)
+	require.Equal(t, "dns.google", list[2].(*dotUpstream).client.TLSConfig.ServerName)
+	require.Equal(t, http.MethodPost, cfg.DoHMethod)
+
+	for _, wrong := range []string{"1.1.1.1", "ftp://example.com", "https:///dns-query", "tls://"} {
+		_, err = (&Config{Servers: []string{wrong}}).newUpstreams()
+		require.Error(t, err, wrong)
+	}
+
+	_, err = (&Config{DoHMethod: "PUT"}).newUpstreams()
+	require.Error(t, err)
+
+	_, err = (&Config{RootCAs: []string{"/not/exists.pem"}}).newUpstreams()
+	require.Error(t, err)
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/maypok86/otter/v2"
 
 	"github.com/im-kulikov/resolvex/internal/broadcast"
+	"github.com/im-kulikov/resolvex/internal/domain"
 )
 
 // API defines an interface for managing domain operations such as creation, deletion, updating, and listing.
@@ -21,27 +22,46 @@ type API interface {
 	Update(oldDomain, newDomain string) error
 	// List используется в API, чтобы отобразить список доменов и адресов
 	List() iter.Seq[Item]
+	// Guard используется в API, чтобы показать состояние защиты от массового отзыва маршрутов
+	Guard() GuardStatus
+	// Acknowledge используется в API, чтобы оператор подтвердил отзыв замороженных маршрутов
+	Acknowledge() bool
+	// Subscribed используется подписками, чтобы получить домены, пришедшие из списка
+	Subscribed(source string) []string
+	// Subscribe используется подписками, чтобы добавить и удалить домены списка
+	Subscribe(source string, add, remove []string)
 }
 
 // Create add a new domain to the store if it does not already exist, returning an error if the domain exists.
-func (s *store) Create(domain string) error {
-	s.ipItems.RLock()
-	defer s.ipItems.RUnlock()
+// A domain that came only from lists becomes manual, so synchronization of lists does not remove it.
+// Names are normalized like the loaded lists, so `*.Example.com.` and `*.example.com` are the same entry.
+func (s *store) Create(name string) error {
+	s.ipItems.Lock()
+	defer s.ipItems.Unlock()
+
+	name = domain.Normalize(name)
 
 	var err error
-	s.domains.Compute(domain, func(oldValue Item, found bool) (Item, otter.ComputeOp) {
-		if found {
-			err = fmt.Errorf("%w: %s", ErrExist, domain)
+	s.domains.Compute(name, func(oldValue Item, found bool) (Item, otter.ComputeOp) {
+		switch {
+		case found && !oldValue.Manual && len(oldValue.Sources) > 0:
+			oldValue.Manual = true
+
+			return oldValue, otter.WriteOp
+		case found:
+			err = fmt.Errorf("%w: %s", ErrExist, name)
 
 			return Item{}, otter.CancelOp
 		}
 
-		return Item{Domain: domain}, otter.WriteOp
+		return Item{Domain: name, Manual: true}, otter.WriteOp
 	})
 	if err != nil {
 		return err
 	}
 
+	s.persist([]string{name}, nil)
+
 	if err = s.validate("Create"); err != nil {
 		s.Error("validate failed", logger.Err(err))
 	}
@@ -50,38 +70,13 @@ func (s *store) Create(domain string) error {
 }
 
 // Delete removes the specified domain from the store along with associated IPs, broadcasting updates for removed IPs.
-func (s *store) Delete(domain string) error {
+// Deleting a wildcard pattern also removes every subdomain discovered by it.
+func (s *store) Delete(name string) error {
 	s.ipItems.Lock()
 	defer s.ipItems.Unlock()
 
-	err, msg := (error)(nil), broadcast.UpdateMessage{Cause: broadcast.CauseAPIDelete}
-	s.domains.Compute(domain, func(old Item, found bool) (Item, otter.ComputeOp) {
-		if !found {
-			err = fmt.Errorf("%w: %s", ErrNotFound, domain)
-
-			return old, otter.CancelOp
-		}
-
-		// собираем список на удаление
-		for address := range old.ext {
-			// если в общем есть, но количество меньше или равно 1 - удаляем
-			val, ok := s.ipItems.list[address]
-			if ok && val <= 1 {
-				msg.ToRemove = append(msg.ToRemove, address)
-
-				delete(s.ipItems.list, address)
-
-				continue
-			}
-
-			// иначе - уменьшаем на единицу
-			s.ipItems.list[address] -= 1
-		}
-
-		// указываем, что необходимо удалить запись
-		return old, otter.InvalidateOp
-	})
-
+	msg := broadcast.UpdateMessage{Cause: broadcast.CauseAPIDelete}
+	removed, err := s.dropDomain(domain.Normalize(name), &msg)
 	if err != nil {
 		return err
 	}
@@ -92,6 +87,8 @@ func (s *store) Delete(domain string) error {
 		s.manager.Broadcast(msg)
 	}
 
+	s.persist(nil, removed)
+
 	if err = s.validate("Delete"); err != nil {
 		s.Error("validate failed", logger.Err(err))
 	}
@@ -99,46 +96,83 @@ func (s *store) Delete(domain string) error {
 	return nil
 }
 
-// Update modifies an existing domain to a new domain, ensuring the new domain does not already exist in the store.
-// Returns an error if the old domain does not exist or the new domain already exists.
-// Handles removal and decrement of associated IP addresses and broadcast removals if necessary.
-func (s *store) Update(oldDomain, newDomain string) error {
-	s.ipItems.Lock()
-	defer s.ipItems.Unlock()
+// dropDomain removes the domain and its related domains (discovered subdomains and tracked CNAME targets),
+// collects addresses to withdraw into msg and returns the list of removed domains. Must be called under ipItems lock.
+func (s *store) dropDomain(name string, msg *broadcast.UpdateMessage) ([]string, error) {
+	// потомки ищутся рекурсивно: цели CNAME отслеживаются и у поддоменов шаблона
+	children := make(map[string][]string) // parent => domains
+	for item := range s.domains.Values() {
+		if item.Parent != "" {
+			children[item.Parent] = append(children[item.Parent], item.Domain)
+		}
+	}
 
-	if _, ok := s.domains.GetEntry(newDomain); ok {
-		return fmt.Errorf("could not change %q to %q: %w", oldDomain, newDomain, ErrExist)
+	removed := []string{name}
+	seen := map[string]struct{}{name: {}}
+	for index := 0; index < len(removed); index++ {
+		for _, child := range children[removed[index]] {
+			if _, ok := seen[child]; !ok {
+				seen[child] = struct{}{}
+				removed = append(removed, child)
+			}
+		}
 	}
 
-	err, msg := (error)(nil), broadcast.UpdateMessage{Cause: broadcast.CauseAPIUpdate}
-	s.domains.Compute(oldDomain, func(old Item, found bool) (Item, otter.ComputeOp) {
-		if !found {
-			err = fmt.Errorf("could not change %q to %q: %w", oldDomain, newDomain, ErrNotFound)
+	var err error
+	for _, item := range removed {
+		s.domains.Compute(item, func(old Item, found bool) (Item, otter.ComputeOp) {
+			if !found {
+				err = fmt.Errorf("%w: %s", ErrNotFound, item)
 
-			return old, otter.CancelOp
-		}
+				return old, otter.CancelOp
+			}
+
+			// собираем список на удаление
+			for address := range old.ext {
+				// если в общем есть, но количество меньше или равно 1 - удаляем
+				if val, ok := s.ipItems.list[address]; ok && val <= 1 {
+					msg.ToRemove = append(msg.ToRemove, address)
 
-		// собираем список на удаление
-		for address := range old.ext {
-			// если в общем есть, но количество меньше или равно 1 - удаляем
-			if val, ok := s.ipItems.list[address]; ok && val <= 1 {
-				msg.ToRemove = append(msg.ToRemove, address)
+					delete(s.ipItems.list, address)
 
-				delete(s.ipItems.list, address)
+					continue
+				}
 
-				continue
+				// иначе - уменьшаем на единицу
+				s.ipItems.list[address] -= 1
 			}
 
-			// иначе - уменьшаем на единицу
-			s.ipItems.list[address] -= 1
+			// указываем, что необходимо удалить запись
+			return old, otter.InvalidateOp
+		})
+
+		// сам домен должен существовать, дочерние могли быть удалены параллельно
+		if err != nil && item == name {
+			return nil, err
 		}
 
-		// указываем, что необходимо удалить запись
-		return old, otter.InvalidateOp
-	})
+		err = nil
+	}
+
+	return removed, nil
+}
 
+// Update modifies an existing domain to a new domain, ensuring the new domain does not already exist in the store.
+// Returns an error if the old domain does not exist or the new domain already exists.
+// Handles removal and decrement of associated IP addresses and broadcast removals if necessary.
+func (s *store) Update(oldDomain, newDomain string) error {
+	s.ipItems.Lock()
+	defer s.ipItems.Unlock()
+
+	oldDomain, newDomain = domain.Normalize(oldDomain), domain.Normalize(newDomain)
+	if _, ok := s.domains.GetEntry(newDomain); ok {
+		return fmt.Errorf("could not change %q to %q: %w", oldDomain, newDomain, ErrExist)
+	}
+
+	msg := broadcast.UpdateMessage{Cause: broadcast.CauseAPIUpdate}
+	removed, err := s.dropDomain(oldDomain, &msg)
 	if err != nil {
-		return err
+		return fmt.Errorf("could not change %q to %q: %w", oldDomain, newDomain, ErrNotFound)
 	}
 
 	s.domains.Compute(newDomain, func(oldValue Item, found bool) (Item, otter.ComputeOp) {
@@ -148,7 +182,7 @@ func (s *store) Update(oldDomain, newDomain string) error {
 			return Item{}, otter.CancelOp
 		}
 
-		return Item{Domain: newDomain}, otter.WriteOp
+		return Item{Domain: newDomain, Manual: true}, otter.WriteOp
 	})
 
 	if err != nil {
@@ -161,6 +195,8 @@ func (s *store) Update(oldDomain, newDomain string) error {
 		s.manager.Broadcast(msg)
 	}
 
+	s.persist([]string{newDomain}, removed)
+
 	if err = s.validate("Update"); err != nil {
 		s.Error("validate failed", logger.Err(err))
 	}
@@ -177,7 +213,18 @@ func (s *store) List() iter.Seq[Item] {
 	return func(yield func(Item) bool) {
 		for rec := range s.domains.Values() {
 			if !yield(
-				Item{Domain: rec.Domain, Expire: rec.Expire, Record: slices.Clone(rec.Record)},
+				Item{
+					Domain: rec.Domain,
+					Parent: rec.Parent,
+					Expire: rec.Expire,
+					Record: slices.Clone(rec.Record),
+					Chain:  slices.Clone(rec.Chain),
+					Status: rec.Status,
+					Hold:   holdTimes(rec),
+
+					Manual:  rec.Manual,
+					Sources: slices.Clone(rec.Sources),
+				},
 			) {
 				return
 			}
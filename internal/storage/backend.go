@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"io"
+	"maps"
+	"slices"
+	"time"
+)
+
+// Backend defines a persistent layer that keeps domains and IP reference counters between restarts.
+type Backend interface {
+	// Load используется при старте, чтобы восстановить домены и счётчики адресов
+	Load() ([]Record, map[string]int, error)
+	// Save используется после изменений, чтобы сохранить изменённые и удалить удалённые домены,
+	// counters содержит только изменённые счётчики, нулевой счётчик удаляется
+	Save(update []Record, remove []string, counters map[string]int) error
+	// LoadGuard используется при старте, чтобы рестарт не снимал заморозку массового отзыва
+	LoadGuard() (GuardState, error)
+	// SaveGuard используется после изменения заморозки, нулевое состояние означает, что тревоги нет
+	SaveGuard(state GuardState) error
+
+	io.Closer
+}
+
+// Record represents the persisted state of a single domain.
+type Record struct {
+	Domain string               `json:"domain"`
+	Parent string               `json:"parent,omitempty"`
+	Expire time.Time            `json:"expire"`
+	Record map[string]time.Time `json:"record"`
+	Seen   map[string]time.Time `json:"seen,omitempty"`
+	Last   time.Time            `json:"last,omitzero"`
+	Chain  []string             `json:"chain,omitempty"`
+	Status Status               `json:"status,omitzero"`
+	Manual bool                 `json:"manual,omitempty"`
+	Source []string             `json:"sources,omitempty"`
+}
+
+// GuardState represents the persisted state of the mass-withdrawal guard, zero Since means no alert.
+type GuardState struct {
+	Since    time.Time `json:"since"`
+	Withheld []string  `json:"withheld,omitempty"`
+}
+
+// memoryBackend is used when no persistent storage is configured, all data lives only in memory.
+type memoryBackend struct{}
+
+func (memoryBackend) Load() ([]Record, map[string]int, error) { return nil, nil, nil }
+
+func (memoryBackend) Save([]Record, []string, map[string]int) error { return nil }
+
+func (memoryBackend) LoadGuard() (GuardState, error) { return GuardState{}, nil }
+
+func (memoryBackend) SaveGuard(GuardState) error { return nil }
+
+func (memoryBackend) Close() error { return nil }
+
+func newRecord(item Item) Record {
+	return Record{
+		Domain: item.Domain,
+		Parent: item.Parent,
+		Expire: item.Expire,
+		Record: maps.Clone(item.ext),
+		Seen:   maps.Clone(item.seen),
+		Last:   item.last,
+		Chain:  slices.Clone(item.Chain),
+		Status: item.Status,
+		Manual: item.Manual,
+		Source: slices.Clone(item.Sources),
+	}
+}
+
+func (r Record) item() Item {
+	ext := maps.Clone(r.Record)
+	if ext == nil {
+		ext = make(map[string]time.Time)
+	}
+
+	// домены, сохранённые до появления подписок, добавлены оператором
+	manual := r.Manual || (len(r.Source) == 0 && r.Parent == "")
+
+	return Item{
+		ext:  ext,
+		seen: maps.Clone(r.Seen),
+		last: r.Last,
+
+		Domain:  r.Domain,
+		Parent:  r.Parent,
+		Expire:  r.Expire,
+		Record:  slices.Collect(maps.Keys(ext)),
+		Chain:   slices.Clone(r.Chain),
+		Status:  r.Status,
+		Manual:  manual,
+		Sources: slices.Clone(r.Source),
+	}
+}
@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltBackend stores domains and IP reference counters in an embedded bbolt database file.
+type boltBackend struct {
+	db *bolt.DB
+}
+
+// nolint:gochecknoglobals
+var (
+	domainsBucket  = []byte("domains")
+	countersBucket = []byte("counters")
+	guardBucket    = []byte("guard")
+	guardKey       = []byte("state")
+)
+
+const boltOpenTimeout = time.Second * 5
+
+// NewBoltBackend opens (or creates) a bbolt database at the given path and prepares required buckets.
+func NewBoltBackend(path string) (Backend, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("could not open storage(%q): %w", path, err)
+	}
+
+	if err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{domainsBucket, countersBucket, guardBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		_ = db.Close()
+
+		return nil, fmt.Errorf("could not prepare storage(%q): %w", path, err)
+	}
+
+	return &boltBackend{db: db}, nil
+}
+
+// Load reads all persisted domains and IP reference counters.
+func (b *boltBackend) Load() ([]Record, map[string]int, error) {
+	var records []Record
+	counters := make(map[string]int)
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(domainsBucket).ForEach(func(key, val []byte) error {
+			var rec Record
+			if err := json.Unmarshal(val, &rec); err != nil {
+				return fmt.Errorf("could not decode domain(%q): %w", key, err)
+			}
+
+			records = append(records, rec)
+
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		return tx.Bucket(countersBucket).ForEach(func(key, val []byte) error {
+			if len(val) != 8 {
+				return fmt.Errorf("could not decode counter(%q): wrong length %d", key, len(val))
+			}
+
+			counters[string(key)] = int(binary.BigEndian.Uint64(val)) // nolint:gosec
+
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not load storage: %w", err)
+	}
+
+	return records, counters, nil
+}
+
+// Save writes changed domains, drops removed ones and updates changed IP reference counters in a single transaction.
+func (b *boltBackend) Save(update []Record, remove []string, counters map[string]int) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		domains := tx.Bucket(domainsBucket)
+		for _, name := range remove {
+			if err := domains.Delete([]byte(name)); err != nil {
+				return fmt.Errorf("could not delete domain(%q): %w", name, err)
+			}
+		}
+
+		for _, rec := range update {
+			data, err := json.Marshal(rec)
+			if err != nil {
+				return fmt.Errorf("could not encode domain(%q): %w", rec.Domain, err)
+			}
+
+			if err = domains.Put([]byte(rec.Domain), data); err != nil {
+				return fmt.Errorf("could not store domain(%q): %w", rec.Domain, err)
+			}
+		}
+
+		bucket := tx.Bucket(countersBucket)
+		for address, counter := range counters {
+			var err error
+			if counter <= 0 {
+				err = bucket.Delete([]byte(address))
+			} else {
+				err = bucket.Put([]byte(address), binary.BigEndian.AppendUint64(nil, uint64(counter))) // nolint:gosec
+			}
+
+			if err != nil {
+				return fmt.Errorf("could not store counter(%q): %w", address, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// LoadGuard reads the persisted state of the mass-withdrawal guard.
+func (b *boltBackend) LoadGuard() (GuardState, error) {
+	var state GuardState
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if val := tx.Bucket(guardBucket).Get(guardKey); val != nil {
+			return json.Unmarshal(val, &state)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return GuardState{}, fmt.Errorf("could not load guard: %w", err)
+	}
+
+	return state, nil
+}
+
+// SaveGuard writes the state of the mass-withdrawal guard, the zero state is deleted.
+func (b *boltBackend) SaveGuard(state GuardState) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if state.Since.IsZero() {
+			return tx.Bucket(guardBucket).Delete(guardKey)
+		}
+
+		data, err := json.Marshal(state)
+		if err != nil {
+			return fmt.Errorf("could not encode guard: %w", err)
+		}
+
+		return tx.Bucket(guardBucket).Put(guardKey, data)
+	})
+}
+
+// Close releases the database file.
+func (b *boltBackend) Close() error { return b.db.Close() }
@@ -9,51 +9,62 @@ import (
 	"github.com/maypok86/otter/v2"
 
 	"github.com/im-kulikov/resolvex/internal/broadcast"
+	"github.com/im-kulikov/resolvex/internal/domain"
 )
 
 // DNS представляет интерфейс для работы с DNS функциональностью.
 type DNS interface {
 	// AllDomains получить список всех доменов
 	AllDomains() []string
-	// ExpiredDomains используется для DNS, чтобы обработать
-	ExpiredDomains() []string
 	// Publish используется для DNS, чтобы обновить записи
 	Publish(domains []PublishItem)
+	// Observe используется для DNS, чтобы добавить поддомены, попадающие под wildcard
+	Observe(names ...string) []string
+	// Managed используется для DNS, чтобы выбрать имена, которые хранятся как домены
+	Managed(names ...string) []string
+	// Covered используется для DNS, чтобы выбрать имена, которые Observe добавит как поддомены
+	Covered(names ...string) []string
+	// Schedules используется для DNS, чтобы получить время обновления всех доменов при старте
+	Schedules() []Schedule
+	// Changes сигнализирует, что домены были добавлены, изменены или удалены
+	Changes() <-chan struct{}
+	// PopChanges возвращает время обновления доменов, изменённых с прошлого вызова
+	PopChanges() []Schedule
 }
 
+// PublishItem contains the answer for the domain.
+// Items without Expire only add addresses to stored domains, the schedule and the status are kept.
 type PublishItem struct {
 	Domain string
 	Expire time.Time
 	Record map[string]time.Time
+	// Chain contains CNAME chain of the answer, starting from the domain itself.
+	Chain []string
+	// Rcode and Error describe the response, empty Rcode is treated as NOERROR.
+	Rcode string
+	Error string
+	// Disagreement describes different answers of servers, nil when servers agree.
+	Disagreement *Disagreement
+	// DNSSEC contains the validation status of the answer, bogus answers are failures.
+	DNSSEC string
 }
 
-func (s *store) getDomains(expired bool) []string {
-	var out []string // nolint:prealloc
-	for item := range s.domains.Values() {
-		// не нужно обновлять записи, которые не протухли
-		if expired && time.Until(item.Expire) > 0 {
-			continue
-		}
-
-		out = append(out, item.Domain)
-	}
-
-	return out
+// Failed reports whether the domain was not resolved: the request failed or the server returned an error.
+// Negative answers (NXDOMAIN) are answers without addresses.
+func (p PublishItem) Failed() bool {
+	return p.Error != "" || (p.Rcode != "" && p.Rcode != RcodeSuccess && p.Rcode != RcodeNameError)
 }
 
 func (s *store) AllDomains() []string {
 	s.ipItems.RLock()
 	defer s.ipItems.RUnlock()
 
-	return s.getDomains(false)
-}
-
-// ExpiredDomains return a slice of all domain names currently present in the store, ensuring thread-safe access.
-func (s *store) ExpiredDomains() []string {
-	s.ipItems.RLock()
-	defer s.ipItems.RUnlock()
+	var out []string // nolint:prealloc
+	for item := range s.domains.Values() {
+		out = append(out, item.Domain)
+	}
 
-	return s.getDomains(true)
+	return out
 }
 
 // Publish updates the store's domain and IP lists, handling additions, removals, and broadcasting updates.
@@ -64,20 +75,40 @@ func (s *store) Publish(domains []PublishItem) {
 	var msg broadcast.UpdateMessage
 	// Идём по новым доменам
 	for _, rec := range domains {
+		policy, now := s.retentionOf(rec.Domain), time.Now()
+
 		// обрабатываем каждую запись
 		s.domains.Compute(rec.Domain, func(old Item, found bool) (Item, otter.ComputeOp) {
+			// подсмотренный ответ не создаёт домен, который могли удалить после проверки,
+			// ошибка тоже: иначе удалённый во время запроса домен вернулся бы пустым
+			if !found && (rec.Expire.IsZero() || rec.Failed()) {
+				return old, otter.CancelOp
+			}
+
+			// при ошибке адреса не трогаем, обновляем только статус и время следующей попытки
+			if rec.Failed() {
+				old.Expire, old.Status = rec.Expire, old.Status.failed(rec)
+
+				return old, otter.WriteOp
+			}
+
 			// сначала очищаем от старых записей и формируем список обновлений
 			//   - если запись из нового списка протухшая - пропускаем / continue
+			//   - срок удаления продлевается политикой удержания от момента, когда адрес видели последний раз
 			//   - если запись из нового списка уже есть в старом — запоминаем, что есть более новая версия и continue
 			//   - если нет записи в общем счётчике - добавляем в список обновления
 			//   - инкремент общего счётчика
 			has := make(map[string]struct{})
 			lst := make(map[string]time.Time)
+			seen := make(map[string]time.Time)
 			for address, expires := range rec.Record {
-				if time.Until(expires) <= 0 {
+				if expires.Sub(now) <= 0 {
 					continue
 				}
 
+				seen[address] = now
+				expires = policy.deadline(now, expires)
+
 				if _, ok := old.ext[address]; ok {
 					lst[address] = expires
 					has[address] = struct{}{}
@@ -86,6 +117,7 @@ func (s *store) Publish(domains []PublishItem) {
 
 				if _, ok := s.ipItems.list[address]; !ok {
 					msg.ToUpdate = append(msg.ToUpdate, address)
+					msg.SetGroup(address, s.groupOf(rec.Domain))
 				}
 
 				lst[address] = expires
@@ -95,19 +127,36 @@ func (s *store) Publish(domains []PublishItem) {
 			// теперь нужно пройтись по тем записям, что остались в старом списке и не были найдены в новом
 			//   - если запись есть в новом списке - пропускаем, continue
 			//   - если не протух - добавляем в новый список и continue
+			//   - протухшие оставляем, если политика требует хранить последние N адресов
 			//   - если найден в общем списке и счётчик больше 1 - просто декремент и continue
 			//   - иначе удаляем из общего списка и добавляем в список на удаление
 			// иначе на удаление
+			var expired []string
 			for address, expires := range old.ext {
 				if _, ok := has[address]; ok {
 					continue
 				}
 
-				if time.Until(expires) > 0 {
+				if when, ok := old.seen[address]; ok {
+					seen[address] = when
+				}
+
+				if expires.Sub(now) > 0 {
 					lst[address] = expires
 					continue
 				}
 
+				expired = append(expired, address)
+			}
+
+			kept, released := policy.keep(expired, len(lst), old.seen, old.ext)
+			for _, address := range kept {
+				lst[address] = old.ext[address]
+			}
+
+			for _, address := range released {
+				delete(seen, address)
+
 				if val, ok := s.ipItems.list[address]; ok && val > 1 {
 					s.ipItems.list[address] -= 1
 					continue
@@ -118,18 +167,54 @@ func (s *store) Publish(domains []PublishItem) {
 			}
 
 			// по завершению - сохраняем новый элемент
-			return Item{
-				ext: lst,
+			next := Item{
+				ext:  lst,
+				seen: seen,
+				last: now,
 
 				Domain: rec.Domain,
+				Parent: old.Parent,
 				Expire: rec.Expire,
 				Record: slices.Collect(maps.Keys(lst)),
-			}, otter.WriteOp
+				Chain:  rec.Chain,
+				Status: old.Status.answered(rec, now),
+
+				Manual:  old.Manual,
+				Sources: old.Sources,
+			}
+
+			// ответ только добавил адреса, расписание, цепочку и статус ведёт резолвер
+			if rec.Expire.IsZero() {
+				next.Expire, next.Chain, next.Status = old.Expire, old.Chain, old.Status
+			}
+
+			return next, otter.WriteOp
 		})
 	}
 
 	msg.Cause = broadcast.CauseDNSPublish
 
+	// массовый отзыв маршрутов замораживается, пока оператор не подтвердит или адреса не вернутся
+	alert := !s.guard.since.IsZero()
+	now := time.Now()
+	s.guard.revive(msg.ToUpdate)
+	msg.ToRemove = s.guard.filter(now, len(s.ipItems.list), msg.ToRemove)
+	msg.ToRemove = append(msg.ToRemove, s.guard.settle(now, len(s.ipItems.list))...)
+
+	switch status := s.guard.status(); {
+	case !alert && status.Alert:
+		s.Warn("mass-withdrawal detected, withdrawals are frozen",
+			logger.Int("withheld", len(status.Withheld)),
+			logger.Int("table", len(s.ipItems.list)))
+	case alert && !status.Alert:
+		s.Info("mass-withdrawal alert cleared")
+	}
+
+	// заморозка живёт только в памяти, без сохранения рестарт отозвал бы удержанные адреса
+	if alert || !s.guard.since.IsZero() {
+		s.flusher.markGuard()
+	}
+
 	// если есть обновления - отправляем
 	if len(msg.ToUpdate) > 0 || len(msg.ToRemove) > 0 {
 		slices.Sort(msg.ToUpdate)
@@ -137,7 +222,137 @@ func (s *store) Publish(domains []PublishItem) {
 		s.manager.Broadcast(msg)
 	}
 
+	updated := make([]string, 0, len(domains))
+	for _, rec := range domains {
+		updated = append(updated, rec.Domain)
+	}
+
+	updated = append(updated, s.trackTargets(domains)...)
+
+	s.persist(updated, nil)
+
 	if err := s.validate("CauseDNSPublish"); err != nil {
 		s.Error("validate failed", logger.Err(err))
 	}
 }
+
+// Observe adds observed names that match a stored wildcard pattern as child domains and returns added ones.
+// Names that are already stored or not covered by any wildcard are ignored.
+func (s *store) Observe(names ...string) []string {
+	s.ipItems.Lock()
+	defer s.ipItems.Unlock()
+
+	var added []string
+	for _, name := range names {
+		name = domain.Normalize(name)
+
+		parent := s.parentOf(name)
+		if parent == "" {
+			continue
+		}
+
+		s.domains.Compute(name, func(old Item, found bool) (Item, otter.ComputeOp) {
+			if found {
+				return old, otter.CancelOp
+			}
+
+			added = append(added, name)
+
+			return Item{Domain: name, Parent: parent, ext: make(map[string]time.Time)}, otter.WriteOp
+		})
+	}
+
+	if len(added) == 0 {
+		return nil
+	}
+
+	s.Info("subdomains discovered", logger.Any("domains", added))
+
+	s.persist(added, nil)
+
+	return added
+}
+
+// parentOf returns the closest stored wildcard pattern covering the name, must be called under ipItems lock.
+func (s *store) parentOf(name string) string {
+	for _, pattern := range domain.Wildcards(name) {
+		if _, ok := s.domains.GetIfPresent(pattern); ok {
+			return pattern
+		}
+	}
+
+	return ""
+}
+
+// Covered returns names that are not stored yet but match a stored wildcard pattern.
+func (s *store) Covered(names ...string) []string {
+	s.ipItems.RLock()
+	defer s.ipItems.RUnlock()
+
+	var out []string
+	for _, name := range names {
+		if name = domain.Normalize(name); domain.IsWildcard(name) {
+			continue
+		}
+
+		if _, ok := s.domains.GetIfPresent(name); !ok && s.parentOf(name) != "" {
+			out = append(out, name)
+		}
+	}
+
+	return out
+}
+
+// Managed returns names that are stored as domains, wildcard patterns are not domains.
+func (s *store) Managed(names ...string) []string {
+	s.ipItems.RLock()
+	defer s.ipItems.RUnlock()
+
+	var out []string
+	for _, name := range names {
+		if name = domain.Normalize(name); domain.IsWildcard(name) {
+			continue
+		}
+
+		if _, ok := s.domains.GetIfPresent(name); ok {
+			out = append(out, name)
+		}
+	}
+
+	return out
+}
+
+// trackTargets adds CNAME targets as related domains when tracking is enabled and returns added ones.
+// Must be called under ipItems lock.
+func (s *store) trackTargets(domains []PublishItem) []string {
+	if !s.tracked {
+		return nil
+	}
+
+	var added []string
+	for _, rec := range domains {
+		// связанный домен принадлежит исходному, чтобы удаляться вместе с ним
+		parent := rec.Domain
+		if item, ok := s.domains.GetIfPresent(rec.Domain); ok && item.Parent != "" && !domain.IsWildcard(item.Parent) {
+			parent = item.Parent
+		}
+
+		for _, target := range rec.Chain[min(1, len(rec.Chain)):] {
+			s.domains.Compute(target, func(old Item, found bool) (Item, otter.ComputeOp) {
+				if found {
+					return old, otter.CancelOp
+				}
+
+				added = append(added, target)
+
+				return Item{Domain: target, Parent: parent, ext: make(map[string]time.Time)}, otter.WriteOp
+			})
+		}
+	}
+
+	if len(added) > 0 {
+		s.Info("CNAME targets tracked", logger.Any("domains", added))
+	}
+
+	return added
+}
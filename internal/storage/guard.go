@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/im-kulikov/go-bones/logger"
+
+	"github.com/im-kulikov/resolvex/internal/broadcast"
+)
+
+// GuardConfig describes the mass-withdrawal guard, it protects the table when upstreams fail or return empty answers.
+// When DNS driven withdrawals within Window exceed Share of the table, withdrawals are frozen
+// until an operator acknowledges the alert or the withheld addresses come back.
+// Share equal to zero disables the guard, withdrawals fewer than Minimum never raise the alert.
+type GuardConfig struct {
+	Share   float64       `env:"SHARE"   default:"0.5"`
+	Window  time.Duration `env:"WINDOW"  default:"10m"`
+	Minimum int           `env:"MINIMUM" default:"10"`
+}
+
+// GuardStatus describes the state of the mass-withdrawal guard.
+type GuardStatus struct {
+	Alert    bool
+	Since    time.Time
+	Withheld []string
+}
+
+type withdrawal struct {
+	at    time.Time
+	count int
+}
+
+// guard keeps withdrawals history and withheld addresses, must be used under ipItems lock.
+type guard struct {
+	GuardConfig
+
+	since    time.Time
+	history  []withdrawal
+	withheld map[string]struct{}
+}
+
+func newGuard(cfg GuardConfig) *guard {
+	return &guard{GuardConfig: cfg, withheld: make(map[string]struct{})}
+}
+
+// filter returns withdrawals that are allowed to be broadcast, table is the number of announced addresses.
+// Withdrawals exceeding the share of the table are withheld and raise the alert.
+func (g *guard) filter(now time.Time, table int, remove []string) []string {
+	if g.Share <= 0 || len(remove) == 0 {
+		return remove
+	}
+
+	if !g.since.IsZero() {
+		g.withhold(remove)
+
+		return nil
+	}
+
+	if g.exceeds(now, table, len(remove)) {
+		g.since = now
+		g.withhold(remove)
+
+		return nil
+	}
+
+	g.history = append(g.history, withdrawal{at: now, count: len(remove)})
+
+	return remove
+}
+
+// exceeds reports whether withdrawals within the window together with count exceed the share of the table.
+func (g *guard) exceeds(now time.Time, table, count int) bool {
+	g.history = slices.DeleteFunc(g.history, func(item withdrawal) bool { return now.Sub(item.at) > g.Window })
+
+	for _, item := range g.history {
+		count += item.count
+	}
+
+	// размер таблицы на начало окна: текущие адреса и всё, что было отозвано в окне
+	return count >= max(g.Minimum, 1) && float64(count) > g.Share*float64(table+count)
+}
+
+func (g *guard) withhold(remove []string) {
+	for _, address := range remove {
+		g.withheld[address] = struct{}{}
+	}
+}
+
+// revive forgets withheld addresses that came back into the table.
+func (g *guard) revive(addresses []string) {
+	for _, address := range addresses {
+		delete(g.withheld, address)
+	}
+}
+
+// settle clears the alert when the remaining withheld addresses fit into the share of the table
+// and returns them to be withdrawn.
+func (g *guard) settle(now time.Time, table int) []string {
+	if g.since.IsZero() || g.exceeds(now, table, len(g.withheld)) {
+		return nil
+	}
+
+	return g.release()
+}
+
+// release clears the alert and returns withheld addresses.
+func (g *guard) release() []string {
+	out := slices.Sorted(maps.Keys(g.withheld))
+
+	g.since = time.Time{}
+	g.withheld = make(map[string]struct{})
+	g.history = nil
+
+	return out
+}
+
+// state returns the alert and withheld addresses to be persisted.
+func (g *guard) state() GuardState {
+	return GuardState{Since: g.since, Withheld: slices.Sorted(maps.Keys(g.withheld))}
+}
+
+// restore brings back the persisted alert, withheld addresses are announced again by the store.
+func (g *guard) restore(state GuardState) {
+	if g.Share <= 0 || state.Since.IsZero() {
+		return
+	}
+
+	g.since = state.Since
+	g.withhold(state.Withheld)
+}
+
+func (g *guard) status() GuardStatus {
+	return GuardStatus{
+		Alert:    !g.since.IsZero(),
+		Since:    g.since,
+		Withheld: slices.Sorted(maps.Keys(g.withheld)),
+	}
+}
+
+// Guard returns the state of the mass-withdrawal guard.
+func (s *store) Guard() GuardStatus {
+	s.ipItems.RLock()
+	defer s.ipItems.RUnlock()
+
+	return s.guard.status()
+}
+
+// Acknowledge clears the alert of the mass-withdrawal guard and withdraws withheld addresses.
+// Returns false when there is no alert.
+func (s *store) Acknowledge() bool {
+	s.ipItems.Lock()
+	defer s.ipItems.Unlock()
+
+	if s.guard.since.IsZero() {
+		return false
+	}
+
+	remove := s.guard.release()
+
+	s.Warn("mass-withdrawal alert acknowledged", logger.Int("withdrawn", len(remove)))
+
+	s.flusher.markGuard()
+	s.persist(nil, nil)
+
+	if len(remove) > 0 {
+		s.manager.Broadcast(broadcast.UpdateMessage{Cause: broadcast.CauseGuardRelease, ToRemove: remove})
+	}
+
+	return true
+}
@@ -0,0 +1,235 @@
+package storage
+
+import (
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/im-kulikov/go-bones/logger"
+)
+
+// flusher collects domains changed since the last flush and counters saved by the last flush,
+// so every flush writes only changed domains and counters.
+type flusher struct {
+	sync.Mutex // serializes flushes
+
+	interval time.Duration
+	saved    map[string]int // address => persisted counter
+
+	pending sync.Mutex
+	update  map[string]struct{}
+	remove  map[string]struct{}
+	guard   bool
+
+	stop chan struct{}
+	done chan struct{}
+
+	// closing делает повторный Close безопасным: канал и backend закрываются один раз
+	closing sync.Once
+	closed  error
+}
+
+// batch is a single write into the backend, zero counters are deleted, guard is set when it was changed.
+type batch struct {
+	update   []Record
+	remove   []string
+	counters map[string]int
+	guard    *GuardState
+}
+
+func newFlusher(interval time.Duration) *flusher {
+	return &flusher{
+		interval: interval,
+		saved:    make(map[string]int),
+		update:   make(map[string]struct{}),
+		remove:   make(map[string]struct{}),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (f *flusher) mark(update, remove []string) {
+	f.pending.Lock()
+	defer f.pending.Unlock()
+
+	for _, name := range update {
+		delete(f.remove, name)
+		f.update[name] = struct{}{}
+	}
+
+	for _, name := range remove {
+		delete(f.update, name)
+		f.remove[name] = struct{}{}
+	}
+}
+
+// markGuard marks the state of the mass-withdrawal guard as changed.
+func (f *flusher) markGuard() {
+	f.pending.Lock()
+	f.guard = true
+	f.pending.Unlock()
+}
+
+// retry marks domains of the failed batch again, domains marked after the snapshot are newer and kept as is:
+// otherwise a stale removal would delete the domain added again while the batch was written.
+func (f *flusher) retry(update, remove []string) {
+	f.pending.Lock()
+	defer f.pending.Unlock()
+
+	marked := func(name string) bool {
+		_, updated := f.update[name]
+		_, removed := f.remove[name]
+
+		return updated || removed
+	}
+
+	for _, name := range update {
+		if !marked(name) {
+			f.update[name] = struct{}{}
+		}
+	}
+
+	for _, name := range remove {
+		if !marked(name) {
+			f.remove[name] = struct{}{}
+		}
+	}
+}
+
+// persist marks changed domains and notifies about them, must be called under ipItems lock.
+// Without FlushInterval changes are saved right away, otherwise they are saved by the flush loop.
+func (s *store) persist(update, remove []string) {
+	s.changes.mark(update, remove)
+	s.flusher.mark(update, remove)
+
+	if s.flusher.interval <= 0 {
+		s.save(s.snapshot())
+	}
+}
+
+// snapshot collects pending domains and counters changed since the last flush, must be called under ipItems lock.
+func (s *store) snapshot() batch {
+	s.flusher.pending.Lock()
+	update, remove, guard := s.flusher.update, s.flusher.remove, s.flusher.guard
+	s.flusher.update, s.flusher.remove = make(map[string]struct{}), make(map[string]struct{})
+	s.flusher.guard = false
+	s.flusher.pending.Unlock()
+
+	out := batch{counters: make(map[string]int)}
+	if guard {
+		state := s.guard.state()
+		out.guard = &state
+	}
+
+	for name := range update {
+		if item, ok := s.domains.GetIfPresent(name); ok {
+			out.update = append(out.update, newRecord(item))
+		}
+	}
+
+	for name := range remove {
+		out.remove = append(out.remove, name)
+	}
+
+	for address, counter := range s.ipItems.list {
+		if s.flusher.saved[address] != counter {
+			out.counters[address] = counter
+		}
+	}
+
+	for address := range s.flusher.saved {
+		if _, ok := s.ipItems.list[address]; !ok {
+			out.counters[address] = 0
+		}
+	}
+
+	return out
+}
+
+// save writes the batch, domains of the failed batch are marked again to be saved by the next flush.
+func (s *store) save(item batch) {
+	if item.guard != nil {
+		if err := s.backend.SaveGuard(*item.guard); err != nil {
+			s.Error("could not persist guard", logger.Err(err))
+			s.flusher.markGuard()
+		}
+	}
+
+	if len(item.update) == 0 && len(item.remove) == 0 && len(item.counters) == 0 {
+		return
+	}
+
+	if err := s.backend.Save(item.update, item.remove, item.counters); err != nil {
+		s.Error("could not persist storage", logger.Err(err))
+
+		update := make([]string, 0, len(item.update))
+		for _, rec := range item.update {
+			update = append(update, rec.Domain)
+		}
+
+		s.flusher.retry(update, item.remove)
+
+		return
+	}
+
+	for address, counter := range item.counters {
+		if counter > 0 {
+			s.flusher.saved[address] = counter
+		} else {
+			delete(s.flusher.saved, address)
+		}
+	}
+}
+
+// flush saves pending changes, the backend is written outside ipItems lock.
+func (s *store) flush() {
+	s.flusher.Lock()
+	defer s.flusher.Unlock()
+
+	s.ipItems.RLock()
+	item := s.snapshot()
+	s.ipItems.RUnlock()
+
+	s.save(item)
+}
+
+// runFlusher saves pending changes every FlushInterval until the store is closed.
+func (s *store) runFlusher() {
+	defer close(s.flusher.done)
+
+	ticker := time.NewTicker(s.flusher.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.flusher.stop:
+			return
+		case <-ticker.C:
+			s.flush()
+		}
+	}
+}
+
+// Close saves pending changes and releases the persistent backend, repeated calls return the first result.
+func (s *store) Close() error {
+	s.flusher.closing.Do(func() {
+		if s.flusher.interval > 0 {
+			close(s.flusher.stop)
+			<-s.flusher.done
+
+			s.flush()
+		}
+
+		s.flusher.closed = s.backend.Close()
+	})
+
+	return s.flusher.closed
+}
+
+// restoreSaved remembers counters loaded from the backend as persisted.
+func (s *store) restoreSaved(counters map[string]int) {
+	s.flusher.saved = maps.Clone(counters)
+	if s.flusher.saved == nil {
+		s.flusher.saved = make(map[string]int)
+	}
+}
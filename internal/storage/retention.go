@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/im-kulikov/resolvex/internal/domain"
+)
+
+// retention describes how long addresses that vanished from DNS answers are kept announced.
+type retention struct {
+	// hold keeps an address for the duration after it was last seen
+	hold time.Duration
+	// last keeps at least N most recently seen addresses of the domain
+	last int
+}
+
+// newRetention parses global and per domain retention policies from Config.
+func newRetention(cfg Config) (retention, map[string]retention, error) {
+	global := retention{hold: cfg.Retention, last: cfg.KeepLast}
+	if global.hold < 0 || global.last < 0 {
+		return global, nil, fmt.Errorf("retention should not be negative")
+	}
+
+	domains := make(map[string]retention, len(cfg.DomainRetention))
+	for _, entry := range cfg.DomainRetention {
+		pattern, value, ok := strings.Cut(entry, "=")
+		if pattern, value = domain.Normalize(strings.TrimSpace(pattern)), strings.TrimSpace(value); !ok ||
+			domain.Validate(pattern) != nil {
+			return global, nil, fmt.Errorf("could not parse domain retention %q: expected pattern=policy", entry)
+		}
+
+		policy, ok := domains[pattern]
+		if !ok {
+			policy = global
+		}
+
+		// policy это либо длительность (`6h`), либо количество адресов (`last:3`)
+		if count, found := strings.CutPrefix(value, "last:"); found {
+			num, err := strconv.Atoi(count)
+			if err != nil || num < 0 {
+				return global, nil, fmt.Errorf("could not parse domain retention %q: wrong number of addresses", entry)
+			}
+
+			policy.last = num
+		} else {
+			hold, err := time.ParseDuration(value)
+			if err != nil || hold < 0 {
+				return global, nil, fmt.Errorf("could not parse domain retention %q: wrong duration", entry)
+			}
+
+			policy.hold = hold
+		}
+
+		domains[pattern] = policy
+	}
+
+	return global, domains, nil
+}
+
+// deadline returns when the address seen at the moment should be withdrawn.
+func (r retention) deadline(seen, expires time.Time) time.Time {
+	if hold := seen.Add(r.hold); hold.After(expires) {
+		return hold
+	}
+
+	return expires
+}
+
+// keep splits expired addresses into kept by the number of addresses and released ones,
+// kept is the number of addresses the domain already has.
+func (r retention) keep(expired []string, kept int, seen, ext map[string]time.Time) ([]string, []string) {
+	lastSeen := func(address string) time.Time {
+		if when, ok := seen[address]; ok {
+			return when
+		}
+
+		return ext[address]
+	}
+
+	// сначала самые свежие адреса, при равенстве - по алфавиту, чтобы порядок был стабильным
+	slices.SortFunc(expired, func(a, b string) int {
+		if cmp := lastSeen(b).Compare(lastSeen(a)); cmp != 0 {
+			return cmp
+		}
+
+		return strings.Compare(a, b)
+	})
+
+	count := min(max(r.last-kept, 0), len(expired))
+
+	return expired[:count], expired[count:]
+}
+
+// retentionOf returns the retention policy of the domain: exact match wins, then the closest wildcard.
+func (s *store) retentionOf(name string) retention {
+	if policy, ok := matchPattern(s.retains, name); ok {
+		return policy
+	}
+
+	return s.retain
+}
+
+// holdTimes returns remaining time for addresses that are no longer in DNS answers but still kept,
+// zero means the address is kept by the number of addresses until newer ones replace it.
+func holdTimes(item Item) map[string]time.Duration {
+	var out map[string]time.Duration
+	for address, expires := range item.ext {
+		if when, ok := item.seen[address]; !ok || !when.Before(item.last) {
+			continue
+		}
+
+		if out == nil {
+			out = make(map[string]time.Duration)
+		}
+
+		out[address] = max(time.Until(expires), 0).Truncate(time.Second)
+	}
+
+	return out
+}
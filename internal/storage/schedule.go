@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/im-kulikov/resolvex/internal/domain"
+)
+
+// Schedule describes when the domain should be resolved again.
+// Removed is set when the domain was deleted or should not be resolved at all.
+type Schedule struct {
+	Domain  string
+	Expire  time.Time
+	Removed bool
+}
+
+// changes collects names of changed domains until the resolver takes them.
+type changes struct {
+	sync.Mutex
+
+	names  map[string]struct{}
+	signal chan struct{}
+}
+
+func newChanges() *changes {
+	return &changes{names: make(map[string]struct{}), signal: make(chan struct{}, 1)}
+}
+
+// mark remembers changed domains and wakes up the reader without blocking.
+func (c *changes) mark(lists ...[]string) {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, list := range lists {
+		for _, name := range list {
+			c.names[name] = struct{}{}
+		}
+	}
+
+	if len(c.names) == 0 {
+		return
+	}
+
+	select {
+	case c.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (c *changes) take() map[string]struct{} {
+	c.Lock()
+	defer c.Unlock()
+
+	out := c.names
+	c.names = make(map[string]struct{})
+
+	return out
+}
+
+// Schedules returns refresh times of all resolvable domains, wildcards are skipped.
+func (s *store) Schedules() []Schedule {
+	s.ipItems.RLock()
+	defer s.ipItems.RUnlock()
+
+	var out []Schedule // nolint:prealloc
+	for item := range s.domains.Values() {
+		if domain.IsWildcard(item.Domain) {
+			continue
+		}
+
+		out = append(out, Schedule{Domain: item.Domain, Expire: item.Expire})
+	}
+
+	return out
+}
+
+// Changes returns a channel that receives a signal when domains were added, changed or removed.
+func (s *store) Changes() <-chan struct{} { return s.changes.signal }
+
+// PopChanges returns refresh times of domains changed since the previous call.
+func (s *store) PopChanges() []Schedule {
+	names := s.changes.take()
+	if len(names) == 0 {
+		return nil
+	}
+
+	s.ipItems.RLock()
+	defer s.ipItems.RUnlock()
+
+	out := make([]Schedule, 0, len(names))
+	for name := range names {
+		item, ok := s.domains.GetIfPresent(name)
+		out = append(out, Schedule{Domain: name, Expire: item.Expire, Removed: !ok || domain.IsWildcard(name)})
+	}
+
+	return out
+}
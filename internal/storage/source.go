@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"slices"
+	"time"
+
+	"github.com/im-kulikov/go-bones/logger"
+	"github.com/maypok86/otter/v2"
+
+	"github.com/im-kulikov/resolvex/internal/broadcast"
+)
+
+// Subscribed returns domains that came from the list subscription.
+func (s *store) Subscribed(source string) []string {
+	s.ipItems.RLock()
+	defer s.ipItems.RUnlock()
+
+	var out []string
+	for item := range s.domains.Values() {
+		if slices.Contains(item.Sources, source) {
+			out = append(out, item.Domain)
+		}
+	}
+
+	slices.Sort(out)
+
+	return out
+}
+
+// Subscribe applies changes of the list subscription: added domains remember the source,
+// removed domains forget it and are deleted when no source and no operator keeps them.
+func (s *store) Subscribe(source string, add, remove []string) {
+	s.ipItems.Lock()
+	defer s.ipItems.Unlock()
+
+	var updated, removed []string
+	for _, name := range add {
+		s.domains.Compute(name, func(old Item, found bool) (Item, otter.ComputeOp) {
+			if found && slices.Contains(old.Sources, source) {
+				return old, otter.CancelOp
+			}
+
+			if !found {
+				old = Item{Domain: name, ext: make(map[string]time.Time)}
+			}
+
+			// домен из списка живёт сам по себе, а не как поддомен wildcard или цель CNAME
+			old.Parent = ""
+			old.Sources = append(slices.Clone(old.Sources), source)
+			updated = append(updated, name)
+
+			return old, otter.WriteOp
+		})
+	}
+
+	msg := broadcast.UpdateMessage{Cause: broadcast.CauseSubscription}
+	for _, name := range remove {
+		var drop bool
+		s.domains.Compute(name, func(old Item, found bool) (Item, otter.ComputeOp) {
+			if !found || !slices.Contains(old.Sources, source) {
+				return old, otter.CancelOp
+			}
+
+			old.Sources = slices.DeleteFunc(slices.Clone(old.Sources), func(item string) bool { return item == source })
+			if drop = !old.Manual && len(old.Sources) == 0; !drop {
+				updated = append(updated, name)
+			}
+
+			return old, otter.WriteOp
+		})
+
+		if !drop {
+			continue
+		}
+
+		list, err := s.dropDomain(name, &msg)
+		if err != nil {
+			continue
+		}
+
+		removed = append(removed, list...)
+	}
+
+	if len(msg.ToRemove) > 0 {
+		slices.Sort(msg.ToRemove)
+		s.manager.Broadcast(msg)
+	}
+
+	if len(updated) == 0 && len(removed) == 0 {
+		return
+	}
+
+	s.Info("list subscription applied",
+		logger.String("source", source),
+		logger.Int("updated", len(updated)),
+		logger.Int("removed", len(removed)))
+
+	s.persist(updated, removed)
+
+	if err := s.validate("Subscribe"); err != nil {
+		s.Error("validate failed", logger.Err(err))
+	}
+}
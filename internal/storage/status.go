@@ -0,0 +1,62 @@
+package storage
+
+import "time"
+
+// Response codes of DNS answers that are not failures.
+const (
+	RcodeSuccess   = "NOERROR"
+	RcodeNameError = "NXDOMAIN"
+)
+
+// DNSSEC validation statuses of answers, empty status means that validation is disabled.
+const (
+	DNSSECSecure   = "secure"
+	DNSSECInsecure = "insecure"
+	DNSSECBogus    = "bogus"
+)
+
+// Status describes the last resolution of the domain.
+type Status struct {
+	// Rcode contains the last response code, e.g. NOERROR, NXDOMAIN or SERVFAIL
+	Rcode string `json:"rcode,omitempty"`
+	// Error contains the last error of the request, e.g. timeout
+	Error string `json:"error,omitempty"`
+	// Failures is the number of consecutive failed resolutions, negative answers are failures too
+	Failures int `json:"failures,omitempty"`
+	// Success is the last time the domain was resolved
+	Success time.Time `json:"success,omitzero"`
+	// Disagreement describes different answers of servers, nil when servers agree
+	Disagreement *Disagreement `json:"disagreement,omitempty"`
+	// DNSSEC contains the validation status of the last answer: secure, insecure or bogus
+	DNSSEC string `json:"dnssec,omitempty"`
+}
+
+// Disagreement describes different answers of servers for the domain.
+type Disagreement struct {
+	// Answers contains addresses returned by every server that answered
+	Answers map[string][]string `json:"answers"`
+	// Rejected contains addresses dropped by the consensus policy
+	Rejected []string `json:"rejected,omitempty"`
+}
+
+func (s Status) failed(rec PublishItem) Status {
+	s.Rcode, s.Error, s.Disagreement, s.DNSSEC = rec.Rcode, rec.Error, rec.Disagreement, rec.DNSSEC
+	s.Failures++
+
+	return s
+}
+
+func (s Status) answered(rec PublishItem, now time.Time) Status {
+	if rec.Rcode == RcodeNameError {
+		return s.failed(rec)
+	}
+
+	s.Rcode, s.Error, s.Disagreement, s.DNSSEC = rec.Rcode, "", rec.Disagreement, rec.DNSSEC
+	if s.Rcode == "" {
+		s.Rcode = RcodeSuccess
+	}
+
+	s.Failures, s.Success = 0, now
+
+	return s
+}
@@ -2,6 +2,9 @@ package storage
 
 import (
 	"fmt"
+	"io"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -11,15 +14,29 @@ import (
 	"github.com/maypok86/otter/v2"
 
 	"github.com/im-kulikov/resolvex/internal/broadcast"
+	"github.com/im-kulikov/resolvex/internal/domain"
 )
 
 // Item represents a structure used for associating domains with IP addresses and their expiration times.
 type Item struct {
-	ext map[string]time.Time
+	ext  map[string]time.Time // address => withdrawal deadline
+	seen map[string]time.Time // address => last time the address was in a DNS answer
+	last time.Time            // last time the domain was published
 
 	Domain string
+	Parent string
 	Record []string
 	Expire time.Time
+	// Chain contains CNAME chain of the last answer, starting from the domain itself.
+	Chain []string
+	// Status describes the last resolution of the domain.
+	Status Status
+	// Hold contains remaining time of addresses that vanished from DNS answers but are kept by retention policy.
+	Hold map[string]time.Duration
+	// Manual is set for domains added by the operator, synchronization of lists never removes them.
+	Manual bool
+	// Sources contains names of list subscriptions the domain came from.
+	Sources []string
 }
 
 // Repository is a composite interface that combines the functionalities of BGP, API, and DNS interfaces.
@@ -27,6 +44,32 @@ type Repository interface {
 	BGP
 	API
 	DNS
+
+	io.Closer
+}
+
+// Config describes storage settings, when Path is empty all data lives only in memory.
+// Groups assigns route groups to domains, entries have `pattern=group` format,
+// where pattern is a domain or a wildcard, e.g. `*.example.com=cdn`.
+// Retention keeps vanished addresses for the duration after they were last seen,
+// KeepLast keeps at least N most recently seen addresses of every domain.
+// DomainRetention overrides them per domain, entries have `pattern=policy` format,
+// where policy is a duration or a number of addresses, e.g. `*.example.com=12h`, `example.com=last:3`.
+type Config struct {
+	Path   string   `env:"PATH"`
+	Groups []string `env:"GROUPS"`
+
+	Retention       time.Duration `env:"RETENTION"`
+	KeepLast        int           `env:"KEEP_LAST"`
+	DomainRetention []string      `env:"DOMAIN_RETENTION"`
+
+	Guard GuardConfig `env:"GUARD"`
+
+	// TrackCNAME adds every CNAME target as a related domain, it is removed together with the domain.
+	TrackCNAME bool `env:"TRACK_CNAME"`
+
+	// FlushInterval batches writes into the backend, changes are written right away when it is zero.
+	FlushInterval time.Duration `env:"FLUSH_INTERVAL" default:"1s"`
 }
 
 // ipStorage represents a thread-safe storage for managing a map of IP addresses and their reference counts.
@@ -42,6 +85,14 @@ type store struct {
 
 	ipItems *ipStorage
 	domains *otter.Cache[string, Item]
+	backend Backend
+	grouped map[string]string // pattern => group
+	retain  retention
+	retains map[string]retention // pattern => retention
+	guard   *guard
+	tracked bool
+	changes *changes
+	flusher *flusher
 
 	manager broadcast.Broadcaster
 }
@@ -59,8 +110,10 @@ const (
 )
 
 // New creates and initializes a new Repository with the provided logger, broadcaster, and a list of domains.
+// Persisted domains are restored first, then missing domains from the list are added.
 // Returns the initialized Repository or an error if the initialization fails.
 func New(
+	cfg Config,
 	log *logger.Logger,
 	manager broadcast.Broadcaster,
 	domains []string,
@@ -75,21 +128,162 @@ func New(
 		o(&opts)
 	}
 
+	grouped := make(map[string]string, len(cfg.Groups))
+	for _, entry := range cfg.Groups {
+		pattern, group, ok := strings.Cut(entry, "=")
+		if pattern, group = domain.Normalize(strings.TrimSpace(pattern)), strings.TrimSpace(group); !ok ||
+			group == "" || domain.Validate(pattern) != nil {
+			return nil, fmt.Errorf("could not parse domain group %q: expected pattern=group", entry)
+		}
+
+		grouped[pattern] = group
+	}
+
+	retain, retains, err := newRetention(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	var res *otter.Cache[string, Item]
 	if res, err = otter.New(&opts); err != nil {
 		return nil, fmt.Errorf("could not create Domain storage: %w", err)
 	}
 
-	for _, domain := range domains {
-		res.Set(domain, Item{Domain: domain, ext: make(map[string]time.Time)})
+	var backend Backend = memoryBackend{}
+	if cfg.Path != "" {
+		if backend, err = NewBoltBackend(cfg.Path); err != nil {
+			return nil, err
+		}
 	}
 
-	return &store{
+	svc := &store{
 		Logger:  out,
 		ipItems: ips,
 		domains: res,
+		backend: backend,
+		grouped: grouped,
+		retain:  retain,
+		retains: retains,
+		guard:   newGuard(cfg.Guard),
+		tracked: cfg.TrackCNAME,
+		changes: newChanges(),
+		flusher: newFlusher(cfg.FlushInterval),
 		manager: manager,
-	}, nil
+	}
+
+	if err = svc.restore(domains); err != nil {
+		_ = backend.Close()
+
+		return nil, err
+	}
+
+	if cfg.FlushInterval > 0 {
+		go svc.runFlusher()
+	}
+
+	return svc, nil
+}
+
+// restore loads persisted domains and counters, adds missing domains and announces restored addresses.
+func (s *store) restore(domains []string) error {
+	records, counters, err := s.backend.Load()
+	if err != nil {
+		return err
+	}
+
+	for _, rec := range records {
+		s.domains.Set(rec.Domain, rec.item())
+	}
+
+	for address, counter := range counters {
+		s.ipItems.list[address] = counter
+	}
+
+	s.restoreSaved(counters)
+
+	state, err := s.backend.LoadGuard()
+	if err != nil {
+		return err
+	}
+
+	switch s.guard.restore(state); {
+	case !s.guard.since.IsZero():
+		s.Warn("mass-withdrawal alert restored, withdrawals are frozen",
+			logger.Int("withheld", len(state.Withheld)))
+	case !state.Since.IsZero():
+		// защита выключена, сохранённая тревога больше не нужна
+		s.flusher.markGuard()
+	}
+
+	var added []string
+	for _, domain := range domains {
+		if _, ok := s.domains.GetIfPresent(domain); ok {
+			continue
+		}
+
+		added = append(added, domain)
+		s.domains.Set(domain, Item{Domain: domain, Manual: true, ext: make(map[string]time.Time)})
+	}
+
+	if len(records) > 0 {
+		s.Info("storage restored",
+			logger.Int("domains", len(records)),
+			logger.Int("addresses", len(counters)))
+	}
+
+	if err = s.validate("Restore"); err != nil {
+		s.Error("validate failed", logger.Err(err))
+	}
+
+	// удержанные защитой адреса не отозваны, поэтому после рестарта они анонсируются снова
+	if list := append(s.getIPList(), s.guard.status().Withheld...); len(list) > 0 {
+		slices.Sort(list)
+
+		msg := broadcast.UpdateMessage{Cause: broadcast.CauseRestore, ToUpdate: list}
+		for item := range s.domains.Values() {
+			for address := range item.ext {
+				if _, ok := msg.Groups[address]; !ok {
+					msg.SetGroup(address, s.groupOf(item.Domain))
+				}
+			}
+		}
+
+		s.manager.Broadcast(msg)
+	}
+
+	s.persist(added, nil)
+
+	return nil
+}
+
+// groupOf returns the route group of the domain: exact match wins, then the closest wildcard.
+func (s *store) groupOf(name string) string {
+	group, _ := matchPattern(s.grouped, name)
+
+	return group
+}
+
+// matchPattern returns the value of the domain pattern: exact match wins, then the closest wildcard.
+func matchPattern[T any](patterns map[string]T, name string) (T, bool) {
+	if len(patterns) == 0 {
+		var empty T
+
+		return empty, false
+	}
+
+	if value, ok := patterns[name]; ok {
+		return value, true
+	}
+
+	for _, pattern := range domain.Wildcards(name) {
+		if value, ok := patterns[pattern]; ok {
+			return value, true
+		}
+	}
+
+	var empty T
+
+	return empty, false
 }
 
 func (s *store) validate(where any) error {
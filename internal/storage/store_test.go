@@ -3,8 +3,10 @@ package storage
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"maps"
 	"net"
+	"path/filepath"
 	"slices"
 	"testing"
 	"time"
@@ -31,10 +33,10 @@ func TestStore_Delete(t *testing.T) {
 	manager := new(testBroadcaster)
 
 	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
-	svc, err := New(log, manager, domains)
+	svc, err := New(Config{}, log, manager, domains)
 	require.NoError(t, err)
 	require.ElementsMatch(t, domains, svc.AllDomains())
-	require.ElementsMatch(t, domains, svc.ExpiredDomains())
+	require.ElementsMatch(t, domains, expiredDomains(svc))
 	require.Empty(t, svc.IPsList())
 
 	require.ErrorIs(t, svc.Delete("google.com"), ErrNotFound)
@@ -63,10 +65,10 @@ func TestStore_Update(t *testing.T) {
 	manager := new(testBroadcaster)
 
 	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
-	svc, err := New(log, manager, domains)
+	svc, err := New(Config{}, log, manager, domains)
 	require.NoError(t, err)
 	require.ElementsMatch(t, domains, svc.AllDomains())
-	require.ElementsMatch(t, domains, svc.ExpiredDomains())
+	require.ElementsMatch(t, domains, expiredDomains(svc))
 	require.Empty(t, svc.IPsList())
 
 	require.ErrorIs(t, svc.Update("google.com", "www.google.com"), ErrNotFound)
@@ -77,10 +79,10 @@ func TestStore_List(t *testing.T) {
 	manager := new(testBroadcaster)
 
 	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
-	svc, err := New(log, manager, domains)
+	svc, err := New(Config{}, log, manager, domains)
 	require.NoError(t, err)
 	require.ElementsMatch(t, domains, svc.AllDomains())
-	require.ElementsMatch(t, domains, svc.ExpiredDomains())
+	require.ElementsMatch(t, domains, expiredDomains(svc))
 	require.Empty(t, svc.IPsList())
 
 	require.NoError(t, svc.Create("google.com"))
@@ -92,7 +94,7 @@ func TestStore_List(t *testing.T) {
 
 		break
 	}
-	require.ElementsMatch(t, domains, svc.ExpiredDomains())
+	require.ElementsMatch(t, domains, expiredDomains(svc))
 }
 
 func Test_storage(t *testing.T) {
@@ -102,10 +104,10 @@ func Test_storage(t *testing.T) {
 	domains = append(domains, "www.google.com")
 
 	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
-	svc, err := New(log, manager, domains)
+	svc, err := New(Config{}, log, manager, domains)
 	require.NoError(t, err)
 	require.ElementsMatch(t, domains, svc.AllDomains())
-	require.ElementsMatch(t, domains, svc.ExpiredDomains())
+	require.ElementsMatch(t, domains, expiredDomains(svc))
 	require.Empty(t, svc.IPsList())
 
 	// проверяем простое удаление
@@ -114,7 +116,7 @@ func Test_storage(t *testing.T) {
 
 		require.NoError(t, svc.Delete(domains[0]))
 		require.Empty(t, svc.AllDomains())
-		require.Empty(t, svc.ExpiredDomains())
+		require.Empty(t, expiredDomains(svc))
 
 		manager.AssertExpectations(t)
 	})
@@ -126,7 +128,7 @@ func Test_storage(t *testing.T) {
 		require.NoError(t, svc.Create("google.com"))
 		require.Empty(t, svc.IPsList())
 		require.ElementsMatch(t, []string{"google.com"}, svc.AllDomains())
-		require.ElementsMatch(t, []string{"google.com"}, svc.ExpiredDomains())
+		require.ElementsMatch(t, []string{"google.com"}, expiredDomains(svc))
 
 		// во второй раз - ошибка
 		require.ErrorIs(t, svc.Create("google.com"), ErrExist)
@@ -149,7 +151,7 @@ func Test_storage(t *testing.T) {
 		})
 		require.Empty(t, svc.IPsList())
 		require.ElementsMatch(t, []string{"google.com"}, svc.AllDomains())
-		require.ElementsMatch(t, []string{"google.com"}, svc.ExpiredDomains())
+		require.ElementsMatch(t, []string{"google.com"}, expiredDomains(svc))
 
 		manager.AssertExpectations(t)
 	})
@@ -175,7 +177,7 @@ func Test_storage(t *testing.T) {
 			})
 		})
 		require.ElementsMatch(t, []string{"127.0.0.1", "127.0.0.2"}, svc.IPsList())
-		require.Empty(t, svc.ExpiredDomains())
+		require.Empty(t, expiredDomains(svc))
 		require.ElementsMatch(t, []string{"google.com"}, svc.AllDomains())
 
 		manager.AssertExpectations(t)
@@ -193,7 +195,7 @@ func Test_storage(t *testing.T) {
 
 		require.Empty(t, svc.IPsList())
 		require.ElementsMatch(t, []string{"www.google.com"}, svc.AllDomains())
-		require.ElementsMatch(t, []string{"www.google.com"}, svc.ExpiredDomains())
+		require.ElementsMatch(t, []string{"www.google.com"}, expiredDomains(svc))
 
 		manager.On("Broadcast",
 			broadcast.UpdateMessage{
@@ -224,7 +226,7 @@ func Test_storage(t *testing.T) {
 
 		require.NotPanics(t, func() { require.NoError(t, svc.Delete("www.google.com")) })
 		require.Empty(t, svc.AllDomains())
-		require.Empty(t, svc.ExpiredDomains())
+		require.Empty(t, expiredDomains(svc))
 		require.Empty(t, svc.IPsList())
 
 		manager.AssertExpectations(t)
@@ -244,13 +246,25 @@ func Test_shouldFail(t *testing.T) {
 	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
 	require.Error(
 		t,
-		bones.ExtractError(New(log, manager, domains, func(o *otter.Options[string, Item]) {
+		bones.ExtractError(New(Config{}, log, manager, domains, func(o *otter.Options[string, Item]) {
 			o.MaximumSize = 1
 			o.MaximumWeight = 1
 		})),
 	)
 }
 
+// expiredDomains returns domains the resolver should refresh right now.
+func expiredDomains(svc DNS) []string {
+	var out []string
+	for _, item := range svc.Schedules() {
+		if time.Until(item.Expire) <= 0 {
+			out = append(out, item.Domain)
+		}
+	}
+
+	return out
+}
+
 func getOutdated(ips map[string]time.Time) []string {
 	out := make([]string, 0, len(ips))
 	for address, expires := range ips {
@@ -275,12 +289,12 @@ func Test_publishSuccess(t *testing.T) {
 
 	buf := new(bytes.Buffer)
 	log := logger.ForTests(logger.TestLoggerWriteToTB(t), logger.TestLoggerWriter(buf))
-	svc, err := New(log, manager, domains)
+	svc, err := New(Config{}, log, manager, domains)
 	require.NoError(t, err)
 
 	require.NoError(t, svc.Create("google.com"))
 	require.ElementsMatch(t, []string{"google.com"}, svc.AllDomains())
-	require.ElementsMatch(t, []string{"google.com"}, svc.ExpiredDomains())
+	require.ElementsMatch(t, []string{"google.com"}, expiredDomains(svc))
 
 	now := time.Now()
 	ips := make(map[string]time.Time)
@@ -374,3 +388,741 @@ func Test_publishSuccess(t *testing.T) {
 	require.NoError(t, svc.(*store).validate("test"))
 	manager.AssertExpectations(t)
 }
+
+func TestStore_Restore(t *testing.T) {
+	manager := new(testBroadcaster)
+	manager.Test(t)
+
+	cfg := Config{Path: filepath.Join(t.TempDir(), "store.db")}
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	svc, err := New(cfg, log, manager, []string{"google.com"})
+	require.NoError(t, err)
+
+	require.NoError(t, svc.Create("example.com"))
+	svc.Subscribe("ads", []string{"example.org"}, nil)
+
+	now := time.Now().Add(time.Hour)
+	manager.On("Broadcast",
+		broadcast.UpdateMessage{
+			Cause:    broadcast.CauseDNSPublish,
+			ToUpdate: []string{"127.0.0.1"},
+		}).Once()
+
+	svc.Publish([]PublishItem{{
+		Domain: "example.com",
+		Expire: now,
+		Record: map[string]time.Time{"127.0.0.1": now},
+	}})
+	require.NoError(t, svc.Close())
+
+	manager.On("Broadcast",
+		broadcast.UpdateMessage{
+			Cause:    broadcast.CauseRestore,
+			ToUpdate: []string{"127.0.0.1"},
+		}).Once()
+
+	svc, err = New(cfg, log, manager, nil)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"google.com", "example.com", "example.org"}, svc.AllDomains())
+	require.ElementsMatch(t, []string{"google.com", "example.org"}, expiredDomains(svc))
+	require.Equal(t, []string{"example.org"}, svc.Subscribed("ads"))
+	require.ElementsMatch(t, []string{"127.0.0.1"}, svc.IPsList())
+	require.NoError(t, svc.(*store).validate("test"))
+	require.NoError(t, svc.Close())
+
+	manager.AssertExpectations(t)
+}
+
+type saveCall struct {
+	update   []string
+	remove   []string
+	counters map[string]int
+}
+
+type testBackend struct {
+	memoryBackend
+
+	saves  []saveCall
+	fail   bool
+	closed int
+}
+
+func (b *testBackend) Save(update []Record, remove []string, counters map[string]int) error {
+	if b.fail {
+		return errors.New("disk is full")
+	}
+
+	call := saveCall{remove: remove, counters: counters}
+	for _, rec := range update {
+		call.update = append(call.update, rec.Domain)
+	}
+
+	b.saves = append(b.saves, call)
+
+	return nil
+}
+
+func (b *testBackend) Close() error {
+	b.closed++
+
+	return nil
+}
+
+func TestStore_Persist(t *testing.T) {
+	manager := new(testBroadcaster)
+	manager.Test(t)
+	manager.On("Broadcast", mock.Anything)
+
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	now := time.Now().Add(time.Hour)
+	publish := func(svc Repository, name, address string) {
+		svc.Publish([]PublishItem{{Domain: name, Expire: now, Record: map[string]time.Time{address: now}}})
+	}
+
+	// без интервала пишутся только изменённые домены и счётчики
+	svc, err := New(Config{}, log, manager, []string{"a.com", "b.com"})
+	require.NoError(t, err)
+
+	backend := new(testBackend)
+	svc.(*store).backend = backend
+
+	publish(svc, "a.com", "10.0.0.1")
+	publish(svc, "b.com", "10.0.0.2")
+	require.NoError(t, svc.Delete("a.com"))
+	require.Equal(t, []saveCall{
+		{update: []string{"a.com"}, counters: map[string]int{"10.0.0.1": 1}},
+		{update: []string{"b.com"}, counters: map[string]int{"10.0.0.2": 1}},
+		{remove: []string{"a.com"}, counters: map[string]int{"10.0.0.1": 0}},
+	}, backend.saves)
+
+	// с интервалом изменения копятся и пишутся одной транзакцией
+	svc, err = New(Config{FlushInterval: time.Hour}, log, manager, []string{"a.com", "b.com"})
+	require.NoError(t, err)
+
+	backend = new(testBackend)
+	svc.(*store).backend = backend
+
+	publish(svc, "a.com", "10.0.0.1")
+	publish(svc, "b.com", "10.0.0.2")
+	require.NoError(t, svc.Create("c.com"))
+	require.Empty(t, backend.saves)
+
+	require.NoError(t, svc.Close())
+	require.Len(t, backend.saves, 1)
+	require.ElementsMatch(t, []string{"a.com", "b.com", "c.com"}, backend.saves[0].update)
+	require.Equal(t, map[string]int{"10.0.0.1": 1, "10.0.0.2": 1}, backend.saves[0].counters)
+
+	// повторный Close не закрывает backend ещё раз
+	require.NoError(t, svc.Close())
+	require.Equal(t, 1, backend.closed)
+
+	// домен добавили снова, пока писался пакет с его удалением: после ошибки удаление не повторяется
+	svc, err = New(Config{FlushInterval: time.Hour}, log, manager, []string{"a.com"})
+	require.NoError(t, err)
+
+	backend = new(testBackend)
+	svc.(*store).backend = backend
+
+	require.NoError(t, svc.Delete("a.com"))
+
+	svc.(*store).ipItems.RLock()
+	item := svc.(*store).snapshot()
+	svc.(*store).ipItems.RUnlock()
+
+	require.NoError(t, svc.Create("a.com"))
+
+	backend.fail = true
+	svc.(*store).save(item)
+
+	backend.fail = false
+	require.NoError(t, svc.Close())
+	require.Equal(t, []saveCall{{update: []string{"a.com"}, counters: map[string]int{}}}, backend.saves)
+}
+
+func TestStore_Wildcard(t *testing.T) {
+	manager := new(testBroadcaster)
+	manager.Test(t)
+
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	svc, err := New(Config{}, log, manager, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, svc.Create("*.example.com"))
+	require.ElementsMatch(t, []string{"*.example.com"}, svc.AllDomains())
+	require.Empty(t, expiredDomains(svc))
+
+	require.ElementsMatch(t,
+		[]string{"www.example.com", "a.b.example.com"},
+		svc.Observe("www.example.com.", "A.B.Example.com", "example.com", "google.com", "www.example.com"))
+	require.ElementsMatch(t, []string{"www.example.com", "a.b.example.com"}, expiredDomains(svc))
+	require.Empty(t, svc.Observe("www.example.com"))
+
+	for item := range svc.List() {
+		if item.Domain != "*.example.com" {
+			require.Equal(t, "*.example.com", item.Parent)
+		}
+	}
+
+	now := time.Now().Add(time.Hour)
+	manager.On("Broadcast",
+		broadcast.UpdateMessage{
+			Cause:    broadcast.CauseDNSPublish,
+			ToUpdate: []string{"127.0.0.1", "127.0.0.2"},
+		}).Once()
+
+	svc.Publish([]PublishItem{
+		{Domain: "www.example.com", Expire: now, Record: map[string]time.Time{"127.0.0.1": now}},
+		{Domain: "a.b.example.com", Expire: now, Record: map[string]time.Time{"127.0.0.2": now}},
+	})
+	require.ElementsMatch(t, []string{"127.0.0.1", "127.0.0.2"}, svc.IPsList())
+
+	manager.On("Broadcast",
+		broadcast.UpdateMessage{
+			Cause:    broadcast.CauseAPIDelete,
+			ToRemove: []string{"127.0.0.1", "127.0.0.2"},
+		}).Once()
+
+	require.NoError(t, svc.Delete("*.example.com"))
+	require.Empty(t, svc.AllDomains())
+	require.Empty(t, svc.IPsList())
+	require.NoError(t, svc.(*store).validate("test"))
+
+	manager.AssertExpectations(t)
+}
+
+func TestStore_CreateNormalize(t *testing.T) {
+	manager := new(testBroadcaster)
+	manager.Test(t)
+
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	svc, err := New(Config{}, log, manager, nil)
+	require.NoError(t, err)
+
+	// имена из API приводятся к тому же виду, что и имена из списков
+	require.NoError(t, svc.Create("*.Example.com."))
+	require.ErrorIs(t, svc.Create("*.example.com"), ErrExist)
+	require.NoError(t, svc.Create("Google.com."))
+	require.ErrorIs(t, svc.Create("google.com"), ErrExist)
+	require.ElementsMatch(t, []string{"*.example.com", "google.com"}, svc.AllDomains())
+
+	require.Equal(t, []string{"www.example.com"}, svc.Covered("WWW.example.com."))
+	require.Equal(t, []string{"google.com"}, svc.Managed("google.com"))
+
+	require.NoError(t, svc.Update("GOOGLE.com", "Example.org."))
+	require.NoError(t, svc.Delete("*.EXAMPLE.com"))
+	require.Equal(t, []string{"example.org"}, svc.AllDomains())
+
+	manager.AssertExpectations(t)
+}
+
+func TestStore_Groups(t *testing.T) {
+	manager := new(testBroadcaster)
+	manager.Test(t)
+
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	_, err := New(Config{Groups: []string{"wrong"}}, log, manager, nil)
+	require.Error(t, err)
+
+	svc, err := New(Config{Groups: []string{"*.example.com=cdn", "www.example.com=web"}}, log, manager, nil)
+	require.NoError(t, err)
+
+	now := time.Now().Add(time.Hour)
+	manager.On("Broadcast",
+		broadcast.UpdateMessage{
+			Cause:    broadcast.CauseDNSPublish,
+			ToUpdate: []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"},
+			Groups:   map[string]string{"127.0.0.1": "web", "127.0.0.2": "cdn"},
+		}).Once()
+
+	svc.Publish([]PublishItem{
+		{Domain: "www.example.com", Expire: now, Record: map[string]time.Time{"127.0.0.1": now}},
+		{Domain: "api.example.com", Expire: now, Record: map[string]time.Time{"127.0.0.2": now}},
+		{Domain: "google.com", Expire: now, Record: map[string]time.Time{"127.0.0.3": now}},
+	})
+
+	manager.AssertExpectations(t)
+}
+
+func TestStore_Retention(t *testing.T) {
+	manager := new(testBroadcaster)
+	manager.Test(t)
+
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	for _, wrong := range []string{"wrong", "example.com=wrong", "example.com=last:-1"} {
+		_, err := New(Config{DomainRetention: []string{wrong}}, log, manager, nil)
+		require.Error(t, err, wrong)
+	}
+
+	svc, err := New(Config{KeepLast: 2, DomainRetention: []string{"*.hold.com=1h"}}, log, manager, nil)
+	require.NoError(t, err)
+
+	hold := func(name string) map[string]time.Duration {
+		for item := range svc.List() {
+			if item.Domain == name {
+				return item.Hold
+			}
+		}
+
+		return nil
+	}
+
+	soon, later := time.Now().Add(20*time.Millisecond), time.Now().Add(time.Hour)
+
+	t.Run("keep last", func(t *testing.T) {
+		manager.On("Broadcast", broadcast.UpdateMessage{
+			Cause:    broadcast.CauseDNSPublish,
+			ToUpdate: []string{"127.0.0.1"},
+		}).Once()
+		svc.Publish([]PublishItem{{Domain: "keep.com", Expire: later, Record: map[string]time.Time{"127.0.0.1": soon}}})
+
+		time.Sleep(time.Until(soon))
+
+		// адрес протух, но остаётся, потому что у домена меньше двух адресов
+		manager.On("Broadcast", broadcast.UpdateMessage{
+			Cause:    broadcast.CauseDNSPublish,
+			ToUpdate: []string{"127.0.0.2"},
+		}).Once()
+		svc.Publish([]PublishItem{{Domain: "keep.com", Expire: later, Record: map[string]time.Time{"127.0.0.2": later}}})
+		require.Equal(t, map[string]time.Duration{"127.0.0.1": 0}, hold("keep.com"))
+
+		// более новый адрес вытесняет самый старый
+		manager.On("Broadcast", broadcast.UpdateMessage{
+			Cause:    broadcast.CauseDNSPublish,
+			ToUpdate: []string{"127.0.0.3"},
+			ToRemove: []string{"127.0.0.1"},
+		}).Once()
+		svc.Publish([]PublishItem{{Domain: "keep.com", Expire: later, Record: map[string]time.Time{"127.0.0.3": later}}})
+
+		left := hold("keep.com")
+		require.Len(t, left, 1)
+		require.Greater(t, left["127.0.0.2"], 59*time.Minute)
+	})
+
+	t.Run("hold after last seen", func(t *testing.T) {
+		soon = time.Now().Add(20 * time.Millisecond)
+
+		manager.On("Broadcast", broadcast.UpdateMessage{
+			Cause:    broadcast.CauseDNSPublish,
+			ToUpdate: []string{"127.0.1.1", "127.0.1.2", "127.0.1.3"},
+		}).Once()
+		svc.Publish([]PublishItem{{Domain: "cdn.hold.com", Expire: later, Record: map[string]time.Time{
+			"127.0.1.1": soon,
+			"127.0.1.2": soon,
+			"127.0.1.3": soon,
+		}}})
+
+		time.Sleep(time.Until(soon))
+
+		// все адреса пропали из ответа, но удерживаются час с момента, когда их видели
+		svc.Publish([]PublishItem{{Domain: "cdn.hold.com", Expire: later}})
+
+		left := hold("cdn.hold.com")
+		require.Len(t, left, 3)
+		for _, remain := range left {
+			require.Greater(t, remain, 59*time.Minute)
+		}
+	})
+
+	manager.AssertExpectations(t)
+}
+
+func TestStore_Guard(t *testing.T) {
+	manager := new(testBroadcaster)
+	manager.Test(t)
+
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	svc, err := New(Config{Guard: GuardConfig{Share: 0.5, Window: time.Minute, Minimum: 2}}, log, manager, nil)
+	require.NoError(t, err)
+
+	names := []string{"a.com", "b.com", "c.com"}
+	addresses := map[string]string{"a.com": "127.0.2.1", "b.com": "127.0.2.2", "c.com": "127.0.2.3", "d.com": "127.0.2.4"}
+	later := time.Now().Add(time.Hour)
+
+	publish := func(expires time.Time, names ...string) {
+		items := make([]PublishItem, 0, len(names))
+		for _, name := range names {
+			item := PublishItem{Domain: name, Expire: later}
+			if !expires.IsZero() {
+				item.Record = map[string]time.Time{addresses[name]: expires}
+			}
+
+			items = append(items, item)
+		}
+
+		svc.Publish(items)
+	}
+
+	manager.On("Broadcast", broadcast.UpdateMessage{
+		Cause:    broadcast.CauseDNSPublish,
+		ToUpdate: []string{"127.0.2.4"},
+	}).Once()
+	publish(later, "d.com")
+
+	// все адреса пропадают разом - отзыв замораживается
+	disappear := func() {
+		manager.On("Broadcast", broadcast.UpdateMessage{
+			Cause:    broadcast.CauseDNSPublish,
+			ToUpdate: []string{"127.0.2.1", "127.0.2.2", "127.0.2.3"},
+		}).Once()
+
+		soon := time.Now().Add(20 * time.Millisecond)
+		publish(soon, names...)
+		time.Sleep(time.Until(soon))
+
+		publish(time.Time{}, names...)
+
+		status := svc.Guard()
+		require.True(t, status.Alert)
+		require.Equal(t, []string{"127.0.2.1", "127.0.2.2", "127.0.2.3"}, status.Withheld)
+	}
+
+	t.Run("acknowledge", func(t *testing.T) {
+		disappear()
+
+		manager.On("Broadcast", broadcast.UpdateMessage{
+			Cause:    broadcast.CauseGuardRelease,
+			ToRemove: []string{"127.0.2.1", "127.0.2.2", "127.0.2.3"},
+		}).Once()
+		require.True(t, svc.Acknowledge())
+		require.False(t, svc.Acknowledge())
+		require.False(t, svc.Guard().Alert)
+	})
+
+	t.Run("condition clears", func(t *testing.T) {
+		disappear()
+
+		// адрес вернулся, оставшиеся укладываются в допустимую долю и отзываются
+		manager.On("Broadcast", broadcast.UpdateMessage{
+			Cause:    broadcast.CauseDNSPublish,
+			ToUpdate: []string{"127.0.2.1"},
+			ToRemove: []string{"127.0.2.2", "127.0.2.3"},
+		}).Once()
+		publish(later, "a.com")
+		require.Equal(t, GuardStatus{}, svc.Guard())
+	})
+
+	manager.AssertExpectations(t)
+}
+
+func TestStore_GuardRestore(t *testing.T) {
+	manager := new(testBroadcaster)
+	manager.Test(t)
+
+	// удержанные адреса анонсируются после рестарта вместе с остальными
+	manager.On("Broadcast", broadcast.UpdateMessage{
+		Cause:    broadcast.CauseRestore,
+		ToUpdate: []string{"127.0.2.1", "127.0.2.2", "127.0.2.3", "127.0.2.4"},
+	}).Once()
+	manager.On("Broadcast", broadcast.UpdateMessage{
+		Cause:    broadcast.CauseGuardRelease,
+		ToRemove: []string{"127.0.2.1", "127.0.2.2", "127.0.2.3"},
+	}).Once()
+	manager.On("Broadcast", broadcast.UpdateMessage{
+		Cause:    broadcast.CauseRestore,
+		ToUpdate: []string{"127.0.2.4"},
+	}).Once()
+	manager.On("Broadcast", mock.Anything)
+
+	cfg := Config{
+		Path:  filepath.Join(t.TempDir(), "store.db"),
+		Guard: GuardConfig{Share: 0.5, Window: time.Minute, Minimum: 2},
+	}
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	svc, err := New(cfg, log, manager, nil)
+	require.NoError(t, err)
+
+	later, soon := time.Now().Add(time.Hour), time.Now().Add(20*time.Millisecond)
+	publish := func(expires time.Time, name, address string) {
+		svc.Publish([]PublishItem{{Domain: name, Expire: later, Record: map[string]time.Time{address: expires}}})
+	}
+
+	publish(later, "d.com", "127.0.2.4")
+	publish(soon, "a.com", "127.0.2.1")
+	publish(soon, "b.com", "127.0.2.2")
+	publish(soon, "c.com", "127.0.2.3")
+	time.Sleep(time.Until(soon))
+
+	svc.Publish([]PublishItem{{Domain: "a.com", Expire: later}, {Domain: "b.com", Expire: later}, {Domain: "c.com", Expire: later}})
+
+	status := svc.Guard()
+	require.True(t, status.Alert)
+	require.NoError(t, svc.Close())
+
+	// рестарт не снимает тревогу
+	svc, err = New(cfg, log, manager, nil)
+	require.NoError(t, err)
+	require.Equal(t, status.Withheld, svc.Guard().Withheld)
+	require.True(t, svc.Guard().Since.Equal(status.Since))
+
+	require.True(t, svc.Acknowledge())
+	require.NoError(t, svc.Close())
+
+	svc, err = New(cfg, log, manager, nil)
+	require.NoError(t, err)
+	require.Equal(t, GuardStatus{}, svc.Guard())
+	require.NoError(t, svc.Close())
+
+	manager.AssertExpectations(t)
+}
+
+func TestStore_TrackCNAME(t *testing.T) {
+	manager := new(testBroadcaster)
+	manager.Test(t)
+
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	svc, err := New(Config{TrackCNAME: true}, log, manager, []string{"www.example.com"})
+	require.NoError(t, err)
+
+	later := time.Now().Add(time.Hour)
+	chain := []string{"www.example.com", "edge.cdn.net", "edge.akamai.net"}
+
+	manager.On("Broadcast", broadcast.UpdateMessage{
+		Cause:    broadcast.CauseDNSPublish,
+		ToUpdate: []string{"127.0.0.1"},
+	}).Once()
+	svc.Publish([]PublishItem{{
+		Domain: "www.example.com",
+		Expire: later,
+		Record: map[string]time.Time{"127.0.0.1": later},
+		Chain:  chain,
+	}})
+
+	items := make(map[string]Item)
+	for item := range svc.List() {
+		items[item.Domain] = item
+	}
+
+	require.Len(t, items, 3)
+	require.Equal(t, chain, items["www.example.com"].Chain)
+	require.Equal(t, "www.example.com", items["edge.cdn.net"].Parent)
+	require.Equal(t, "www.example.com", items["edge.akamai.net"].Parent)
+	require.ElementsMatch(t, []string{"edge.cdn.net", "edge.akamai.net"}, expiredDomains(svc))
+
+	// связанные домены удаляются вместе с исходным
+	manager.On("Broadcast", broadcast.UpdateMessage{
+		Cause:    broadcast.CauseAPIDelete,
+		ToRemove: []string{"127.0.0.1"},
+	}).Once()
+	require.NoError(t, svc.Delete("www.example.com"))
+	require.Empty(t, svc.AllDomains())
+
+	manager.AssertExpectations(t)
+}
+
+func TestStore_DeleteDescendants(t *testing.T) {
+	manager := new(testBroadcaster)
+	manager.Test(t)
+	manager.On("Broadcast", mock.Anything)
+
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	svc, err := New(Config{TrackCNAME: true}, log, manager, []string{"*.example.com"})
+	require.NoError(t, err)
+
+	svc.Observe("www.example.com")
+
+	later := time.Now().Add(time.Hour)
+	svc.Publish([]PublishItem{{
+		Domain: "www.example.com",
+		Expire: later,
+		Record: map[string]time.Time{"127.0.0.1": later},
+		Chain:  []string{"www.example.com", "edge.cdn.net"},
+	}})
+	require.ElementsMatch(t, []string{"*.example.com", "www.example.com", "edge.cdn.net"}, svc.AllDomains())
+
+	// цель CNAME поддомена не остаётся без родителя после удаления шаблона
+	require.NoError(t, svc.Delete("*.example.com"))
+	require.Empty(t, svc.AllDomains())
+	require.Empty(t, svc.IPsList())
+}
+
+func TestStore_Status(t *testing.T) {
+	manager := new(testBroadcaster)
+	manager.Test(t)
+
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	svc, err := New(Config{}, log, manager, []string{"example.com"})
+	require.NoError(t, err)
+
+	later := time.Now().Add(time.Hour)
+	status := func() Item {
+		for item := range svc.List() {
+			return item
+		}
+
+		return Item{}
+	}
+
+	manager.On("Broadcast", broadcast.UpdateMessage{
+		Cause:    broadcast.CauseDNSPublish,
+		ToUpdate: []string{"127.0.0.1"},
+	}).Once()
+	svc.Publish([]PublishItem{{
+		Domain: "example.com",
+		Expire: later,
+		Record: map[string]time.Time{"127.0.0.1": later},
+		Rcode:  RcodeSuccess,
+	}})
+
+	success := status().Status.Success
+	require.Equal(t, Status{Rcode: RcodeSuccess, Success: success}, status().Status)
+
+	// ошибка не трогает адреса, но откладывает следующую попытку
+	retry := time.Now().Add(time.Minute)
+	svc.Publish([]PublishItem{{Domain: "example.com", Expire: retry, Error: "timeout"}})
+	require.Equal(t, Status{Error: "timeout", Failures: 1, Success: success}, status().Status)
+	require.Equal(t, []string{"127.0.0.1"}, status().Record)
+	require.Equal(t, retry, status().Expire)
+
+	svc.Publish([]PublishItem{{Domain: "example.com", Expire: retry, Rcode: RcodeNameError}})
+	require.Equal(t, Status{Rcode: RcodeNameError, Failures: 2, Success: success}, status().Status)
+
+	disagreement := &Disagreement{
+		Answers:  map[string][]string{"a": {"127.0.0.1"}, "b": {"127.0.0.1", "127.0.0.6"}},
+		Rejected: []string{"127.0.0.6"},
+	}
+	svc.Publish([]PublishItem{{
+		Domain:       "example.com",
+		Expire:       later,
+		Record:       map[string]time.Time{"127.0.0.1": later},
+		Disagreement: disagreement,
+		DNSSEC:       DNSSECSecure,
+	}})
+	require.Zero(t, status().Status.Failures)
+	require.True(t, status().Status.Success.After(success))
+	require.Equal(t, disagreement, status().Status.Disagreement)
+	require.Equal(t, DNSSECSecure, status().Status.DNSSEC)
+
+	// ошибка запроса к удалённому домену не возвращает его в список
+	svc.Publish([]PublishItem{{Domain: "deleted.com", Expire: retry, Error: "timeout"}})
+	_, ok := svc.(*store).domains.GetIfPresent("deleted.com")
+	require.False(t, ok)
+
+	manager.AssertExpectations(t)
+}
+
+func TestStore_Changes(t *testing.T) {
+	manager := new(testBroadcaster)
+	manager.Test(t)
+
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	svc, err := New(Config{}, log, manager, []string{"example.com"})
+	require.NoError(t, err)
+
+	// при старте расписание берётся целиком, wildcard не резолвятся
+	require.NoError(t, svc.Create("*.example.com"))
+	require.Equal(t, []Schedule{{Domain: "example.com"}}, svc.Schedules())
+
+	<-svc.Changes()
+	require.ElementsMatch(t, []Schedule{
+		{Domain: "example.com"},
+		{Domain: "*.example.com", Removed: true},
+	}, svc.PopChanges())
+	require.Empty(t, svc.PopChanges())
+
+	later := time.Now().Add(time.Hour)
+	manager.On("Broadcast", mock.Anything).Twice()
+	svc.Publish([]PublishItem{{Domain: "example.com", Expire: later, Record: map[string]time.Time{"127.0.0.1": later}}})
+	require.Equal(t, []string{"www.example.com"}, svc.Observe("www.example.com"))
+
+	<-svc.Changes()
+	require.ElementsMatch(t, []Schedule{
+		{Domain: "example.com", Expire: later},
+		{Domain: "www.example.com"},
+	}, svc.PopChanges())
+
+	require.NoError(t, svc.Update("example.com", "example.org"))
+
+	<-svc.Changes()
+	require.ElementsMatch(t, []Schedule{
+		{Domain: "example.com", Removed: true},
+		{Domain: "example.org"},
+	}, svc.PopChanges())
+
+	manager.AssertExpectations(t)
+}
+
+func TestStore_Snooped(t *testing.T) {
+	manager := new(testBroadcaster)
+	manager.Test(t)
+
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	svc, err := New(Config{}, log, manager, []string{"example.com"})
+	require.NoError(t, err)
+
+	require.NoError(t, svc.Create("*.example.org"))
+	require.Equal(t, []string{"example.com"}, svc.Managed("Example.com.", "www.example.org", "*.example.org", "google.com"))
+
+	later := time.Now().Add(time.Hour)
+	manager.On("Broadcast", broadcast.UpdateMessage{
+		Cause:    broadcast.CauseDNSPublish,
+		ToUpdate: []string{"127.0.0.1"},
+	}).Once()
+	svc.Publish([]PublishItem{{Domain: "example.com", Expire: later, Record: map[string]time.Time{"127.0.0.1": later}}})
+
+	// подсмотренный ответ добавляет адреса, но не меняет расписание и статус
+	manager.On("Broadcast", broadcast.UpdateMessage{
+		Cause:    broadcast.CauseDNSPublish,
+		ToUpdate: []string{"127.0.0.2"},
+	}).Once()
+	svc.Publish([]PublishItem{
+		{Domain: "example.com", Record: map[string]time.Time{"127.0.0.2": later}},
+		{Domain: "google.com", Record: map[string]time.Time{"127.0.0.3": later}},
+	})
+
+	require.ElementsMatch(t, []string{"127.0.0.1", "127.0.0.2"}, svc.IPsList())
+	require.ElementsMatch(t, []string{"example.com", "*.example.org"}, svc.AllDomains())
+
+	for item := range svc.List() {
+		if item.Domain != "example.com" {
+			continue
+		}
+
+		require.Equal(t, later, item.Expire)
+		require.Equal(t, RcodeSuccess, item.Status.Rcode)
+	}
+
+	manager.AssertExpectations(t)
+}
+
+func TestStore_Subscribe(t *testing.T) {
+	manager := new(testBroadcaster)
+	manager.Test(t)
+
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	svc, err := New(Config{}, log, manager, []string{"manual.com"})
+	require.NoError(t, err)
+
+	svc.Subscribe("ads", []string{"manual.com", "a.com", "b.com"}, nil)
+	svc.Subscribe("cdn", []string{"b.com"}, nil)
+	require.Equal(t, []string{"a.com", "b.com", "manual.com"}, svc.Subscribed("ads"))
+	require.Equal(t, []string{"b.com"}, svc.Subscribed("cdn"))
+
+	// домен из списка, добавленный оператором, больше не удаляется синхронизацией
+	require.NoError(t, svc.Create("a.com"))
+	require.ErrorIs(t, svc.Create("manual.com"), ErrExist)
+
+	later := time.Now().Add(time.Hour)
+	manager.On("Broadcast", mock.Anything).Once()
+	svc.Publish([]PublishItem{{Domain: "b.com", Expire: later, Record: map[string]time.Time{"127.0.0.1": later}}})
+
+	svc.Subscribe("ads", nil, []string{"manual.com", "a.com", "b.com"})
+	require.Empty(t, svc.Subscribed("ads"))
+	require.ElementsMatch(t, []string{"manual.com", "a.com", "b.com"}, svc.AllDomains())
+
+	// последний источник удаляет домен вместе с адресами
+	manager.On("Broadcast", broadcast.UpdateMessage{
+		Cause:    broadcast.CauseSubscription,
+		ToRemove: []string{"127.0.0.1"},
+	}).Once()
+
+	svc.Subscribe("cdn", nil, []string{"b.com"})
+	require.ElementsMatch(t, []string{"manual.com", "a.com"}, svc.AllDomains())
+	require.Empty(t, svc.IPsList())
+
+	for item := range svc.List() {
+		require.True(t, item.Manual, item.Domain)
+		require.Empty(t, item.Sources, item.Domain)
+	}
+
+	manager.AssertExpectations(t)
+}
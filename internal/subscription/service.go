@@ -0,0 +1,247 @@
+package subscription
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/im-kulikov/go-bones/logger"
+	"github.com/im-kulikov/go-bones/service"
+
+	"github.com/im-kulikov/resolvex/internal/domain"
+	"github.com/im-kulikov/resolvex/internal/storage"
+)
+
+// Config describes list subscriptions.
+// Sources contains named lists, entries have `name=location` format, where location is HTTP(S) URL,
+// `file://` URL or a local path, e.g. `ads=https://example.com/list.txt`.
+// Interval is the refresh interval of every list, Intervals overrides it per list, entries have `name=duration` format.
+// Format is the syntax of every list (see domain.ParseFormat), Formats overrides it per list,
+// entries have `name=format` format.
+// Cache is the directory for last good copies of lists used when list hosts are unreachable,
+// MaxSize limits every decoded list, Timeout limits fetching of a single list.
+type Config struct {
+	Sources   []string      `env:"SOURCES"`
+	Interval  time.Duration `env:"INTERVAL"  default:"1h"`
+	Intervals []string      `env:"INTERVALS"`
+	Format    string        `env:"FORMAT"    default:"auto"`
+	Formats   []string      `env:"FORMATS"`
+	Cache     string        `env:"CACHE"`
+	MaxSize   int64         `env:"MAX_SIZE"  default:"67108864"`
+	Timeout   time.Duration `env:"TIMEOUT"   default:"30s"`
+}
+
+const serviceName = "subscriptions"
+
+// source is a single list subscription, previous contains domains applied by the last refresh.
+type source struct {
+	name     string
+	location string
+	interval time.Duration
+	format   domain.Format
+	previous []string
+}
+
+type subscriptions struct {
+	Config
+
+	log     *logger.Logger
+	store   storage.API
+	fetcher *domain.Fetcher
+	sources []*source
+}
+
+// launcher is skipped by the runner when there are no sources.
+type launcher struct {
+	service.Service
+
+	enabled bool
+}
+
+func (l launcher) Enabled() bool { return l.enabled }
+
+// New creates the service that periodically synchronizes domains of list subscriptions with the store.
+// Manually added domains are never removed by synchronization.
+func New(cfg Config, log *logger.Logger, store storage.API) (service.Service, error) {
+	out := logger.Named(log, serviceName)
+
+	sources, err := cfg.newSources()
+	if err != nil {
+		return nil, err
+	}
+
+	svc := &subscriptions{
+		Config:  cfg,
+		log:     out,
+		store:   store,
+		fetcher: domain.NewFetcher(nil, cfg.Cache, cfg.MaxSize, out),
+		sources: sources,
+	}
+
+	return launcher{
+		enabled: len(sources) > 0,
+		Service: service.NewLauncher(serviceName, svc.run, func(ctx context.Context) {
+			out.InfoContext(ctx, "gracefully shutdown")
+		}),
+	}, nil
+}
+
+// newSources parses Sources, Intervals and Formats.
+func (c Config) newSources() ([]*source, error) {
+	if c.Timeout <= 0 || c.Interval <= 0 || c.MaxSize <= 0 {
+		return nil, fmt.Errorf("%s: timeout, interval and max size should be positive", serviceName)
+	}
+
+	format, err := domain.ParseFormat(c.Format)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", serviceName, err)
+	}
+
+	out := make([]*source, 0, len(c.Sources))
+	for _, entry := range c.Sources {
+		name, location, ok := strings.Cut(entry, "=")
+		if name, location = strings.TrimSpace(name), strings.TrimSpace(location); !ok || name == "" || location == "" {
+			return nil, fmt.Errorf("could not parse list source %q: expected name=location", entry)
+		}
+
+		if slices.ContainsFunc(out, func(item *source) bool { return item.name == name }) {
+			return nil, fmt.Errorf("could not parse list source %q: duplicate name", entry)
+		}
+
+		out = append(out, &source{name: name, location: location, interval: c.Interval, format: format})
+	}
+
+	for _, entry := range c.Intervals {
+		name, value, ok := strings.Cut(entry, "=")
+		index := slices.IndexFunc(out, func(item *source) bool { return item.name == strings.TrimSpace(name) })
+		interval, err := time.ParseDuration(strings.TrimSpace(value))
+		if !ok || index < 0 || err != nil || interval <= 0 {
+			return nil, fmt.Errorf("could not parse list interval %q: expected name=duration of known source", entry)
+		}
+
+		out[index].interval = interval
+	}
+
+	for _, entry := range c.Formats {
+		name, value, ok := strings.Cut(entry, "=")
+		index := slices.IndexFunc(out, func(item *source) bool { return item.name == strings.TrimSpace(name) })
+		if !ok || index < 0 {
+			return nil, fmt.Errorf("could not parse list format %q: expected name=format of known source", entry)
+		}
+
+		if out[index].format, err = domain.ParseFormat(value); err != nil {
+			return nil, fmt.Errorf("could not parse list format %q: %w", entry, err)
+		}
+	}
+
+	return out, nil
+}
+
+// run refreshes every source on its own interval until the context is done.
+func (s *subscriptions) run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, item := range s.sources {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			s.watch(ctx, item)
+		}()
+	}
+
+	wg.Wait()
+
+	return nil
+}
+
+// watch refreshes the source right away and then every interval.
+func (s *subscriptions) watch(ctx context.Context, item *source) {
+	// после перезапуска предыдущий список берётся из хранилища
+	item.previous = s.store.Subscribed(item.name)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		s.refresh(ctx, item)
+		timer.Reset(item.interval)
+	}
+}
+
+// refresh fetches the list and applies only domains added and removed since the previous refresh.
+func (s *subscriptions) refresh(top context.Context, item *source) {
+	ctx, cancel := context.WithTimeout(top, s.Timeout)
+	defer cancel()
+
+	res, err := s.fetcher.Load(ctx, item.location, item.format)
+	if err != nil {
+		s.log.ErrorContext(ctx, "could not fetch list, keep previous domains",
+			logger.String("source", item.name),
+			logger.Err(err))
+
+		return
+	}
+
+	list, invalid := res.Domains, res.Invalid
+	if len(invalid) > 0 {
+		s.log.WarnContext(ctx, "invalid lines in list are skipped",
+			logger.String("source", item.name),
+			logger.Int("invalid", len(invalid)),
+			logger.Any("examples", invalid[:min(len(invalid), 5)]))
+	}
+
+	// пустой список скорее означает сломанный источник, чем желание удалить все домены
+	if len(list) == 0 {
+		s.log.WarnContext(ctx, "list is empty, keep previous domains", logger.String("source", item.name))
+
+		return
+	}
+
+	add, remove := diff(item.previous, list)
+	if len(add) > 0 || len(remove) > 0 {
+		s.store.Subscribe(item.name, add, remove)
+	}
+
+	item.previous = list
+
+	s.log.InfoContext(ctx, "list synchronized",
+		logger.String("source", item.name),
+		logger.Int("domains", len(list)),
+		logger.Int("added", len(add)),
+		logger.Int("removed", len(remove)))
+}
+
+// diff returns domains of the next list missing in the previous one and domains of the previous list missing in the next.
+func diff(previous, next []string) ([]string, []string) {
+	seen := make(map[string]bool, len(previous)) // domain => found in the next list
+	for _, name := range previous {
+		seen[name] = false
+	}
+
+	var add, remove []string
+	for _, name := range next {
+		if _, ok := seen[name]; !ok {
+			add = append(add, name)
+		}
+
+		seen[name] = true
+	}
+
+	for _, name := range previous {
+		if !seen[name] {
+			remove = append(remove, name)
+		}
+	}
+
+	return add, remove
+}
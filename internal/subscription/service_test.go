@@ -0,0 +1,275 @@
+package subscription
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/im-kulikov/go-bones/logger"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+
+	"github.com/im-kulikov/resolvex/internal/broadcast"
+	"github.com/im-kulikov/resolvex/internal/domain"
+	"github.com/im-kulikov/resolvex/internal/storage"
+)
+
+type testBroadcaster struct{}
+
+func (testBroadcaster) Broadcast(broadcast.UpdateMessage) {}
+
+func TestConfig_Sources(t *testing.T) {
+	for _, wrong := range []Config{
+		{Sources: []string{"ads"}},
+		{Sources: []string{"=list.txt"}},
+		{Sources: []string{"ads=a.txt", "ads=b.txt"}},
+		{Sources: []string{"ads=a.txt"}, Intervals: []string{"cdn=1m"}},
+		{Sources: []string{"ads=a.txt"}, Intervals: []string{"ads=-1m"}},
+		{Sources: []string{"ads=a.txt"}, Format: "json"},
+		{Sources: []string{"ads=a.txt"}, MaxSize: -1},
+		{Sources: []string{"ads=a.txt"}, Formats: []string{"ads=json"}},
+		{Sources: []string{"ads=a.txt"}, Formats: []string{"cdn=hosts"}},
+	} {
+		wrong.Interval, wrong.Timeout = time.Hour, time.Second
+		if wrong.MaxSize == 0 {
+			wrong.MaxSize = 1 << 20
+		}
+
+		_, err := wrong.newSources()
+		require.Error(t, err, wrong)
+	}
+
+	list, err := Config{
+		Sources:   []string{"ads=https://example.com/list.txt?a=b", "local=file:///etc/list"},
+		Intervals: []string{"local=5m"},
+		Formats:   []string{"local=dnsmasq"},
+		Interval:  time.Hour,
+		MaxSize:   1 << 20,
+		Timeout:   time.Second,
+	}.newSources()
+	require.NoError(t, err)
+	require.Equal(t, []*source{
+		{name: "ads", location: "https://example.com/list.txt?a=b", interval: time.Hour, format: domain.FormatAuto},
+		{name: "local", location: "file:///etc/list", interval: 5 * time.Minute, format: domain.FormatDnsmasq},
+	}, list)
+}
+
+func TestSubscriptions_Refresh(t *testing.T) {
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	store, err := storage.New(storage.Config{}, log, testBroadcaster{}, []string{"manual.com"})
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "list.txt")
+	write := func(data string) { require.NoError(t, os.WriteFile(path, []byte(data), 0o600)) }
+
+	svc := &subscriptions{
+		Config:  Config{Timeout: time.Second},
+		log:     log,
+		store:   store,
+		fetcher: domain.NewFetcher(nil, "", 1<<20, log),
+	}
+
+	item := &source{name: "local", location: path}
+	domains := func() []string {
+		list := store.AllDomains()
+		slices.Sort(list)
+
+		return list
+	}
+
+	write("# comment\nA.com.\nb.com # inline\n\n10.0.0.1\nbad domain\nmanual.com\n")
+	svc.refresh(context.Background(), item)
+	require.Equal(t, []string{"a.com", "b.com", "manual.com"}, item.previous)
+	require.Equal(t, []string{"a.com", "b.com", "manual.com"}, domains())
+
+	// применяется только разница, домен оператора остаётся
+	write("b.com\nc.com\n")
+	svc.refresh(context.Background(), item)
+	require.Equal(t, []string{"b.com", "c.com"}, store.Subscribed("local"))
+	require.Equal(t, []string{"b.com", "c.com", "manual.com"}, domains())
+
+	// пустой или недоступный список не удаляет домены
+	write("# nothing\n")
+	svc.refresh(context.Background(), item)
+
+	item.location = filepath.Join(t.TempDir(), "missing.txt")
+	svc.refresh(context.Background(), item)
+	require.Equal(t, []string{"b.com", "c.com", "manual.com"}, domains())
+}
+
+func TestSubscriptions_Formats(t *testing.T) {
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+
+		return path
+	}
+
+	for _, tc := range []struct {
+		name   string
+		format domain.Format
+		data   string
+		expect []string
+	}{
+		{
+			name:   "hosts",
+			data:   "127.0.0.1 localhost\r\n0.0.0.0 a.com www.a.com # ads\r\n::1 ip6-localhost\r\n",
+			expect: []string{"a.com", "www.a.com"},
+		},
+		{
+			name: "dnsmasq",
+			data: "# vpn\nipset=/a.com/b.com/vpn4,vpn6\nnftset=/c.com/4#inet#fw4#vpn\nserver=/d.com/1.1.1.1\naddress=/e.com/0.0.0.0\n",
+			expect: []string{
+				"*.a.com", "*.b.com", "*.c.com", "*.d.com",
+				"a.com", "b.com", "c.com", "d.com",
+			},
+		},
+		{
+			name:   "adguard",
+			data:   "! title\n||a.com^\n@@||b.com^\n||c.com^$client=10.0.0.1\nexample.org##.banner\n0.0.0.0 d.com\ne.com\n",
+			expect: []string{"*.a.com", "a.com", "d.com", "e.com"},
+		},
+		{
+			name:   "v2fly",
+			format: domain.FormatV2fly,
+			data:   "include:cdn\na.com @ads\nfull:b.com\nkeyword:video\nregexp:^c\\.com$\n",
+			expect: []string{"*.a.com", "*.cdn.net", "a.com", "b.com", "cdn.net", "static.cdn.net"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			write("cdn", "domain:cdn.net\nfull:static.cdn.net\ninclude:v2fly\n")
+
+			store, err := storage.New(storage.Config{}, log, testBroadcaster{}, nil)
+			require.NoError(t, err)
+
+			svc := &subscriptions{
+				Config:  Config{Timeout: time.Second},
+				log:     log,
+				store:   store,
+				fetcher: domain.NewFetcher(nil, "", 1<<20, log),
+			}
+			item := &source{name: tc.name, location: write(tc.name, tc.data), format: tc.format}
+
+			svc.refresh(context.Background(), item)
+			require.Equal(t, tc.expect, store.Subscribed(tc.name))
+		})
+	}
+}
+
+type testListServer struct {
+	sync.Mutex
+
+	data     []byte
+	encoding string
+	down     bool
+	requests int
+	matched  int
+}
+
+func (l *testListServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.requests++
+	etag := fmt.Sprintf("%q", fmt.Sprintf("%x", sha256.Sum256(l.data)))
+
+	switch {
+	case l.down:
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case r.Header.Get("If-None-Match") == etag:
+		l.matched++
+		w.WriteHeader(http.StatusNotModified)
+	default:
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Encoding", l.encoding)
+		_, _ = w.Write(l.data)
+	}
+}
+
+func (l *testListServer) set(t *testing.T, data, encoding string) {
+	l.Lock()
+	defer l.Unlock()
+
+	var buf bytes.Buffer
+	switch encoding {
+	case "gzip":
+		writer := gzip.NewWriter(&buf)
+		_, err := writer.Write([]byte(data))
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+	case "zstd":
+		writer, err := zstd.NewWriter(&buf)
+		require.NoError(t, err)
+		_, err = writer.Write([]byte(data))
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+	default:
+		buf.WriteString(data)
+	}
+
+	l.data, l.encoding = buf.Bytes(), encoding
+}
+
+func TestSubscriptions_Fetch(t *testing.T) {
+	log := logger.ForTests(logger.TestLoggerWriteToTB(t))
+	lists := new(testListServer)
+	srv := httptest.NewServer(lists)
+	defer srv.Close()
+
+	cache := t.TempDir()
+	newService := func(maxSize int64) (*subscriptions, storage.Repository) {
+		store, err := storage.New(storage.Config{}, log, testBroadcaster{}, nil)
+		require.NoError(t, err)
+
+		return &subscriptions{
+			Config:  Config{Timeout: time.Second},
+			log:     log,
+			store:   store,
+			fetcher: domain.NewFetcher(srv.Client(), cache, maxSize, log),
+		}, store
+	}
+
+	svc, store := newService(1 << 20)
+	item := &source{name: "remote", location: srv.URL + "/list.txt", format: domain.FormatPlain}
+
+	lists.set(t, "a.com\nb.com\n", "gzip")
+	svc.refresh(context.Background(), item)
+	require.Equal(t, []string{"a.com", "b.com"}, store.Subscribed("remote"))
+
+	// список не изменился, сервер отвечает 304
+	svc.refresh(context.Background(), item)
+	require.Equal(t, 1, lists.matched)
+	require.Equal(t, []string{"a.com", "b.com"}, store.Subscribed("remote"))
+
+	lists.set(t, "b.com\nc.com\n", "zstd")
+	svc.refresh(context.Background(), item)
+	require.Equal(t, []string{"b.com", "c.com"}, store.Subscribed("remote"))
+
+	// после перезапуска недоступный источник заменяется сохранённой копией
+	lists.down = true
+	svc, store = newService(1 << 20)
+	item.previous = nil
+	svc.refresh(context.Background(), item)
+	require.Equal(t, []string{"b.com", "c.com"}, store.Subscribed("remote"))
+
+	// список больше ограничения не применяется
+	svc, store = newService(8)
+	lists.down = false
+	item.previous = nil
+	item.location = srv.URL + "/large.txt"
+	lists.set(t, "d.com\ne.com\nf.com\n", "")
+	svc.refresh(context.Background(), item)
+	require.Empty(t, store.Subscribed("remote"))
+}